@@ -1,16 +1,37 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
-	"github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/exp/slog"
+	"io"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 	"users/internal"
 	"users/internal/config"
 	"users/internal/handlers"
 	"users/internal/managers"
+	"users/pkg/checkpoint"
 	"users/pkg/database"
+	"users/pkg/events"
+	"users/pkg/logging"
+	"users/pkg/metrics"
+	"users/pkg/tlsconfig"
+	"users/pkg/tracing"
 )
 
 const (
@@ -22,29 +43,406 @@ const (
 
 AMC Users Service
 `
+	// configWatchInterval is the time between checks of the settings file.
+	configWatchInterval = 2 * time.Second
+	// certWatchInterval is the time between checks of the TLS certificate files.
+	certWatchInterval = 10 * time.Second
+	// exportCleanupInterval is the time between deletions of expired exports.
+	exportCleanupInterval = 10 * time.Minute
 )
 
 func main() {
 
-	if err := config.LoadConfiguration(); err != nil {
-		log.Fatal(err)
+	args, err := config.Load()
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		slog.Error("Error loading configuration", "error", err)
+		os.Exit(1)
+	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(logging.ParseLevel(config.Config.LogLevel))
+	slog.SetDefault(logging.New(os.Stdout, logLevel))
+	// The healthcheck asks the running service and config only shows the
+	// configuration, so they must not open the database nor run its migrations.
+	if len(args) > 0 && args[0] == "healthcheck" {
+		os.Exit(healthcheck())
+	}
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(configCommand(args[1:]))
 	}
 	db := database.InitDB(config.Config.DBName)
-	e := setUpServer(db)
-	e.Logger.Fatal(e.Start(config.Config.Host + ":" + config.Config.Port))
+	db.Timeout = dbTimeout(config.Config.DBTimeout)
+
+	if len(args) > 0 {
+		code := runCommand(db, args[0])
+		_ = db.Close()
+		os.Exit(code)
+	}
+
+	metrics.RegisterDatabase(db.Conn.DB, func() (int, error) { return database.GetDBVersion(db.Conn) })
+	stopTracing, err := tracing.Setup(context.Background(), config.Config.TracingEndpoint, "amc-users")
+	if err != nil {
+		slog.Error("Error setting up tracing", "error", err)
+		os.Exit(1)
+	}
+	tlsConfig, certs, err := serverTLS()
+	if err != nil {
+		slog.Error("Error setting up TLS", "error", err)
+		os.Exit(1)
+	}
+
+	// ctx is done on SIGINT or SIGTERM, stopping the workers and the server.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	workers := &sync.WaitGroup{}
+	startWorker(workers, func() { watchConfig(ctx, logLevel) })
+	if certs != nil {
+		startWorker(workers, func() { certs.Run(ctx, certWatchInterval) })
+	}
+	startAuditCheckpoints(ctx, workers, *db)
+	webhookManager := managers.NewWebhookManager(*db)
+	startOutboxDispatcher(ctx, workers, *db, webhookManager)
+	exportManager := managers.NewExportManager(*db)
+	exportManager.ResumeExportJobs(ctx)
+	startWorker(workers, func() { exportManager.RunExportCleanup(ctx, exportCleanupInterval) })
+	e := setUpServer(db, webhookManager, exportManager)
+	go func() {
+		if err := startServer(e, config.Config.Host+":"+config.Config.Port, tlsConfig); err != nil && err != http.ErrServerClosed {
+			slog.Error("Error starting server", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout(config.Config.ShutdownTimeout))
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Error draining requests", "error", err)
+	}
+	startWorker(workers, exportManager.Wait)
+	if !waitWorkers(shutdownCtx, workers) {
+		slog.Warn("Workers still running after the shutdown timeout")
+	}
+	if err := stopTracing(shutdownCtx); err != nil {
+		slog.Warn("Error flushing traces", "error", err)
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("Error closing database", "error", err)
+	}
+	slog.Info("Shut down")
+
+}
+
+// runCommand runs a one-off subcommand and returns the process exit code.
+func runCommand(db *database.Database, command string) int {
+	switch command {
+	case "verify-audit":
+		result, err := managers.NewAuditManager(*db).VerifyAuditChain(context.Background())
+		if err != nil {
+			slog.Error("Error verifying audit chain", "error", err)
+			return 2
+		}
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
+		if !result.Valid {
+			return 1
+		}
+		return 0
+	case "audit-public-key":
+		key, err := checkpoint.ParseKey(config.Config.AuditCheckpointKey)
+		if err != nil {
+			slog.Error("Error reading AUDIT_CHECKPOINT_KEY", "error", err)
+			return 2
+		}
+		fmt.Println(checkpoint.EncodePublicKey(key))
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q, available: verify-audit, audit-public-key, healthcheck, config\n", command)
+		return 2
+	}
+}
+
+// configCommand runs the config subcommand: print writes the configuration
+// in effect, with its secrets masked; generate-key writes a new key for
+// SECRETS_KEYS; seal-secrets seals the NAME=value lines of its input with the
+// first key of SECRETS_KEYS; rotate-secrets seals a secrets file again with
+// the first key, opening it with any.
+func configCommand(args []string) int {
+	var err error
+	switch {
+	case len(args) == 1 && args[0] == "print":
+		config.Config.Print(os.Stdout)
+	case len(args) == 1 && args[0] == "generate-key":
+		var key string
+		if key, err = config.GenerateSecretsKey(); err == nil {
+			fmt.Println(key)
+		}
+	case len(args) == 1 && args[0] == "seal-secrets":
+		err = sealSecrets()
+	case len(args) == 2 && args[0] == "rotate-secrets":
+		err = rotateSecrets(args[1])
+	default:
+		fmt.Fprintln(os.Stderr, "usage: config print | generate-key | seal-secrets < secrets.env | rotate-secrets FILE")
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// sealSecrets writes the secrets read from stdin sealed with the first key.
+func sealSecrets() error {
+	keys, err := config.SecretsKeys()
+	if err != nil {
+		return err
+	}
+	secrets, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	sealed, err := config.SealSecrets(secrets, keys[0])
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(sealed)
+	return err
+}
+
+// rotateSecrets seals the secrets file at path again with the first key,
+// replacing it only once written.
+func rotateSecrets(path string) error {
+	keys, err := config.SecretsKeys()
+	if err != nil {
+		return err
+	}
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	secrets, err := config.OpenSecrets(sealed, keys)
+	if err != nil {
+		return err
+	}
+	if sealed, err = config.SealSecrets(secrets, keys[0]); err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, sealed, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// healthcheck asks the readiness of the service listening on the configured
+// port, for container health checks in images without curl. It returns 0 when
+// ready and 1 otherwise.
+func healthcheck() int {
+	host := config.Config.Host
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	scheme := "http"
+	if config.Config.TLSCertFile != "" {
+		scheme = "https"
+		// The service is asked at a local address its certificate is not
+		// issued for. It is shown its own certificate in case it requires
+		// client certificates from a CA that issued it.
+		tlsConfig := &tls.Config{InsecureSkipVerify: true}
+		if cert, err := tls.LoadX509KeyPair(config.Config.TLSCertFile, config.Config.TLSKeyFile); err == nil {
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	resp, err := client.Get(scheme + "://" + net.JoinHostPort(host, config.Config.Port) + internal.RouteReadiness)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return 1
+	}
+	return 0
+}
+
+// serverTLS returns the TLS configuration of the server and the reloader of
+// its certificate, both nil when no certificate is configured.
+func serverTLS() (*tls.Config, *tlsconfig.CertReloader, error) {
+	if config.Config.TLSCertFile == "" {
+		return nil, nil, nil
+	}
+	certs, err := tlsconfig.NewCertReloader(config.Config.TLSCertFile, config.Config.TLSKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig, err := tlsconfig.Server(certs, config.Config.TLSClientAuth, config.Config.TLSClientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tlsConfig, certs, nil
+}
+
+// startServer serves e on address, over TLS and HTTP/2 when tlsConfig is set.
+func startServer(e *echo.Echo, address string, tlsConfig *tls.Config) error {
+	if tlsConfig == nil {
+		return e.Start(address)
+	}
+	e.TLSServer.Addr = address
+	e.TLSServer.TLSConfig = tlsConfig
+	return e.StartServer(e.TLSServer)
+}
+
+// dbTimeout parses the configured database timeout, falling back to 5s.
+func dbTimeout(timeout string) time.Duration {
+	if timeout == "" {
+		return 5 * time.Second
+	}
+	duration, err := time.ParseDuration(timeout)
+	if err != nil || duration < 0 {
+		slog.Warn("Wrong database timeout, using 5s", "timeout", timeout)
+		return 5 * time.Second
+	}
+	return duration
+}
 
+// shutdownTimeout parses the configured shutdown timeout, falling back to 10s.
+func shutdownTimeout(timeout string) time.Duration {
+	duration, err := time.ParseDuration(timeout)
+	if err != nil || duration <= 0 {
+		if timeout != "" {
+			slog.Warn("Wrong shutdown timeout, using 10s", "timeout", timeout)
+		}
+		return 10 * time.Second
+	}
+	return duration
+}
+
+// waitWorkers waits for the workers to return, telling whether they did
+// before ctx was done.
+func waitWorkers(ctx context.Context, workers *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
-func setUpServer(db *database.Database) *echo.Echo {
+// startWorker runs worker in the background, tracked by workers.
+func startWorker(workers *sync.WaitGroup, worker func()) {
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		worker()
+	}()
+}
+
+// watchConfig reloads the configuration on SIGHUP and when its settings file
+// is modified, until ctx is done.
+func watchConfig(ctx context.Context, logLevel *slog.LevelVar) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	modified := config.WatchFile(ctx, configWatchInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		case <-modified:
+		}
+		if _, err := config.Reload(); err != nil {
+			slog.Error("Error reloading configuration, keeping the current one", "error", err)
+			continue
+		}
+		logLevel.Set(logging.ParseLevel(config.Current().LogLevel))
+	}
+}
+
+func startAuditCheckpoints(ctx context.Context, workers *sync.WaitGroup, db database.Database) {
+	if config.Config.AuditCheckpointFile == "" || config.Config.AuditCheckpointKey == "" {
+		return
+	}
+	interval, err := time.ParseDuration(config.Config.AuditCheckpointInterval)
+	if err != nil || interval <= 0 {
+		interval = time.Hour
+	}
+	auditManager := managers.NewAuditManager(db)
+	startWorker(workers, func() { auditManager.RunAuditCheckpoints(ctx, interval) })
+}
+
+// startOutboxDispatcher delivers outbox events to the configured sinks and to
+// the webhook subscriptions, whose deliveries are then sent by their own worker.
+func startOutboxDispatcher(ctx context.Context, workers *sync.WaitGroup, db database.Database, webhookManager *managers.WebhookManager) {
+	sinks := []events.Sink{webhookManager.Sink()}
+	for _, name := range strings.Split(config.Config.OutboxSinks, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "stdout":
+			sinks = append(sinks, events.NewWriterSink(os.Stdout))
+		case "http":
+			sinks = append(sinks, events.NewHTTPSink(config.Config.OutboxWebhookURL))
+		case "nats":
+			subject := config.Config.OutboxNATSSubject
+			if subject == "" {
+				subject = "users"
+			}
+			var options []nats.Option
+			if config.Config.OutboxNATSCredsFile != "" {
+				options = append(options, nats.UserCredentials(config.Config.OutboxNATSCredsFile))
+			}
+			if config.Config.OutboxNATSCAFile != "" {
+				options = append(options, nats.RootCAs(config.Config.OutboxNATSCAFile))
+			}
+			sinks = append(sinks, events.NewNATSSink(config.Config.OutboxNATSURL, subject, options...))
+		default:
+			slog.Warn("Unknown outbox sink", "sink", name)
+		}
+	}
+	interval, err := time.ParseDuration(config.Config.OutboxPollInterval)
+	if err != nil || interval <= 0 {
+		interval = time.Second
+	}
+	dispatcher := managers.NewOutboxDispatcher(db, sinks...)
+	startWorker(workers, func() { dispatcher.Run(ctx, interval) })
+	startWorker(workers, func() { webhookManager.Run(ctx, interval) })
+}
+
+func setUpServer(db *database.Database, webhookManager *managers.WebhookManager, exportManager *managers.ExportManager) *echo.Echo {
 	e := echo.New()
-	e.Use(middleware.Logger())
+	if strict, _ := strconv.ParseBool(config.Config.StrictBody); strict {
+		e.JSONSerializer = internal.StrictJSONSerializer{}
+	}
+	e.Use(logging.Middleware(slog.Default()))
+	e.Use(tracing.Middleware())
+	e.Use(metrics.Middleware())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
-		AllowMethods: []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete},
+		AllowOriginFunc: func(origin string) (bool, error) {
+			return config.Current().AllowsOrigin(origin), nil
+		},
+		AllowMethods:  []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete},
+		ExposeHeaders: []string{internal.HeaderETag},
 	}))
 
-	addRoutes(e, *db)
+	addRoutes(e, *db, webhookManager, exportManager)
 	e.HideBanner = true
 	fmt.Printf(banner)
 
@@ -52,14 +450,45 @@ func setUpServer(db *database.Database) *echo.Echo {
 
 }
 
-func addRoutes(e *echo.Echo, db database.Database) {
+func addRoutes(e *echo.Echo, db database.Database, webhookManager *managers.WebhookManager, exportManager *managers.ExportManager) {
+
+	healthAPI := handlers.HealthAPI{DB: db, Manager: managers.NewHealthManager(db)}
+	e.GET(internal.RouteLiveness, healthAPI.LivenessHandler)
+	e.GET(internal.RouteReadiness, healthAPI.ReadinessHandler)
+	e.GET(internal.RouteMetrics, metrics.Handler())
 
 	userManager := managers.NewUserManager(db)
 
-	userAPI := handlers.UserAPI{DB: db, Manager: userManager}
+	requireIfMatch, _ := strconv.ParseBool(config.Config.RequireIfMatch)
+	userAPI := handlers.UserAPI{DB: db, Manager: userManager, RequireIfMatch: requireIfMatch}
+	e.HTTPErrorHandler = internal.NewHTTPErrorHandler(userAPI.ActorLocale)
 	e.POST(internal.RouteLogin, userAPI.Login)
 	e.POST(internal.RouteUser, userAPI.PostUserHandler)
 	e.GET(internal.RouteUserID, userAPI.GetUserHandler)
 	e.PUT(internal.RouteUserID, userAPI.PutUserHandler)
 	e.DELETE(internal.RouteUserID, userAPI.DeleteUserHandler)
+	e.GET(internal.RouteUserDeletionImpact, userAPI.GetDeletionImpactHandler, handlers.RequireSelfOrAdmin)
+	e.POST(internal.RouteUserAnonymize, userAPI.AnonymizeUserHandler, handlers.RequireSelfOrAdmin)
+
+	avatarAPI := handlers.AvatarAPI{DB: db, Manager: managers.NewAvatarManager(db)}
+	e.PUT(internal.RouteUserAvatar, avatarAPI.PutAvatarHandler)
+	e.GET(internal.RouteUserAvatar, avatarAPI.GetAvatarHandler)
+
+	exportAPI := handlers.ExportAPI{DB: db, Manager: exportManager}
+	e.GET(internal.RouteUserExport, exportAPI.GetExportHandler, handlers.RequireSelfOrAdmin)
+	e.GET(internal.RouteUserExportID, exportAPI.GetExportJobHandler, handlers.RequireSelfOrAdmin)
+	e.GET(internal.RouteUserExportDownload, exportAPI.DownloadExportHandler, handlers.RequireSelfOrAdmin)
+
+	auditAPI := handlers.AuditAPI{DB: db, Manager: managers.NewAuditManager(db)}
+	e.GET(internal.RouteUserAudit, auditAPI.GetUserAuditHandler, handlers.RequireSelfOrAdmin)
+	e.GET(internal.RouteAudit, auditAPI.GetAuditHandler, handlers.RequireAdmin)
+
+	webhookAPI := handlers.WebhookAPI{DB: db, Manager: webhookManager}
+	e.POST(internal.RouteWebhooks, webhookAPI.PostWebhookHandler, handlers.RequireAdmin)
+	e.GET(internal.RouteWebhooks, webhookAPI.GetWebhooksHandler, handlers.RequireAdmin)
+	e.GET(internal.RouteWebhookID, webhookAPI.GetWebhookHandler, handlers.RequireAdmin)
+	e.PUT(internal.RouteWebhookID, webhookAPI.PutWebhookHandler, handlers.RequireAdmin)
+	e.DELETE(internal.RouteWebhookID, webhookAPI.DeleteWebhookHandler, handlers.RequireAdmin)
+	e.GET(internal.RouteWebhookDeliveries, webhookAPI.GetDeliveriesHandler, handlers.RequireAdmin)
+	e.POST(internal.RouteWebhookRedeliver, webhookAPI.RedeliverHandler, handlers.RequireAdmin)
 }
@@ -3,16 +3,26 @@ module users
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/go-playground/validator/v10 v10.11.2
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/joho/godotenv v1.5.1
 	github.com/json-iterator/go v1.1.12
 	github.com/labstack/echo/v4 v4.9.1
-	github.com/labstack/gommon v0.4.0
 	github.com/mattn/go-colorable v0.1.12 // indirect
+	github.com/nats-io/nats.go v1.25.0
 	github.com/oklog/ulid/v2 v2.1.0
-	github.com/stretchr/testify v1.8.1
-	golang.org/x/crypto v0.5.0
-	golang.org/x/time v0.1.0 // indirect
+	github.com/prometheus/client_golang v1.14.0
+	github.com/stretchr/testify v1.8.2
+	go.opentelemetry.io/otel v1.14.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.14.0
+	go.opentelemetry.io/otel/sdk v1.14.0
+	go.opentelemetry.io/otel/trace v1.14.0
+	golang.org/x/crypto v0.6.0
+	golang.org/x/exp v0.0.0-20230315142452-642cacee5cc0
+	golang.org/x/image v0.5.0
+	golang.org/x/sys v0.5.0
+	golang.org/x/text v0.7.0
+	gopkg.in/yaml.v3 v3.0.1
 	modernc.org/sqlite v1.23.1
 )
@@ -1,30 +1,129 @@
 package config
 
-import (
-	"github.com/joho/godotenv"
-	"os"
-)
+import "strings"
 
 var Config Configuration
 
-// Configuration settings of the service.
+// Configuration settings of the service. Each one is named by its mapstructure
+// tag, starts from its default tag, must pass the rules of its validate tag,
+// is masked when printed if it has a secret tag, as are the credentials of a
+// URL, and can change while running if it has a reload tag, read from Current.
 type Configuration struct {
 	// Host --> Default 0.0.0.0
-	Host string `mapstructure:"HOST" json:"host" default:"0.0.0.0"`
-	// Port --> Default 49100
-	Port string `mapstructure:"PORT" json:"port" default:"3100"`
-	// DBName --> Name of the database. Default "amc.db"
-	DBName string `mapstructure:"DB_NAME" json:"DBName" default:"amc.db"`
+	Host string `mapstructure:"HOST" json:"host" default:"0.0.0.0" validate:"omitempty,ip|hostname"`
+	// Port --> Default 3100
+	Port string `mapstructure:"PORT" json:"port" default:"3100" validate:"port"`
+	// DBName --> Name of the database, relative to the parent of the working directory. Default "/amc.db"
+	DBName string `mapstructure:"DB_NAME" json:"DBName" default:"/amc.db" validate:"required,startswith=/"`
+	// DBTimeout --> Longest a database call made for a request may take, 0 for no limit. Default 5s
+	DBTimeout string `mapstructure:"DB_TIMEOUT" json:"DBTimeout" default:"5s" validate:"omitempty,duration"`
+	// ShutdownTimeout --> Longest the service waits on shutdown for the requests in flight and the workers. Default 10s
+	ShutdownTimeout string `mapstructure:"SHUTDOWN_TIMEOUT" json:"shutdownTimeout" default:"10s" validate:"omitempty,duration"`
+	// CORSAllowOrigins --> Comma separated origins allowed to call the service, * for any. Default *
+	CORSAllowOrigins string `mapstructure:"CORS_ALLOW_ORIGINS" json:"corsAllowOrigins" default:"*" reload:"true"`
+	// AdminUsers --> Comma separated ids of the users acting as administrators, as given in X-User-ID. Optional
+	AdminUsers string `mapstructure:"ADMIN_USERS" json:"adminUsers" reload:"true"`
+	// TLSCertFile --> PEM certificate served over TLS, loaded again when it changes. Plain HTTP when not set
+	TLSCertFile string `mapstructure:"TLS_CERT_FILE" json:"tlsCertFile" validate:"required_with=TLSKeyFile,omitempty,file"`
+	// TLSKeyFile --> PEM private key of TLS_CERT_FILE
+	TLSKeyFile string `mapstructure:"TLS_KEY_FILE" json:"tlsKeyFile" validate:"required_with=TLSCertFile,omitempty,file"`
+	// TLSClientAuth --> Client certificates asked over TLS: none, verify those given, or require one. Default none
+	TLSClientAuth string `mapstructure:"TLS_CLIENT_AUTH" json:"tlsClientAuth" default:"none" validate:"omitempty,oneof=none verify require"`
+	// TLSClientCAFile --> PEM CAs client certificates are verified against
+	TLSClientCAFile string `mapstructure:"TLS_CLIENT_CA_FILE" json:"tlsClientCAFile" validate:"omitempty,file"`
+	// HealthMinFreeDisk --> Free bytes below which the disk of the database is reported not ready. Default 104857600
+	HealthMinFreeDisk string `mapstructure:"HEALTH_MIN_FREE_DISK" json:"healthMinFreeDisk" default:"104857600" validate:"omitempty,number"`
+	// TracingEndpoint --> URL of the OTLP/HTTP collector traces are exported to, e.g. http://collector:4318. Optional
+	TracingEndpoint string `mapstructure:"TRACING_ENDPOINT" json:"tracingEndpoint" validate:"omitempty,url"`
+	// LogLevel --> Lowest level logged: debug, info, warn or error. Default info
+	LogLevel string `mapstructure:"LOG_LEVEL" json:"logLevel" default:"info" validate:"omitempty,oneof=debug info warn error DEBUG INFO WARN ERROR" reload:"true"`
+	// PwnedPasswordsFile --> Sorted SHA-1 breached-password corpus. Optional
+	PwnedPasswordsFile string `mapstructure:"PWNED_PASSWORDS_FILE" json:"pwnedPasswordsFile" validate:"omitempty,file" reload:"true"`
+	// PwnedPasswordsURL --> Base URL of a k-anonymity range API. Optional
+	PwnedPasswordsURL string `mapstructure:"PWNED_PASSWORDS_URL" json:"pwnedPasswordsURL" validate:"omitempty,url" reload:"true"`
+	// AuditCheckpointFile --> File signed audit checkpoints are appended to. Optional
+	AuditCheckpointFile string `mapstructure:"AUDIT_CHECKPOINT_FILE" json:"auditCheckpointFile" validate:"omitempty,parentdir"`
+	// AuditCheckpointKey --> Base64 ed25519 seed used to sign audit checkpoints
+	AuditCheckpointKey string `mapstructure:"AUDIT_CHECKPOINT_KEY" json:"auditCheckpointKey" secret:"true"`
+	// AuditCheckpointPublicKey --> Base64 ed25519 public key audit checkpoints are verified with, as printed by audit-public-key
+	AuditCheckpointPublicKey string `mapstructure:"AUDIT_CHECKPOINT_PUBLIC_KEY" json:"auditCheckpointPublicKey"`
+	// AuditCheckpointInterval --> Time between audit checkpoints. Default 1h
+	AuditCheckpointInterval string `mapstructure:"AUDIT_CHECKPOINT_INTERVAL" json:"auditCheckpointInterval" default:"1h" validate:"omitempty,duration"`
+	// OutboxSinks --> Comma separated sinks user events are dispatched to: stdout, http, nats. Optional
+	OutboxSinks string `mapstructure:"OUTBOX_SINKS" json:"outboxSinks"`
+	// OutboxWebhookURL --> URL events are posted to by the http sink
+	OutboxWebhookURL string `mapstructure:"OUTBOX_WEBHOOK_URL" json:"outboxWebhookURL" validate:"omitempty,url"`
+	// OutboxNATSURL --> Address of the NATS server used by the nats sink, tls:// for TLS. It may carry a user and password or a token
+	OutboxNATSURL string `mapstructure:"OUTBOX_NATS_URL" json:"outboxNATSURL" default:"nats://127.0.0.1:4222" validate:"omitempty,url"`
+	// OutboxNATSCredsFile --> NATS credentials file, with the JWT and nkey seed of the nats sink. Optional
+	OutboxNATSCredsFile string `mapstructure:"OUTBOX_NATS_CREDS_FILE" json:"outboxNATSCredsFile" validate:"omitempty,file"`
+	// OutboxNATSCAFile --> PEM CAs the certificate of the NATS server is verified against. Default the system ones
+	OutboxNATSCAFile string `mapstructure:"OUTBOX_NATS_CA_FILE" json:"outboxNATSCAFile" validate:"omitempty,file"`
+	// OutboxNATSSubject --> Prefix of the subjects events are published on. Default "users"
+	OutboxNATSSubject string `mapstructure:"OUTBOX_NATS_SUBJECT" json:"outboxNATSSubject" default:"users"`
+	// OutboxPollInterval --> Time between outbox dispatches. Default 1s
+	OutboxPollInterval string `mapstructure:"OUTBOX_POLL_INTERVAL" json:"outboxPollInterval" default:"1s" validate:"omitempty,duration"`
+	// WebhookDisableAfter --> Consecutive failed attempts that disable a webhook. Default 20
+	WebhookDisableAfter string `mapstructure:"WEBHOOK_DISABLE_AFTER" json:"webhookDisableAfter" default:"20" validate:"omitempty,number"`
+	// WebhookAllowPrivate --> Let webhooks reach loopback, private and link-local addresses, for local setups. Default false
+	WebhookAllowPrivate string `mapstructure:"WEBHOOK_ALLOW_PRIVATE" json:"webhookAllowPrivate" default:"false" validate:"omitempty,boolean"`
+	// UserDeletionPolicy --> What happens to the meals and calendar of a deleted user: cascade, reassign or block. Default cascade
+	UserDeletionPolicy string `mapstructure:"USER_DELETION_POLICY" json:"userDeletionPolicy" default:"cascade" validate:"omitempty,oneof=cascade reassign block"`
+	// UserDeletionReassignTo --> User receiving the data of deleted users with the reassign policy
+	UserDeletionReassignTo string `mapstructure:"USER_DELETION_REASSIGN_TO" json:"userDeletionReassignTo"`
+	// RequireIfMatch --> Reject user updates and deletions without an If-Match header. Default false
+	RequireIfMatch string `mapstructure:"REQUIRE_IF_MATCH" json:"requireIfMatch" default:"false" validate:"omitempty,boolean"`
+	// StrictBody --> Reject request bodies with fields the endpoint does not know. Default false
+	StrictBody string `mapstructure:"STRICT_BODY" json:"strictBody" default:"false" validate:"omitempty,boolean"`
+	// ErasedMailBlockPeriod --> Time the mail of an anonymized user cannot be registered again, 0 to allow it. Default 720h
+	ErasedMailBlockPeriod string `mapstructure:"ERASED_MAIL_BLOCK_PERIOD" json:"erasedMailBlockPeriod" default:"720h" validate:"omitempty,duration"`
+	// MailHashKey --> Secret of at least 32 characters the mails of anonymized users are hashed with, so the hashes can't be reversed by guessing
+	MailHashKey string `mapstructure:"MAIL_HASH_KEY" json:"mailHashKey" secret:"true" validate:"required,min=32"`
+	// AvatarStore --> Where avatars are stored: local or s3. Default local
+	AvatarStore string `mapstructure:"AVATAR_STORE" json:"avatarStore" default:"local" validate:"omitempty,oneof=local s3"`
+	// AvatarDir --> Directory of the local avatar store. Default "avatars"
+	AvatarDir string `mapstructure:"AVATAR_DIR" json:"avatarDir" default:"avatars"`
+	// AvatarMaxSize --> Largest avatar upload in bytes. Default 5242880
+	AvatarMaxSize string `mapstructure:"AVATAR_MAX_SIZE" json:"avatarMaxSize" default:"5242880" validate:"omitempty,number"`
+	// AvatarS3Endpoint --> URL of the S3 compatible store, objects are addressed path style
+	AvatarS3Endpoint string `mapstructure:"AVATAR_S3_ENDPOINT" json:"avatarS3Endpoint" validate:"omitempty,url"`
+	// AvatarS3Bucket --> Bucket avatars are stored in
+	AvatarS3Bucket string `mapstructure:"AVATAR_S3_BUCKET" json:"avatarS3Bucket"`
+	// AvatarS3Region --> Region of the bucket. Default us-east-1
+	AvatarS3Region string `mapstructure:"AVATAR_S3_REGION" json:"avatarS3Region" default:"us-east-1"`
+	// AvatarS3AccessKey --> Access key of the S3 compatible store
+	AvatarS3AccessKey string `mapstructure:"AVATAR_S3_ACCESS_KEY" json:"avatarS3AccessKey"`
+	// AvatarS3SecretKey --> Secret key of the S3 compatible store
+	AvatarS3SecretKey string `mapstructure:"AVATAR_S3_SECRET_KEY" json:"avatarS3SecretKey" secret:"true"`
+	// ExportDir --> Directory asynchronous data exports are written to. Default the system temp dir
+	ExportDir string `mapstructure:"EXPORT_DIR" json:"exportDir" validate:"omitempty,dir"`
+	// ExportTTL --> Time an asynchronous export is kept once generated. Default 24h
+	ExportTTL string `mapstructure:"EXPORT_TTL" json:"exportTTL" default:"24h" validate:"omitempty,duration"`
+	// ExportAsyncThreshold --> Rows above which a data export is generated asynchronously. Default 1000
+	ExportAsyncThreshold string `mapstructure:"EXPORT_ASYNC_THRESHOLD" json:"exportAsyncThreshold" default:"1000" validate:"omitempty,number"`
 }
 
-func LoadConfiguration() error {
-	err := godotenv.Load("./internal/config/.env")
-	if err != nil {
-		return err
+// IsAdmin tells whether the user id is one of AdminUsers.
+func (c Configuration) IsAdmin(id string) bool {
+	if id == "" {
+		return false
 	}
-	Config.Host = os.Getenv("HOST")
-	Config.Port = os.Getenv("PORT")
-	Config.DBName = os.Getenv("DB_NAME")
+	for _, admin := range strings.Split(c.AdminUsers, ",") {
+		if strings.TrimSpace(admin) == id {
+			return true
+		}
+	}
+	return false
+}
 
-	return nil
+// AllowsOrigin tells whether origin is one of CORSAllowOrigins, or they
+// allow any.
+func (c Configuration) AllowsOrigin(origin string) bool {
+	for _, allowed := range strings.Split(c.CORSAllowOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,379 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/go-playground/validator/v10"
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvFile is read for the settings not in the environment, if it exists.
+const EnvFile = "./internal/config/.env"
+
+// FileVariable names the YAML or TOML file read for settings, also given by
+// the --config flag.
+const FileVariable = "CONFIG_FILE"
+
+const masked = "********"
+
+// Source tells where settings are read from, so tests can do without the
+// process environment and files.
+type Source struct {
+	// Args are the command line arguments, without the program name.
+	Args []string
+	// EnvFile is the .env file read, ignored when it does not exist.
+	EnvFile string
+	// LookupEnv reads a variable of the environment.
+	LookupEnv func(name string) (string, bool)
+}
+
+// setting is a field of Configuration and the variable it is read from.
+type setting struct {
+	field  int
+	name   string
+	value  string
+	secret bool
+	// url masks the credentials a URL can carry in its userinfo and query.
+	url    bool
+	reload bool
+}
+
+// Load reads Config from the process and returns the arguments that are not
+// flags, as the subcommand to run.
+func Load() ([]string, error) {
+	return use(Source{Args: os.Args[1:], EnvFile: EnvFile, LookupEnv: os.LookupEnv})
+}
+
+// use loads Config from s, which Reload then reads again.
+func use(s Source) ([]string, error) {
+	config, args, file, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	Config = config
+	loaded = s
+	loadedFile.Store(file)
+	current.Store(&config)
+	return args, nil
+}
+
+// Load builds a configuration from, by increasing precedence, the defaults
+// of Configuration, the YAML or TOML file named by the --config flag or by
+// CONFIG_FILE, the .env file, the secrets file named by the --secrets-file
+// flag or by SECRETS_FILE, the environment and the command line flags, one
+// per setting with the name of its variable, as --db-name for DB_NAME. A
+// variable NAME_FILE in the environment names a file NAME is read from.
+// Empty variables are taken as not set. It returns the configuration, once
+// valid, and the arguments that are not flags.
+func (s Source) Load() (Configuration, []string, error) {
+	config, args, _, err := s.load()
+	return config, args, err
+}
+
+// load is Load also returning the settings file read, if any.
+func (s Source) load() (Configuration, []string, string, error) {
+	settings := defaults()
+	byName := map[string]*setting{}
+	for i := range settings {
+		byName[settings[i].name] = &settings[i]
+	}
+
+	flags := flag.NewFlagSet("users", flag.ContinueOnError)
+	file := flags.String("config", "", "YAML or TOML file to read settings from")
+	secretsFile := flags.String("secrets-file", "", "sealed file to read secret settings from")
+	for _, st := range settings {
+		flags.String(flagName(st.name), "", "sets "+st.name)
+	}
+	args, err := parseFlags(flags, s.Args)
+	if err != nil {
+		return Configuration{}, nil, "", err
+	}
+
+	dotenv, err := godotenv.Read(s.EnvFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Configuration{}, nil, "", fmt.Errorf("reading %s: %w", s.EnvFile, err)
+	}
+	lookup := func(name string) string {
+		if value, ok := s.LookupEnv(name); ok && value != "" {
+			return value
+		}
+		return dotenv[name]
+	}
+
+	if *file == "" {
+		*file = lookup(FileVariable)
+	}
+	if *file != "" {
+		values, err := readFile(*file)
+		if err != nil {
+			return Configuration{}, nil, "", err
+		}
+		for name, value := range values {
+			st, ok := byName[name]
+			if !ok {
+				return Configuration{}, nil, "", fmt.Errorf("%s: unknown setting %s", *file, name)
+			}
+			st.value = value
+		}
+	}
+	for _, st := range settings {
+		if value := dotenv[st.name]; value != "" {
+			byName[st.name].value = value
+		}
+	}
+	if *secretsFile == "" {
+		*secretsFile = lookup(SecretsFileVariable)
+	}
+	if *secretsFile != "" {
+		values, err := s.readSecrets(*secretsFile)
+		if err != nil {
+			return Configuration{}, nil, "", err
+		}
+		for name, value := range values {
+			st, ok := byName[name]
+			if !ok {
+				return Configuration{}, nil, "", fmt.Errorf("%s: unknown setting %s", *secretsFile, name)
+			}
+			if value != "" {
+				st.value = value
+			}
+		}
+	}
+	for _, st := range settings {
+		value, err := s.env(st.name)
+		if err != nil {
+			return Configuration{}, nil, "", err
+		}
+		if value != "" {
+			byName[st.name].value = value
+		}
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if st, ok := byName[strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))]; ok {
+			st.value = f.Value.String()
+		}
+	})
+
+	var config Configuration
+	values := reflect.ValueOf(&config).Elem()
+	for _, st := range settings {
+		values.Field(st.field).SetString(st.value)
+	}
+	if err = config.Validate(); err != nil {
+		return Configuration{}, nil, "", err
+	}
+	return config, args, *file, nil
+}
+
+// defaults lists the settings of Configuration with their default values.
+func defaults() []setting {
+	t := reflect.TypeOf(Configuration{})
+	settings := make([]setting, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		settings = append(settings, setting{
+			field:  i,
+			name:   field.Tag.Get("mapstructure"),
+			value:  field.Tag.Get("default"),
+			secret: field.Tag.Get("secret") == "true",
+			url:    isURL(field.Tag.Get("validate")),
+			reload: field.Tag.Get("reload") == "true",
+		})
+	}
+	return settings
+}
+
+func flagName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+// parseFlags parses the flags found anywhere in args, before or after the
+// subcommand, and returns the other arguments.
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var rest []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return rest, nil
+		}
+		rest = append(rest, args[0])
+		args = args[1:]
+	}
+}
+
+// readFile reads the settings of a YAML or TOML file, by the name of their
+// variable in any case. Lists are joined with commas.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("%s: configuration files must be .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for key, value := range raw {
+		name := strings.ToUpper(key)
+		switch v := value.(type) {
+		case map[string]interface{}:
+			return nil, fmt.Errorf("%s: %s must not be a table", path, name)
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	return values, nil
+}
+
+// Validate checks every setting against the rules of its validate tag and
+// reports all that break them.
+func (c Configuration) Validate() error {
+	err := validate.Struct(c)
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return err
+	}
+	problems := make([]string, 0, len(errs))
+	for _, fe := range errs {
+		problems = append(problems, fmt.Sprintf("%s %s, got %q", fe.Field(), ruleMessage(fe), fe.Value()))
+	}
+	return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+}
+
+var validate = newValidator()
+
+func newValidator() *validator.Validate {
+	v := validator.New()
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		return field.Tag.Get("mapstructure")
+	})
+	_ = v.RegisterValidation("port", func(fl validator.FieldLevel) bool {
+		port, err := strconv.Atoi(fl.Field().String())
+		return err == nil && port > 0 && port <= 65535
+	})
+	_ = v.RegisterValidation("duration", func(fl validator.FieldLevel) bool {
+		_, err := time.ParseDuration(fl.Field().String())
+		return err == nil
+	})
+	_ = v.RegisterValidation("parentdir", func(fl validator.FieldLevel) bool {
+		info, err := os.Stat(filepath.Dir(fl.Field().String()))
+		return err == nil && info.IsDir()
+	})
+	return v
+}
+
+func ruleMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "required_with":
+		return "is required with " + settingName(fe.Param())
+	case "port":
+		return "must be a port between 1 and 65535"
+	case "duration":
+		return "must be a duration such as 30s or 1h"
+	case "number":
+		return "must be a whole number"
+	case "boolean":
+		return "must be true or false"
+	case "oneof":
+		return "must be one of " + fe.Param()
+	case "startswith":
+		return "must start with " + fe.Param()
+	case "url":
+		return "must be a URL"
+	case "file":
+		return "must be an existing file"
+	case "dir":
+		return "must be an existing directory"
+	case "parentdir":
+		return "must be in an existing directory"
+	case "ip|hostname":
+		return "must be an IP address or a host name"
+	}
+	return "is not valid"
+}
+
+// settingName returns the variable of the Configuration field named field.
+func settingName(field string) string {
+	if f, ok := reflect.TypeOf(Configuration{}).FieldByName(field); ok {
+		return f.Tag.Get("mapstructure")
+	}
+	return field
+}
+
+// Print writes the settings of c as variables, masking secrets and the
+// credentials of URLs, so the output can be used as a .env file once they are
+// filled in.
+func (c Configuration) Print(w io.Writer) {
+	values := reflect.ValueOf(c)
+	for _, st := range defaults() {
+		fmt.Fprintf(w, "%s=%s\n", st.name, st.show(values.Field(st.field).String()))
+	}
+}
+
+// isURL tells whether the rules of a validate tag take a URL.
+func isURL(rules string) bool {
+	for _, rule := range strings.Split(rules, ",") {
+		if rule == "url" {
+			return true
+		}
+	}
+	return false
+}
+
+// show returns value as it can be shown, masked if the setting is a secret.
+// The userinfo and query of a URL are masked, as they can carry credentials.
+func (st setting) show(value string) string {
+	if st.secret && value != "" {
+		return masked
+	}
+	if st.url {
+		u, err := url.Parse(value)
+		if err != nil {
+			return masked
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = masked
+		}
+		if u.User != nil {
+			u.User = url.User(masked)
+			return strings.Replace(u.String(), u.User.String(), masked, 1)
+		}
+		return u.String()
+	}
+	return value
+}
@@ -0,0 +1,125 @@
+package config
+
+import (
+	"context"
+	"golang.org/x/exp/slog"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// reloadMu serializes loads, so reloads asked at once apply in turn.
+	reloadMu sync.Mutex
+	// loaded is the source Config was loaded from, read again by Reload.
+	loaded Source
+	// loadedFile is the settings file last read, watched by WatchFile.
+	loadedFile atomic.Value
+	// current holds the *Configuration returned by Current.
+	current atomic.Value
+)
+
+// Change is a setting whose value differs after a reload, with secrets and the
+// credentials of URLs masked.
+type Change struct {
+	Name string
+	From string
+	To   string
+}
+
+// Current returns the configuration in effect, which differs from Config in
+// the settings with a reload tag once reloaded. It is Config until loaded.
+func Current() Configuration {
+	if config, _ := current.Load().(*Configuration); config != nil {
+		return *config
+	}
+	return Config
+}
+
+// Reload loads the configuration again from the source Config was loaded
+// from and swaps Current for it. Only the settings with a reload tag change;
+// any other needs a restart, so its change is rejected with a warning. An
+// invalid configuration is rejected as a whole, keeping the current one. The
+// changes are logged and returned.
+func Reload() ([]Change, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	next, _, file, err := loaded.load()
+	if err != nil {
+		return nil, err
+	}
+	loadedFile.Store(file)
+
+	config := Current()
+	values := reflect.ValueOf(&config).Elem()
+	nextValues := reflect.ValueOf(next)
+	var changes []Change
+	for _, st := range defaults() {
+		from, to := values.Field(st.field).String(), nextValues.Field(st.field).String()
+		if from == to {
+			continue
+		}
+		change := Change{Name: st.name, From: st.show(from), To: st.show(to)}
+		if !st.reload {
+			slog.Warn("Setting needs a restart, change rejected", "setting", change.Name, "from", change.From, "to", change.To)
+			continue
+		}
+		values.Field(st.field).SetString(to)
+		slog.Info("Setting changed", "setting", change.Name, "from", change.From, "to", change.To)
+		changes = append(changes, change)
+	}
+	current.Store(&config)
+	slog.Info("Configuration reloaded", "changes", len(changes))
+	return changes, nil
+}
+
+// WatchFile checks every interval whether the settings file last read was
+// modified, until ctx is done, and sends on the returned channel when it was.
+func WatchFile(ctx context.Context, interval time.Duration) <-chan struct{} {
+	modified := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		file, stamp := watched()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			nextFile, nextStamp := watched()
+			// A file being replaced may be missing for a moment, and a
+			// different file is only watched from now on.
+			if nextFile == file && nextStamp != stamp && nextStamp != (fileStamp{}) {
+				select {
+				case modified <- struct{}{}:
+				default:
+				}
+			}
+			file, stamp = nextFile, nextStamp
+		}
+	}()
+	return modified
+}
+
+// fileStamp tells a file apart from its previous versions.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// watched returns the settings file last read and its stamp, zero when there
+// is none or it can't be read.
+func watched() (string, fileStamp) {
+	file, _ := loadedFile.Load().(string)
+	if file == "" {
+		return "", fileStamp{}
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return file, fileStamp{}
+	}
+	return file, fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
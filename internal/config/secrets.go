@@ -0,0 +1,146 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/nacl/secretbox"
+	"io"
+	"os"
+	"strings"
+)
+
+// SecretsFileVariable names the file of settings sealed with SealSecrets,
+// also given by the --secrets-file flag.
+const SecretsFileVariable = "SECRETS_FILE"
+
+// SecretsKeysVariable names the comma separated keys, base64 encoded, the
+// secrets file may be sealed with, read from the environment only. The first
+// one seals, so a new key goes first while the old ones still open files
+// not sealed again yet.
+const SecretsKeysVariable = "SECRETS_KEYS"
+
+// fileSuffix ends the variables naming the file a setting is read from, as
+// Docker and Kubernetes secrets are given.
+const fileSuffix = "_FILE"
+
+const (
+	keySize   = 32
+	nonceSize = 24
+)
+
+var (
+	ErrNoSecretsKeys = errors.New(SecretsKeysVariable + " is not set")
+	ErrSealedSecrets = errors.New("no key of " + SecretsKeysVariable + " opens the secrets file")
+)
+
+// env returns the value of the variable name, or the content of the file
+// named by the variable name_FILE without its trailing newline. Setting both
+// is an error.
+func (s Source) env(name string) (string, error) {
+	value, _ := s.LookupEnv(name)
+	path, _ := s.LookupEnv(name + fileSuffix)
+	switch {
+	case path == "":
+		return value, nil
+	case value != "":
+		return "", fmt.Errorf("set only one of %s and %s%s", name, name, fileSuffix)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s%s: %w", name, fileSuffix, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// secretsKeys returns the keys of SECRETS_KEYS, the sealing one first.
+func (s Source) secretsKeys() ([]*[keySize]byte, error) {
+	value, err := s.env(SecretsKeysVariable)
+	if err != nil {
+		return nil, err
+	}
+	var keys []*[keySize]byte
+	for i, encoded := range strings.Split(value, ",") {
+		encoded = strings.TrimSpace(encoded)
+		if encoded == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(decoded) != keySize {
+			return nil, fmt.Errorf("%s: key %d must be %d bytes encoded in base64", SecretsKeysVariable, i+1, keySize)
+		}
+		key := new([keySize]byte)
+		copy(key[:], decoded)
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoSecretsKeys
+	}
+	return keys, nil
+}
+
+// SecretsKeys returns the keys of SECRETS_KEYS in the environment Config was
+// loaded from, the sealing one first.
+func SecretsKeys() ([]*[keySize]byte, error) {
+	return loaded.secretsKeys()
+}
+
+// GenerateSecretsKey returns a new random key for SECRETS_KEYS.
+func GenerateSecretsKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// SealSecrets encrypts settings, NAME=value lines as in a .env file, with
+// key using NaCl secretbox. The result is base64 encoded so it can be kept
+// as a text file.
+func SealSecrets(settings []byte, key *[keySize]byte) ([]byte, error) {
+	if _, err := godotenv.Unmarshal(string(settings)); err != nil {
+		return nil, fmt.Errorf("secrets must be NAME=value lines: %w", err)
+	}
+	var nonce [nonceSize]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	sealed := secretbox.Seal(nonce[:], settings, &nonce, key)
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+// OpenSecrets decrypts settings sealed by SealSecrets with any of keys.
+func OpenSecrets(sealed []byte, keys []*[keySize]byte) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sealed)))
+	if err != nil || len(decoded) < nonceSize+secretbox.Overhead {
+		return nil, ErrSealedSecrets
+	}
+	var nonce [nonceSize]byte
+	copy(nonce[:], decoded)
+	for _, key := range keys {
+		if settings, ok := secretbox.Open(nil, decoded[nonceSize:], &nonce, key); ok {
+			return settings, nil
+		}
+	}
+	return nil, ErrSealedSecrets
+}
+
+// readSecrets reads the settings of the secrets file at path, opened with
+// the keys of SECRETS_KEYS.
+func (s Source) readSecrets(path string) (map[string]string, error) {
+	keys, err := s.secretsKeys()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	sealed, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := OpenSecrets(sealed, keys)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return godotenv.Unmarshal(string(settings))
+}
@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+	"users/pkg/logging"
+)
+
+// MIMEProblemJSON is the content type errors are answered with.
+const MIMEProblemJSON = "application/problem+json"
+
+// problemTypePrefix makes the type of a problem out of the code of its error.
+const problemTypePrefix = "urn:users:problem:"
+
+// Error is an error the service answers clients with. Code identifies it for
+// good and keys its message in the catalogs, and Status is the HTTP status it
+// is answered with.
+type Error struct {
+	Code   string
+	Status int
+	// Fields details which fields of the request were wrong, if any.
+	Fields []FieldError
+	cause  error
+}
+
+// FieldError tells why a field of the request was rejected: the rule it broke,
+// with the parameter of the rule if it takes one. Errors in the body as a
+// whole, as malformed JSON, name no field. Message is translated when
+// the error is answered if the field error has a key in the catalogs.
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+	key     string
+}
+
+func newError(status int, code string) *Error {
+	return &Error{Code: code, Status: status}
+}
+
+// Error returns the message of e in DefaultLanguage, followed by its cause.
+func (e *Error) Error() string {
+	message := translate(DefaultLanguage, e.Code, "")
+	if e.cause != nil {
+		return message + ": " + e.cause.Error()
+	}
+	return message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+// StatusCode is the status e is answered with.
+func (e *Error) StatusCode() int {
+	return e.Status
+}
+
+// Is matches any error with the same code, so the copies made by Wrap and
+// WithFields still match the error they were made from.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of e caused by err. The cause is logged along with the
+// request but never shown to the client.
+func (e *Error) Wrap(err error) *Error {
+	wrapped := *e
+	wrapped.cause = err
+	return &wrapped
+}
+
+// WithFields returns a copy of e detailing the fields that were wrong.
+func (e *Error) WithFields(fields ...FieldError) *Error {
+	detailed := *e
+	detailed.Fields = fields
+	return &detailed
+}
+
+// IsKnownError tells whether err is, or wraps, an Error, so it can be returned
+// to the client as is.
+func IsKnownError(err error) bool {
+	var e *Error
+	return errors.As(err, &e)
+}
+
+// Problem is the body errors are answered with, as defined by RFC 7807, plus
+// the code of the error and the fields that were wrong.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Code     string       `json:"code"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// NewProblem describes err as it happened on instance, in lang. An echo error
+// keeps its status when it is a client error, as the route not being found,
+// and any other error is answered as ErrSomethingWentWrong.
+func NewProblem(err error, instance, lang string) *Problem {
+	var known *Error
+	if errors.As(err, &known) {
+		problem := &Problem{
+			Type:     problemTypePrefix + known.Code,
+			Title:    title(lang, known.Status),
+			Status:   known.Status,
+			Detail:   translate(lang, known.Code, ""),
+			Instance: instance,
+			Code:     known.Code,
+		}
+		for _, field := range known.Fields {
+			if field.key != "" {
+				field.Message = translate(lang, field.key, field.Param)
+			}
+			problem.Errors = append(problem.Errors, field)
+		}
+		return problem
+	}
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) && he.Code < http.StatusInternalServerError {
+		problem := &Problem{
+			Type:     "about:blank",
+			Title:    title(lang, he.Code),
+			Status:   he.Code,
+			Instance: instance,
+			Code:     strings.ReplaceAll(strings.ToLower(http.StatusText(he.Code)), " ", "_"),
+		}
+		if message, ok := he.Message.(string); ok && message != http.StatusText(he.Code) {
+			problem.Detail = message
+		}
+		return problem
+	}
+
+	return NewProblem(ErrSomethingWentWrong, instance, lang)
+}
+
+// NewHTTPErrorHandler returns a handler answering the error a request ended
+// with as a problem, unless a response was already sent. It is written in the
+// language asked for in Accept-Language or else, if actorLocale is given and
+// the request tells who makes it, in the locale of that user. The locale of
+// any other user is never looked up, so it can't leak in the answer.
+func NewHTTPErrorHandler(actorLocale func(ctx context.Context, actorID string) string) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if c.Response().Committed {
+			return
+		}
+		preferences := []string{c.Request().Header.Get(HeaderAcceptLanguage)}
+		if actor := c.Request().Header.Get(HeaderActorID); preferences[0] == "" && actor != "" && actorLocale != nil {
+			preferences[0] = actorLocale(c.Request().Context(), actor)
+		}
+		lang := Language(preferences...)
+		problem := NewProblem(err, c.Request().URL.Path, lang)
+
+		header := c.Response().Header()
+		header.Set(echo.HeaderContentType, MIMEProblemJSON)
+		header.Set(HeaderContentLanguage, lang)
+		header.Add(echo.HeaderVary, HeaderAcceptLanguage)
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(problem.Status)
+		} else {
+			err = c.JSON(problem.Status, problem)
+		}
+		if err != nil {
+			logging.FromContext(c.Request().Context()).Error("Error writing error response", "error", err)
+		}
+	}
+}
+
+// HTTPErrorHandler answers errors as the handler of NewHTTPErrorHandler does,
+// without looking up the locale of the user making the request.
+var HTTPErrorHandler = NewHTTPErrorHandler(nil)
+
+var (
+	ErrUserIDNotPresent    = newError(http.StatusBadRequest, "invalid_user_id")
+	ErrSomethingWentWrong  = newError(http.StatusInternalServerError, "internal_error")
+	ErrUserAlreadyExists   = newError(http.StatusConflict, "user_already_exists")
+	ErrWrongBody           = newError(http.StatusBadRequest, "invalid_body")
+	ErrWrongQuery          = newError(http.StatusBadRequest, "invalid_query")
+	ErrUserNotFound        = newError(http.StatusNotFound, "user_not_found")
+	ErrHashingPassword     = newError(http.StatusBadRequest, "password_hashing_failed")
+	ErrWrongPassword       = newError(http.StatusBadRequest, "wrong_password")
+	ErrWebhookIDNotPresent = newError(http.StatusBadRequest, "invalid_webhook_id")
+	ErrWebhookNotFound     = newError(http.StatusNotFound, "webhook_not_found")
+	ErrDeliveryNotFound    = newError(http.StatusNotFound, "delivery_not_found")
+	ErrWebhookURLPrivate   = newError(http.StatusBadRequest, "webhook_url_private")
+	ErrUserHasData         = newError(http.StatusConflict, "user_has_data")
+	ErrPasswordBreached    = newError(http.StatusBadRequest, "password_breached")
+	ErrUserAnonymized      = newError(http.StatusConflict, "user_anonymized")
+	ErrMailBlocked         = newError(http.StatusConflict, "mail_blocked")
+	ErrVersionMismatch     = newError(http.StatusPreconditionFailed, "version_mismatch")
+	ErrIfMatchRequired     = newError(http.StatusPreconditionRequired, "if_match_required")
+	ErrAvatarNotFound      = newError(http.StatusNotFound, "avatar_not_found")
+	ErrAvatarTooLarge      = newError(http.StatusRequestEntityTooLarge, "avatar_too_large")
+	ErrAvatarType          = newError(http.StatusUnsupportedMediaType, "avatar_type_unsupported")
+	ErrExportIDNotPresent  = newError(http.StatusBadRequest, "invalid_export_id")
+	ErrExportNotFound      = newError(http.StatusNotFound, "export_not_found")
+	ErrExportNotReady      = newError(http.StatusConflict, "export_not_ready")
+	ErrUnauthenticated     = newError(http.StatusUnauthorized, "unauthenticated")
+	ErrForbidden           = newError(http.StatusForbidden, "forbidden")
+)
@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorMatching(t *testing.T) {
+	cause := errors.New("unexpected EOF")
+	err := fmt.Errorf("binding: %w", ErrWrongBody.Wrap(cause))
+
+	assert.True(t, errors.Is(err, ErrWrongBody))
+	assert.True(t, errors.Is(err, cause), "the cause is kept")
+	assert.False(t, errors.Is(err, ErrWrongQuery))
+	assert.True(t, errors.Is(ErrWrongBody.WithFields(FieldError{Field: "mail"}), ErrWrongBody))
+	assert.Contains(t, err.Error(), "unexpected EOF", "the cause is logged")
+	assert.True(t, IsKnownError(err))
+	assert.False(t, IsKnownError(cause))
+}
+
+func TestHTTPErrorHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		err      error
+		expected Problem
+	}{
+		{
+			name:   "[001] Service error (ok)",
+			method: http.MethodGet,
+			err:    fmt.Errorf("getting user: %w", ErrUserNotFound.Wrap(errors.New("no rows"))),
+			expected: Problem{
+				Type:     "urn:users:problem:user_not_found",
+				Title:    "No encontrado",
+				Status:   http.StatusNotFound,
+				Detail:   "usuario no encontrado",
+				Instance: "/user/1",
+				Code:     "user_not_found",
+			},
+		},
+		{
+			name:   "[002] Field errors (ok)",
+			method: http.MethodGet,
+			err:    ErrWrongBody.WithFields(FieldError{Field: "mail", Rule: "required", Message: "es obligatorio"}),
+			expected: Problem{
+				Type:     "urn:users:problem:invalid_body",
+				Title:    "Petición errónea",
+				Status:   http.StatusBadRequest,
+				Detail:   "el cuerpo enviado es erróneo",
+				Instance: "/user/1",
+				Code:     "invalid_body",
+				Errors:   []FieldError{{Field: "mail", Rule: "required", Message: "es obligatorio"}},
+			},
+		},
+		{
+			name:   "[003] Echo client error (ok)",
+			method: http.MethodGet,
+			err:    echo.ErrMethodNotAllowed,
+			expected: Problem{
+				Type:     "about:blank",
+				Title:    "Método no permitido",
+				Status:   http.StatusMethodNotAllowed,
+				Instance: "/user/1",
+				Code:     "method_not_allowed",
+			},
+		},
+		{
+			name:   "[004] Unknown error is not shown (500)",
+			method: http.MethodGet,
+			err:    errors.New("database is locked"),
+			expected: Problem{
+				Type:     "urn:users:problem:internal_error",
+				Title:    "Error interno del servidor",
+				Status:   http.StatusInternalServerError,
+				Detail:   "error inesperado",
+				Instance: "/user/1",
+				Code:     "internal_error",
+			},
+		},
+		{
+			name:     "[005] Echo server error is not shown (500)",
+			method:   http.MethodGet,
+			err:      echo.NewHTTPError(http.StatusServiceUnavailable, "timeout"),
+			expected: *NewProblem(ErrSomethingWentWrong, "/user/1", DefaultLanguage),
+		},
+		{
+			name:     "[006] HEAD request has no body (ok)",
+			method:   http.MethodHead,
+			err:      ErrUserNotFound,
+			expected: Problem{Status: http.StatusNotFound},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(httptest.NewRequest(tt.method, "/user/1", nil), rec)
+
+			HTTPErrorHandler(tt.err, c)
+
+			assert.Equal(t, tt.expected.Status, rec.Code)
+			assert.Equal(t, MIMEProblemJSON, rec.Header().Get(echo.HeaderContentType))
+			if tt.method == http.MethodHead {
+				assert.Zero(t, rec.Body.Len())
+				return
+			}
+			problem := Problem{}
+			require.NoError(t, jsoniter.Unmarshal(rec.Body.Bytes(), &problem))
+			assert.Equal(t, tt.expected, problem)
+		})
+	}
+}
+
+func TestHTTPErrorHandlerCommitted(t *testing.T) {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/user/1", nil), rec)
+	require.NoError(t, c.String(http.StatusOK, "done"))
+
+	HTTPErrorHandler(ErrSomethingWentWrong, c)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "done", rec.Body.String())
+}
+
+func TestHTTPErrorHandlerLanguage(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptLanguage string
+		actor          string
+		actorLocale    string
+		expectedLang   string
+		expectedTitle  string
+		expectedDetail string
+	}{
+		{name: "[001] Default language (ok)", expectedLang: "es", expectedTitle: "Petición errónea", expectedDetail: "el cuerpo enviado es erróneo"},
+		{name: "[002] Accept-Language (ok)", acceptLanguage: "fr;q=0.9, en-GB;q=0.8", expectedLang: "en", expectedTitle: "Bad Request", expectedDetail: "the body sent is wrong"},
+		{name: "[003] Locale of the actor (ok)", actor: "01FN3EEB2NVFJAHAPU00000001", actorLocale: "en-US", expectedLang: "en", expectedTitle: "Bad Request", expectedDetail: "the body sent is wrong"},
+		{name: "[004] Accept-Language over locale (ok)", acceptLanguage: "es", actor: "01FN3EEB2NVFJAHAPU00000001", actorLocale: "en", expectedLang: "es", expectedTitle: "Petición errónea", expectedDetail: "el cuerpo enviado es erróneo"},
+		{name: "[005] Unknown language (ok)", acceptLanguage: "de", expectedLang: "es", expectedTitle: "Petición errónea", expectedDetail: "el cuerpo enviado es erróneo"},
+		{name: "[006] No actor, no locale looked up (ok)", actorLocale: "en", expectedLang: "es", expectedTitle: "Petición errónea", expectedDetail: "el cuerpo enviado es erróneo"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/user", nil)
+			if tt.acceptLanguage != "" {
+				req.Header.Set(HeaderAcceptLanguage, tt.acceptLanguage)
+			}
+			if tt.actor != "" {
+				req.Header.Set(HeaderActorID, tt.actor)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			handler := NewHTTPErrorHandler(func(_ context.Context, actorID string) string {
+				assert.Equal(t, tt.actor, actorID, "only the actor is looked up")
+				return tt.actorLocale
+			})
+
+			handler(ValidationError(NewValidator().Struct(struct {
+				Mail string `json:"mail" validate:"required"`
+			}{})), c)
+
+			assert.Equal(t, tt.expectedLang, rec.Header().Get(HeaderContentLanguage))
+			problem := Problem{}
+			require.NoError(t, jsoniter.Unmarshal(rec.Body.Bytes(), &problem))
+			assert.Equal(t, tt.expectedTitle, problem.Title)
+			assert.Equal(t, tt.expectedDetail, problem.Detail)
+			require.Len(t, problem.Errors, 1)
+			assert.Equal(t, "mail", problem.Errors[0].Field)
+			assert.Equal(t, translate(tt.expectedLang, "field.required", ""), problem.Errors[0].Message)
+		})
+	}
+}
+
+func TestCatalogs(t *testing.T) {
+	for lang, catalog := range catalogs {
+		for key := range catalogs[DefaultLanguage] {
+			assert.NotEmpty(t, catalog[key], "%s has no message for %s", lang, key)
+		}
+		assert.Len(t, catalog, len(catalogs[DefaultLanguage]), lang)
+	}
+	for _, tag := range languages {
+		base, _ := tag.Base()
+		assert.Contains(t, catalogs, base.String())
+	}
+	assert.Equal(t, "must have at least 16 characters", translate("en", "field.min.chars", "16"))
+	assert.Equal(t, "Too Many Requests", title("es", http.StatusTooManyRequests), "falls back to the status text")
+}
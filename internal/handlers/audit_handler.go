@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"users/internal"
+	"users/internal/managers"
+	"users/internal/models"
+	"users/pkg/database"
+	"users/pkg/url"
+)
+
+type AuditAPI struct {
+	DB      database.Database
+	Manager managers.IAuditManager
+}
+
+// GetUserAuditHandler endpoint to get the audit trail of a user
+func (a *AuditAPI) GetUserAuditHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamUserID: {Target: &ID, Err: internal.ErrUserIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	filter := models.AuditFilter{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &filter); err != nil {
+		return internal.ErrWrongQuery
+	}
+	filter.UserId = ID
+
+	page, err := a.Manager.GetAuditEvents(c.Request().Context(), filter)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// GetAuditHandler endpoint to search the whole audit trail
+func (a *AuditAPI) GetAuditHandler(c echo.Context) error {
+	filter := models.AuditFilter{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &filter); err != nil {
+		return internal.ErrWrongQuery
+	}
+
+	page, err := a.Manager.GetAuditEvents(c.Request().Context(), filter)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, page)
+}
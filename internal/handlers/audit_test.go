@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"context"
+	"github.com/json-iterator/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"users/internal"
+	"users/internal/config"
+	"users/internal/managers"
+	"users/internal/models"
+	"users/pkg/database"
+)
+
+type AuditAPITestSuite struct {
+	suite.Suite
+	db *database.Database
+}
+
+func TestAuditAPITestSuite(t *testing.T) {
+	suite.Run(t, new(AuditAPITestSuite))
+}
+
+func (s *AuditAPITestSuite) SetupTest() {
+	_ = database.RemoveDB(databaseTest)
+	s.db = database.InitDB(databaseTest)
+	password, _ := managers.HashPassword("MyPassword.123")
+	s.db.Conn.Exec("INSERT INTO users(id,name,mail,password) VALUES (?,?,?,?)", "01FN3EEB2NVFJAHAPU00000001", "firstuser", "firstuser@mail.com", password)
+
+	actor := models.Actor{IP: "192.0.2.1", UserAgent: "audit-test", RequestID: "req-1"}
+	userManager := managers.NewUserManager(*s.db)
+	_, _ = userManager.Login(context.Background(), actor, models.User{Mail: "firstuser@mail.com", Password: "MyPassword.123"})
+	_, _ = userManager.Login(context.Background(), actor, models.User{Mail: "firstuser@mail.com", Password: "Wrong.123"})
+	_, _ = userManager.Login(context.Background(), actor, models.User{Mail: "nobody@mail.com", Password: "Wrong.123"})
+	_, _ = userManager.UpdateUser(context.Background(), models.Actor{ID: "01FN3EEB2NVFJAHAPU00000001"}, "01FN3EEB2NVFJAHAPU00000001", models.User{
+		Name:     PointerString("michael"),
+		Mail:     "firstuser@mail.com",
+		Password: "MyPassword.456",
+	}, 0)
+}
+
+func (s *AuditAPITestSuite) TearDownTest() {
+	s.db = nil
+	_ = database.RemoveDB(databaseTest)
+}
+
+func (s *AuditAPITestSuite) TestGetAuditHandler() {
+	tests := []struct {
+		name               string
+		query              string
+		expectedEvents     []string
+		expectedTotal      int
+		expectedResp       interface{}
+		expectedStatusCode int
+		wantErr            bool
+	}{
+		{
+			name:               "[001] Get whole audit trail (ok)",
+			expectedEvents:     []string{models.AuditPasswordChange, models.AuditUserUpdated, models.AuditLoginFailure, models.AuditLoginFailure, models.AuditLoginSuccess},
+			expectedTotal:      5,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "[002] Filter by event (ok)",
+			query:              "?event=login.failure",
+			expectedEvents:     []string{models.AuditLoginFailure, models.AuditLoginFailure},
+			expectedTotal:      2,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "[003] Paginate (ok)",
+			query:              "?limit=2&offset=1",
+			expectedEvents:     []string{models.AuditUserUpdated, models.AuditLoginFailure},
+			expectedTotal:      5,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "[004] Filter by actor (ok)",
+			query:              "?actorId=01FN3EEB2NVFJAHAPU00000001",
+			expectedEvents:     []string{models.AuditPasswordChange, models.AuditUserUpdated, models.AuditLoginSuccess},
+			expectedTotal:      3,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "[005] Wrong date (400)",
+			query:              "?from=yesterday",
+			expectedResp:       internal.ErrWrongQuery,
+			expectedStatusCode: http.StatusBadRequest,
+			wantErr:            true,
+		},
+		{
+			name:               "[006] Wrong limit (400)",
+			query:              "?limit=many",
+			expectedResp:       internal.ErrWrongQuery,
+			expectedStatusCode: http.StatusBadRequest,
+			wantErr:            true,
+		},
+	}
+	getEchoContext := func(query string) echo.Context {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, internal.RouteAudit+query, nil)
+		rec := httptest.NewRecorder()
+		return e.NewContext(req, rec)
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			api := AuditAPI{DB: *s.db, Manager: managers.NewAuditManager(*s.db)}
+
+			c := getEchoContext(t.query)
+			err := serve(api.GetAuditHandler, c)
+
+			resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
+			s.True(ok)
+			body := resp.Body.Bytes()
+			if t.wantErr {
+				s.Equal(t.wantErr, err != nil)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
+			} else {
+				page := new(models.AuditPage)
+				s.NoError(jsoniter.Unmarshal(body, page))
+				s.Equal(t.expectedTotal, page.Total)
+				s.Equal(t.expectedEvents, auditEventNames(page.Events))
+			}
+
+			s.Equal(t.expectedStatusCode, c.Response().Status)
+		})
+	}
+}
+
+func (s *AuditAPITestSuite) TestGetUserAuditHandler() {
+	api := AuditAPI{DB: *s.db, Manager: managers.NewAuditManager(*s.db)}
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, internal.RouteUserAudit, nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames(internal.ParamUserID)
+	c.SetParamValues("01FN3EEB2NVFJAHAPU00000001")
+
+	s.NoError(api.GetUserAuditHandler(c))
+	s.Equal(http.StatusOK, rec.Code)
+
+	page := new(models.AuditPage)
+	s.NoError(jsoniter.Unmarshal(rec.Body.Bytes(), page))
+	s.Equal([]string{models.AuditPasswordChange, models.AuditUserUpdated, models.AuditLoginFailure, models.AuditLoginSuccess}, auditEventNames(page.Events))
+
+	updated := page.Events[1]
+	s.JSONEq(`{"fields":["name","password"]}`, string(updated.Details))
+	login := page.Events[3]
+	s.Equal("192.0.2.1", login.IP)
+	s.Equal("audit-test", login.UserAgent)
+	s.Equal("req-1", login.RequestId)
+}
+
+func (s *AuditAPITestSuite) TestAuditDetailsWithoutMail() {
+	api := AuditAPI{DB: *s.db, Manager: managers.NewAuditManager(*s.db)}
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, internal.RouteAudit+"?event="+models.AuditLoginFailure, nil)
+	rec := httptest.NewRecorder()
+	s.NoError(api.GetAuditHandler(e.NewContext(req, rec)))
+
+	page := new(models.AuditPage)
+	s.NoError(jsoniter.Unmarshal(rec.Body.Bytes(), page))
+	s.Equal(2, page.Total)
+	for _, event := range page.Events {
+		s.NotContains(strings.ToLower(string(event.Details)), "@mail.com")
+	}
+}
+
+func (s *AuditAPITestSuite) TestAuditAuthorization() {
+	config.Config.AdminUsers = "01FN3EEB2NVFJAHAPU00000009"
+	defer func() { config.Config.AdminUsers = "" }()
+
+	tests := []struct {
+		name               string
+		route              string
+		actor              string
+		userID             string
+		expectedResp       error
+		expectedStatusCode int
+	}{
+		{
+			name:               "[001] Admin reads the whole trail (ok)",
+			route:              internal.RouteAudit,
+			actor:              "01FN3EEB2NVFJAHAPU00000009",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "[002] User reads the whole trail (403)",
+			route:              internal.RouteAudit,
+			actor:              "01FN3EEB2NVFJAHAPU00000001",
+			expectedResp:       internal.ErrForbidden,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "[003] Anonymous reads the whole trail (401)",
+			route:              internal.RouteAudit,
+			expectedResp:       internal.ErrUnauthenticated,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+		{
+			name:               "[004] User reads their own trail (ok)",
+			route:              internal.RouteUserAudit,
+			actor:              "01FN3EEB2NVFJAHAPU00000001",
+			userID:             "01FN3EEB2NVFJAHAPU00000001",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "[005] Admin reads the trail of a user (ok)",
+			route:              internal.RouteUserAudit,
+			actor:              "01FN3EEB2NVFJAHAPU00000009",
+			userID:             "01FN3EEB2NVFJAHAPU00000001",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "[006] User reads the trail of another user (403)",
+			route:              internal.RouteUserAudit,
+			actor:              "01FN3EEB2NVFJAHAPU00000002",
+			userID:             "01FN3EEB2NVFJAHAPU00000001",
+			expectedResp:       internal.ErrForbidden,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "[007] Anonymous reads the trail of a user (401)",
+			route:              internal.RouteUserAudit,
+			userID:             "01FN3EEB2NVFJAHAPU00000001",
+			expectedResp:       internal.ErrUnauthenticated,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			api := AuditAPI{DB: *s.db, Manager: managers.NewAuditManager(*s.db)}
+			handler := RequireAdmin(api.GetAuditHandler)
+			if t.route == internal.RouteUserAudit {
+				handler = RequireSelfOrAdmin(api.GetUserAuditHandler)
+			}
+
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, t.route, nil)
+			if t.actor != "" {
+				req.Header.Set(internal.HeaderActorID, t.actor)
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			if t.userID != "" {
+				c.SetParamNames(internal.ParamUserID)
+				c.SetParamValues(t.userID)
+			}
+			err := serve(handler, c)
+
+			s.Equal(t.expectedStatusCode, rec.Code)
+			if t.expectedResp != nil {
+				s.ErrorIs(err, t.expectedResp)
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(rec.Body.Bytes(), problem))
+				s.Equal(internal.NewProblem(t.expectedResp, t.route, internal.DefaultLanguage), problem)
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
+
+func auditEventNames(events []models.AuditEvent) []string {
+	names := []string{}
+	for _, event := range events {
+		names = append(names, event.Event)
+	}
+	return names
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+	"users/internal"
+	"users/internal/config"
+)
+
+// RequireAdmin lets through only the requests made by one of ADMIN_USERS,
+// as told by the X-User-ID header.
+func RequireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		actor := c.Request().Header.Get(internal.HeaderActorID)
+		if actor == "" {
+			return internal.ErrUnauthenticated
+		}
+		if !config.Current().IsAdmin(actor) {
+			return internal.ErrForbidden
+		}
+		return next(c)
+	}
+}
+
+// RequireSelfOrAdmin lets through only the requests made by the user of the
+// path, or by one of ADMIN_USERS.
+func RequireSelfOrAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		actor := c.Request().Header.Get(internal.HeaderActorID)
+		if actor == "" {
+			return internal.ErrUnauthenticated
+		}
+		if actor != c.Param(internal.ParamUserID) && !config.Current().IsAdmin(actor) {
+			return internal.ErrForbidden
+		}
+		return next(c)
+	}
+}
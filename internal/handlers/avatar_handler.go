@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/labstack/echo/v4"
+	"io"
+	"net/http"
+	"strings"
+	"users/internal"
+	"users/internal/managers"
+	"users/pkg/database"
+	"users/pkg/url"
+)
+
+const (
+	avatarFormField = "avatar"
+	// multipartOverhead is allowed on top of the avatar for the multipart
+	// boundaries and headers.
+	multipartOverhead = 64 << 10
+)
+
+type AvatarAPI struct {
+	DB      database.Database
+	Manager managers.IAvatarManager
+}
+
+type avatarQuery struct {
+	Size int `query:"size"`
+}
+
+// PutAvatarHandler endpoint to upload the avatar of a user as multipart form
+func (a *AvatarAPI) PutAvatarHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamUserID: {Target: &ID, Err: internal.ErrUserIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	limit := a.Manager.MaxSize() + multipartOverhead
+	if c.Request().ContentLength > limit {
+		return internal.ErrAvatarTooLarge
+	}
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, limit)
+	header, err := c.FormFile(avatarFormField)
+	if err != nil {
+		return internal.ErrWrongBody.Wrap(err)
+	}
+	file, err := header.Open()
+	if err != nil {
+		return internal.ErrWrongBody.Wrap(err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, a.Manager.MaxSize()+1))
+	if err != nil {
+		return internal.ErrWrongBody.Wrap(err)
+	}
+
+	user, err := a.Manager.UploadAvatar(c.Request().Context(), actorFromContext(c), ID, data)
+	if err != nil {
+		return err
+	}
+	cleanUser(user)
+	return c.JSON(http.StatusOK, user)
+}
+
+// GetAvatarHandler endpoint to get the avatar of a user in one of the sizes
+func (a *AvatarAPI) GetAvatarHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamUserID: {Target: &ID, Err: internal.ErrUserIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	query := avatarQuery{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &query); err != nil {
+		return internal.ErrWrongQuery
+	}
+	if query.Size == 0 {
+		query.Size = managers.DefaultAvatarSize
+	}
+
+	data, err := a.Manager.GetAvatar(c.Request().Context(), ID, query.Size)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+	c.Response().Header().Set(internal.HeaderETag, etag)
+	if matchesETag(c.Request().Header.Get(internal.HeaderIfNoneMatch), etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(http.StatusOK, managers.AvatarContentType, data)
+}
+
+// matchesETag tells whether an If-None-Match header lists the etag, comparing
+// weakly as RFC 7232 asks for.
+func matchesETag(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/json-iterator/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/suite"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"users/internal"
+	"users/internal/config"
+	"users/internal/managers"
+	"users/internal/models"
+	"users/pkg/database"
+)
+
+type AvatarAPITestSuite struct {
+	suite.Suite
+	db *database.Database
+}
+
+func TestAvatarAPITestSuite(t *testing.T) {
+	suite.Run(t, new(AvatarAPITestSuite))
+}
+
+func (s *AvatarAPITestSuite) SetupTest() {
+	_ = database.RemoveDB(databaseTest)
+	s.db = database.InitDB(databaseTest)
+	s.db.Conn.Exec("INSERT INTO users(id,name,mail,password) VALUES (?,?,?,?)", "01FN3EEB2NVFJAHAPU00000001", "firstuser", "firstuser@mail.com", "-")
+	config.Config.AvatarDir = s.T().TempDir()
+}
+
+func (s *AvatarAPITestSuite) TearDownTest() {
+	config.Config.AvatarDir, config.Config.AvatarMaxSize = "", ""
+	s.db = nil
+	_ = database.RemoveDB(databaseTest)
+}
+
+func pngImage(width, height int) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	out := &bytes.Buffer{}
+	_ = png.Encode(out, img)
+	return out.Bytes()
+}
+
+func (s *AvatarAPITestSuite) uploadContext(userID string, file []byte) echo.Context {
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	part, err := form.CreateFormFile("avatar", "avatar.png")
+	s.Require().NoError(err)
+	part.Write(file)
+	s.Require().NoError(form.Close())
+
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodPut, internal.RouteUserAvatar, body)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames(internal.ParamUserID)
+	c.SetParamValues(userID)
+	return c
+}
+
+func (s *AvatarAPITestSuite) TestPutAvatarHandler() {
+	tests := []struct {
+		name               string
+		userID             string
+		file               []byte
+		maxSize            string
+		expectedResp       interface{}
+		expectedStatusCode int
+		wantErr            bool
+	}{
+		{
+			name:               "[001] Upload avatar (ok)",
+			userID:             "01FN3EEB2NVFJAHAPU00000001",
+			file:               pngImage(320, 240),
+			expectedStatusCode: http.StatusOK,
+			wantErr:            false,
+		},
+		{
+			name:               "[002] Not an image (415)",
+			userID:             "01FN3EEB2NVFJAHAPU00000001",
+			file:               []byte("<svg xmlns=\"http://www.w3.org/2000/svg\"></svg>"),
+			expectedResp:       internal.ErrAvatarType,
+			expectedStatusCode: http.StatusUnsupportedMediaType,
+			wantErr:            true,
+		},
+		{
+			name:               "[003] Image too large (413)",
+			userID:             "01FN3EEB2NVFJAHAPU00000001",
+			file:               pngImage(320, 240),
+			maxSize:            "1024",
+			expectedResp:       internal.ErrAvatarTooLarge,
+			expectedStatusCode: http.StatusRequestEntityTooLarge,
+			wantErr:            true,
+		},
+		{
+			name:               "[004] User does not exist (404)",
+			userID:             "01FN3EEB2NVFJAHAPU00000099",
+			file:               pngImage(10, 10),
+			expectedResp:       internal.ErrUserNotFound,
+			expectedStatusCode: http.StatusNotFound,
+			wantErr:            true,
+		},
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			config.Config.AvatarMaxSize = t.maxSize
+			api := AvatarAPI{DB: *s.db, Manager: managers.NewAvatarManager(*s.db)}
+
+			c := s.uploadContext(t.userID, t.file)
+			err := serve(api.PutAvatarHandler, c)
+
+			resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
+			s.True(ok)
+			body := resp.Body.Bytes()
+			if t.wantErr {
+				s.Equal(t.wantErr, err != nil)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
+			} else {
+				user := new(models.User)
+				s.NoError(jsoniter.Unmarshal(body, user))
+				s.Equal("/user/"+t.userID+"/avatar", user.AvatarURL)
+			}
+			s.Equal(t.expectedStatusCode, c.Response().Status)
+		})
+	}
+}
+
+func (s *AvatarAPITestSuite) TestGetAvatarHandler() {
+	api := AvatarAPI{DB: *s.db, Manager: managers.NewAvatarManager(*s.db)}
+	userID := "01FN3EEB2NVFJAHAPU00000001"
+	getContext := func(query, ifNoneMatch string) echo.Context {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/user/"+userID+"/avatar"+query, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		c := e.NewContext(req, httptest.NewRecorder())
+		c.SetParamNames(internal.ParamUserID)
+		c.SetParamValues(userID)
+		return c
+	}
+
+	c := getContext("", "")
+	s.Error(serve(api.GetAvatarHandler, c))
+	s.Equal(http.StatusNotFound, c.Response().Status, "no avatar uploaded yet")
+
+	s.Require().NoError(api.PutAvatarHandler(s.uploadContext(userID, pngImage(100, 300))))
+
+	for _, size := range []int{64, 256} {
+		c = getContext("?size="+strconv.Itoa(size), "")
+		s.Require().NoError(api.GetAvatarHandler(c))
+		s.Equal(http.StatusOK, c.Response().Status)
+		s.Equal("image/jpeg", c.Response().Header().Get(echo.HeaderContentType))
+		img, _, err := image.Decode(bytes.NewReader(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes()))
+		s.Require().NoError(err)
+		s.Equal(image.Rect(0, 0, size, size), img.Bounds())
+	}
+
+	c = getContext("", "")
+	s.Require().NoError(api.GetAvatarHandler(c))
+	etag := c.Response().Header().Get("ETag")
+	s.NotEmpty(etag)
+
+	c = getContext("", "W/"+etag)
+	s.Require().NoError(api.GetAvatarHandler(c))
+	s.Equal(http.StatusNotModified, c.Response().Status)
+	s.Zero(c.Response().Writer.(*httptest.ResponseRecorder).Body.Len())
+
+	c = getContext("?size=100", "")
+	s.Error(serve(api.GetAvatarHandler, c))
+	s.Equal(http.StatusBadRequest, c.Response().Status)
+}
+
+func (s *AvatarAPITestSuite) TestAvatarURLRoundTrip() {
+	userID := "01FN3EEB2NVFJAHAPU00000001"
+	avatars := AvatarAPI{DB: *s.db, Manager: managers.NewAvatarManager(*s.db)}
+	s.Require().NoError(avatars.PutAvatarHandler(s.uploadContext(userID, pngImage(64, 64))))
+
+	users := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+	e := echo.New()
+	c := e.NewContext(httptest.NewRequest(http.MethodGet, "/user/"+userID, nil), httptest.NewRecorder())
+	c.SetParamNames(internal.ParamUserID)
+	c.SetParamValues(userID)
+	s.Require().NoError(serve(users.GetUserHandler, c))
+	user := new(models.User)
+	s.Require().NoError(jsoniter.Unmarshal(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes(), user))
+	s.Equal("/user/"+userID+"/avatar", user.AvatarURL)
+
+	// The user read is sent back as is, but for the password it never shows.
+	user.Password = "MyPassword.123"
+	body, err := jsoniter.Marshal(user)
+	s.Require().NoError(err)
+	req := httptest.NewRequest(http.MethodPut, "/user/"+userID, bytes.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c = e.NewContext(req, httptest.NewRecorder())
+	c.SetParamNames(internal.ParamUserID)
+	c.SetParamValues(userID)
+	s.Require().NoError(serve(users.PutUserHandler, c))
+	s.Equal(http.StatusOK, c.Response().Status)
+	updated := new(models.User)
+	s.Require().NoError(jsoniter.Unmarshal(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes(), updated))
+	s.Equal(user.AvatarURL, updated.AvatarURL)
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strings"
+	"users/internal"
+	"users/internal/managers"
+	"users/pkg/database"
+	"users/pkg/url"
+)
+
+const mimeApplicationZip = "application/zip"
+
+type ExportAPI struct {
+	DB      database.Database
+	Manager managers.IExportManager
+}
+
+type exportQuery struct {
+	CSV bool `query:"csv"`
+}
+
+// GetExportHandler endpoint to export all the data of a user. Small accounts
+// get the ZIP in the response; large ones get an export job to poll.
+func (a *ExportAPI) GetExportHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamUserID: {Target: &ID, Err: internal.ErrUserIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	query := exportQuery{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &query); err != nil {
+		return internal.ErrWrongQuery
+	}
+
+	large, err := a.Manager.IsLargeExport(c.Request().Context(), ID)
+	if err != nil {
+		return err
+	}
+	if large {
+		job, err := a.Manager.CreateExportJob(c.Request().Context(), actorFromContext(c), ID, query.CSV)
+		if err != nil {
+			return err
+		}
+		c.Response().Header().Set(echo.HeaderLocation, exportPath(internal.RouteUserExportID, ID, job.Id))
+		return c.JSON(http.StatusAccepted, job)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = a.Manager.WriteExport(c.Request().Context(), actorFromContext(c), ID, query.CSV, buf); err != nil {
+		return err
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, exportAttachment(ID))
+	return c.Blob(http.StatusOK, mimeApplicationZip, buf.Bytes())
+}
+
+// GetExportJobHandler endpoint to get the status of an export job of the user
+// of the path
+func (a *ExportAPI) GetExportJobHandler(c echo.Context) error {
+	var userID, exportID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamUserID:   {Target: &userID, Err: internal.ErrUserIDNotPresent},
+		internal.ParamExportID: {Target: &exportID, Err: internal.ErrExportIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	job, err := a.Manager.GetExportJob(c.Request().Context(), userID, exportID)
+	if err != nil {
+		return err
+	}
+	if job.UserId != userID {
+		return internal.ErrExportNotFound
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// DownloadExportHandler endpoint to download a finished export
+func (a *ExportAPI) DownloadExportHandler(c echo.Context) error {
+	var userID, exportID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamUserID:   {Target: &userID, Err: internal.ErrUserIDNotPresent},
+		internal.ParamExportID: {Target: &exportID, Err: internal.ErrExportIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	file, err := a.Manager.OpenExport(c.Request().Context(), userID, exportID)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	c.Response().Header().Set(echo.HeaderContentDisposition, exportAttachment(userID))
+	return c.Stream(http.StatusOK, mimeApplicationZip, file)
+}
+
+func exportAttachment(userID string) string {
+	return fmt.Sprintf("attachment; filename=%q", "user-"+userID+"-export.zip")
+}
+
+func exportPath(route, userID, exportID string) string {
+	path := strings.Replace(route, ":"+internal.ParamUserID, userID, 1)
+	return strings.Replace(path, ":"+internal.ParamExportID, exportID, 1)
+}
@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"github.com/json-iterator/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"users/internal"
+	"users/internal/config"
+	"users/internal/managers"
+	"users/internal/models"
+	"users/pkg/database"
+)
+
+type ExportAPITestSuite struct {
+	suite.Suite
+	db *database.Database
+}
+
+func TestExportAPITestSuite(t *testing.T) {
+	suite.Run(t, new(ExportAPITestSuite))
+}
+
+func (s *ExportAPITestSuite) SetupTest() {
+	_ = database.RemoveDB(databaseTest)
+	s.db = database.InitDB(databaseTest)
+	password, _ := managers.HashPassword("MyPassword.123")
+	s.db.Conn.Exec("INSERT INTO users(id,name,mail,password) VALUES (?,?,?,?)", "01FN3EEB2NVFJAHAPU00000001", "firstuser", "firstuser@mail.com", password)
+	s.db.Conn.Exec("INSERT INTO meals(id,user_id,name,kcal,type,ingredients,seasons) VALUES (?,?,?,?,?,?,?)",
+		"01FN3EEB2NVFJAHAPM00000001", "01FN3EEB2NVFJAHAPU00000001", "lentejas", 500, "lunch", "[]", "[]")
+	s.db.Conn.Exec("INSERT INTO calendar(user_id,meal_id,date,name) VALUES (?,?,?,?)",
+		"01FN3EEB2NVFJAHAPU00000001", "01FN3EEB2NVFJAHAPM00000001", "2023-05-01", "lentejas")
+	config.Config.ExportDir = s.T().TempDir()
+}
+
+func (s *ExportAPITestSuite) TearDownTest() {
+	config.Config.ExportDir, config.Config.ExportAsyncThreshold, config.Config.ExportTTL = "", "", ""
+	s.db = nil
+	_ = database.RemoveDB(databaseTest)
+}
+
+func (s *ExportAPITestSuite) getEchoContext(target string, names []string, values []string) echo.Context {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	rec := httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+	return c
+}
+
+func (s *ExportAPITestSuite) readZip(body []byte) map[string][]byte {
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	s.Require().NoError(err)
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		s.Require().NoError(err)
+		files[f.Name], err = io.ReadAll(r)
+		s.Require().NoError(err)
+		r.Close()
+	}
+	return files
+}
+
+func (s *ExportAPITestSuite) TestGetExportHandler() {
+	tests := []struct {
+		name               string
+		userID             string
+		query              string
+		expectedFiles      []string
+		expectedResp       interface{}
+		expectedStatusCode int
+		wantErr            bool
+	}{
+		{
+			name:               "[001] Export as JSON (ok)",
+			userID:             "01FN3EEB2NVFJAHAPU00000001",
+			expectedFiles:      []string{"profile.json", "meals.json", "calendar.json", "audit_events.json"},
+			expectedStatusCode: http.StatusOK,
+			wantErr:            false,
+		},
+		{
+			name:   "[002] Export with CSV (ok)",
+			userID: "01FN3EEB2NVFJAHAPU00000001",
+			query:  "?csv=true",
+			expectedFiles: []string{"profile.json", "profile.csv", "meals.json", "meals.csv",
+				"calendar.json", "calendar.csv", "audit_events.json", "audit_events.csv"},
+			expectedStatusCode: http.StatusOK,
+			wantErr:            false,
+		},
+		{
+			name:               "[003] User does not exist (404)",
+			userID:             "01FN3EEB2NVFJAHAPU00000099",
+			expectedResp:       internal.ErrUserNotFound,
+			expectedStatusCode: http.StatusNotFound,
+			wantErr:            true,
+		},
+		{
+			name:               "[004] Wrong query (400)",
+			userID:             "01FN3EEB2NVFJAHAPU00000001",
+			query:              "?csv=maybe",
+			expectedResp:       internal.ErrWrongQuery,
+			expectedStatusCode: http.StatusBadRequest,
+			wantErr:            true,
+		},
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			api := ExportAPI{DB: *s.db, Manager: managers.NewExportManager(*s.db)}
+
+			c := s.getEchoContext("/user/"+t.userID+"/export"+t.query, []string{internal.ParamUserID}, []string{t.userID})
+			err := serve(api.GetExportHandler, c)
+
+			resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
+			s.True(ok)
+			body := resp.Body.Bytes()
+			if t.wantErr {
+				s.Equal(t.wantErr, err != nil)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
+			} else {
+				s.NoError(err)
+				s.Equal("application/zip", resp.Header().Get(echo.HeaderContentType))
+				s.Contains(resp.Header().Get(echo.HeaderContentDisposition), "attachment")
+				files := s.readZip(body)
+				s.Len(files, len(t.expectedFiles))
+				for _, name := range t.expectedFiles {
+					s.Contains(files, name)
+				}
+				s.NotContains(string(files["profile.json"]), "password")
+				s.Contains(string(files["meals.json"]), "lentejas")
+				s.Contains(string(files["calendar.json"]), "2023-05-01")
+			}
+
+			s.Equal(t.expectedStatusCode, c.Response().Status)
+		})
+	}
+}
+
+func (s *ExportAPITestSuite) TestGetExportCSVProfile() {
+	userID := "01FN3EEB2NVFJAHAPU00000001"
+	_, err := s.db.Conn.Exec("UPDATE users SET name = '=firstuser', last_login_at = '2023-05-01T10:00:00.000000Z' WHERE id = ?", userID)
+	s.Require().NoError(err)
+	api := ExportAPI{DB: *s.db, Manager: managers.NewExportManager(*s.db)}
+
+	c := s.getEchoContext("/user/"+userID+"/export?csv=true", []string{internal.ParamUserID}, []string{userID})
+	s.Require().NoError(api.GetExportHandler(c))
+
+	files := s.readZip(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes())
+	profile, err := csv.NewReader(bytes.NewReader(files["profile.csv"])).ReadAll()
+	s.Require().NoError(err)
+	s.Require().Len(profile, 2)
+	row := map[string]string{}
+	for i, column := range profile[0] {
+		row[column] = profile[1][i]
+	}
+	s.Equal("'=firstuser", row["name"], "the name is written escaped, not as a pointer")
+	s.Equal("2023-05-01T10:00:00.000000Z", row["lastLoginAt"])
+	s.Equal("firstuser@mail.com", row["mail"])
+}
+
+func (s *ExportAPITestSuite) TestExportAccess() {
+	config.Config.AdminUsers = "01FN3EEB2NVFJAHAPU00000009"
+	defer func() { config.Config.AdminUsers = "" }()
+	tests := []struct {
+		name               string
+		actor              string
+		expectedResp       error
+		expectedStatusCode int
+	}{
+		{name: "[001] User exports their own data (ok)", actor: "01FN3EEB2NVFJAHAPU00000001", expectedStatusCode: http.StatusOK},
+		{name: "[002] Admin exports the data of a user (ok)", actor: "01FN3EEB2NVFJAHAPU00000009", expectedStatusCode: http.StatusOK},
+		{
+			name:               "[003] User exports the data of another user (403)",
+			actor:              "01FN3EEB2NVFJAHAPU00000002",
+			expectedResp:       internal.ErrForbidden,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "[004] Anonymous exports the data of a user (401)",
+			expectedResp:       internal.ErrUnauthenticated,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			api := ExportAPI{DB: *s.db, Manager: managers.NewExportManager(*s.db)}
+			c := s.getEchoContext("/user/01FN3EEB2NVFJAHAPU00000001/export", []string{internal.ParamUserID}, []string{"01FN3EEB2NVFJAHAPU00000001"})
+			if t.actor != "" {
+				c.Request().Header.Set(internal.HeaderActorID, t.actor)
+			}
+			err := serve(RequireSelfOrAdmin(api.GetExportHandler), c)
+
+			s.Equal(t.expectedStatusCode, c.Response().Status)
+			if t.expectedResp != nil {
+				s.ErrorIs(err, t.expectedResp)
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
+
+func (s *ExportAPITestSuite) TestAsyncExport() {
+	config.Config.ExportAsyncThreshold = "1"
+	api := ExportAPI{DB: *s.db, Manager: managers.NewExportManager(*s.db)}
+	userID := "01FN3EEB2NVFJAHAPU00000001"
+
+	c := s.getEchoContext("/user/"+userID+"/export", []string{internal.ParamUserID}, []string{userID})
+	s.Require().NoError(api.GetExportHandler(c))
+	s.Equal(http.StatusAccepted, c.Response().Status)
+	job := new(models.ExportJob)
+	s.Require().NoError(jsoniter.Unmarshal(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes(), job))
+	s.Equal("/user/"+userID+"/export/"+job.Id, c.Response().Header().Get(echo.HeaderLocation))
+
+	s.Eventually(func() bool {
+		c = s.getEchoContext("/", []string{internal.ParamUserID, internal.ParamExportID}, []string{userID, job.Id})
+		s.Require().NoError(api.GetExportJobHandler(c))
+		s.Require().NoError(jsoniter.Unmarshal(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes(), job))
+		return job.Status == models.ExportDone
+	}, 5*time.Second, 10*time.Millisecond)
+	s.NotNil(job.CompletedAt)
+
+	c = s.getEchoContext("/", []string{internal.ParamUserID, internal.ParamExportID}, []string{userID, job.Id})
+	s.Require().NoError(api.DownloadExportHandler(c))
+	s.Equal(http.StatusOK, c.Response().Status)
+	files := s.readZip(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes())
+	s.Contains(files, "meals.json")
+
+	c = s.getEchoContext("/", []string{internal.ParamUserID, internal.ParamExportID}, []string{"01FN3EEB2NVFJAHAPU00000099", job.Id})
+	s.Error(serve(api.GetExportJobHandler, c))
+	s.Equal(http.StatusNotFound, c.Response().Status, "jobs are only visible to their user")
+
+	c = s.getEchoContext("/", []string{internal.ParamUserID, internal.ParamExportID}, []string{"01FN3EEB2NVFJAHAPU00000099", job.Id})
+	s.ErrorIs(serve(api.DownloadExportHandler, c), internal.ErrExportNotFound, "exports are only downloaded by their user")
+	s.Equal(http.StatusNotFound, c.Response().Status)
+}
+
+func (s *ExportAPITestSuite) TestStoppedExport() {
+	config.Config.ExportAsyncThreshold = "1"
+	manager := managers.NewExportManager(*s.db)
+	stopped, stop := context.WithCancel(context.Background())
+	stop()
+	manager.ResumeExportJobs(stopped)
+	api := ExportAPI{DB: *s.db, Manager: manager}
+	userID := "01FN3EEB2NVFJAHAPU00000001"
+
+	c := s.getEchoContext("/user/"+userID+"/export", []string{internal.ParamUserID}, []string{userID})
+	s.Require().NoError(api.GetExportHandler(c))
+	s.Equal(http.StatusAccepted, c.Response().Status)
+	job := new(models.ExportJob)
+	s.Require().NoError(jsoniter.Unmarshal(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes(), job))
+	manager.Wait()
+
+	getJob := func(api ExportAPI) *models.ExportJob {
+		c := s.getEchoContext("/", []string{internal.ParamUserID, internal.ParamExportID}, []string{userID, job.Id})
+		s.Require().NoError(api.GetExportJobHandler(c))
+		found := new(models.ExportJob)
+		s.Require().NoError(jsoniter.Unmarshal(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes(), found))
+		return found
+	}
+	s.Equal(models.ExportPending, getJob(api).Status, "a stopped job is left to be resumed")
+
+	resumed := managers.NewExportManager(*s.db)
+	resumed.ResumeExportJobs(context.Background())
+	resumed.Wait()
+	s.Equal(models.ExportDone, getJob(ExportAPI{DB: *s.db, Manager: resumed}).Status)
+}
+
+// finishedExport queues an export of the user with manager and returns its
+// job, with the file it was written to, once finished.
+func (s *ExportAPITestSuite) finishedExport(manager *managers.ExportManager, userID string) (*models.ExportJob, string) {
+	job, err := manager.CreateExportJob(context.Background(), models.Actor{}, userID, false)
+	s.Require().NoError(err)
+	manager.Wait()
+	job, err = manager.GetExportJob(context.Background(), userID, job.Id)
+	s.Require().NoError(err)
+	s.Require().Equal(models.ExportDone, job.Status)
+	var file string
+	s.Require().NoError(s.db.Conn.Get(&file, "SELECT file FROM export_jobs WHERE id = ?", job.Id))
+	s.FileExists(file)
+	return job, file
+}
+
+func (s *ExportAPITestSuite) TestExportExpiry() {
+	userID := "01FN3EEB2NVFJAHAPU00000001"
+	config.Config.ExportTTL = "1h"
+	manager := managers.NewExportManager(*s.db)
+	kept, keptFile := s.finishedExport(manager, userID)
+	s.Require().NotNil(kept.ExpiresAt)
+
+	expired, expiredFile := s.finishedExport(manager, userID)
+	_, err := s.db.Conn.Exec("UPDATE export_jobs SET expires_at = '2023-05-01T10:00:00.000000Z' WHERE id = ?", expired.Id)
+	s.Require().NoError(err)
+
+	api := ExportAPI{DB: *s.db, Manager: manager}
+	c := s.getEchoContext("/", []string{internal.ParamUserID, internal.ParamExportID}, []string{userID, expired.Id})
+	s.ErrorIs(serve(api.DownloadExportHandler, c), internal.ErrExportNotFound, "an expired export is not served while waiting for the cleanup")
+
+	deleted, err := manager.CleanUpExports(context.Background())
+	s.NoError(err)
+	s.Equal(1, deleted)
+	s.NoFileExists(expiredFile)
+	s.FileExists(keptFile)
+	_, err = manager.GetExportJob(context.Background(), userID, expired.Id)
+	s.ErrorIs(err, internal.ErrExportNotFound)
+	_, err = manager.GetExportJob(context.Background(), userID, kept.Id)
+	s.NoError(err)
+}
+
+func (s *ExportAPITestSuite) TestExportsDeletedWithUser() {
+	userID := "01FN3EEB2NVFJAHAPU00000001"
+	manager := managers.NewExportManager(*s.db)
+	userManager := managers.NewUserManager(*s.db)
+
+	anonymizedJob, anonymizedFile := s.finishedExport(manager, userID)
+	_, err := userManager.AnonymizeUser(context.Background(), models.Actor{}, userID)
+	s.Require().NoError(err)
+	s.NoFileExists(anonymizedFile)
+	_, err = manager.GetExportJob(context.Background(), userID, anonymizedJob.Id)
+	s.ErrorIs(err, internal.ErrExportNotFound)
+
+	deletedJob, deletedFile := s.finishedExport(manager, userID)
+	s.Require().NoError(userManager.DeleteUser(context.Background(), models.Actor{}, userID, 0))
+	s.NoFileExists(deletedFile)
+	_, err = manager.GetExportJob(context.Background(), userID, deletedJob.Id)
+	s.ErrorIs(err, internal.ErrExportNotFound)
+}
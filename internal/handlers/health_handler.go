@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"users/internal/managers"
+	"users/internal/models"
+	"users/pkg/database"
+)
+
+type HealthAPI struct {
+	DB      database.Database
+	Manager managers.IHealthManager
+}
+
+// LivenessHandler endpoint telling the process is alive, without checking its dependencies
+func (a *HealthAPI) LivenessHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, models.Health{Status: models.HealthOK})
+}
+
+// ReadinessHandler endpoint telling whether the service is ready to serve requests
+func (a *HealthAPI) ReadinessHandler(c echo.Context) error {
+	health := a.Manager.CheckReadiness(c.Request().Context())
+	if health.Status != models.HealthOK {
+		return c.JSON(http.StatusServiceUnavailable, health)
+	}
+	return c.JSON(http.StatusOK, health)
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"github.com/json-iterator/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"users/internal/config"
+	"users/internal/managers"
+	"users/internal/models"
+	"users/pkg/database"
+)
+
+type HealthAPITestSuite struct {
+	suite.Suite
+	db *database.Database
+}
+
+func TestHealthAPITestSuite(t *testing.T) {
+	suite.Run(t, new(HealthAPITestSuite))
+}
+
+func (s *HealthAPITestSuite) SetupTest() {
+	_ = database.RemoveDB(databaseTest)
+	s.db = database.InitDB(databaseTest)
+	config.Config.DBName = databaseTest
+}
+
+func (s *HealthAPITestSuite) TearDownTest() {
+	config.Config.DBName, config.Config.HealthMinFreeDisk = "", ""
+	s.db = nil
+	_ = database.RemoveDB(databaseTest)
+}
+
+func (s *HealthAPITestSuite) getEchoContext(target string) echo.Context {
+	e := echo.New()
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	return e.NewContext(req, httptest.NewRecorder())
+}
+
+func (s *HealthAPITestSuite) listed(checks []string, name string) bool {
+	for _, check := range checks {
+		if check == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *HealthAPITestSuite) TestLivenessHandler() {
+	api := HealthAPI{DB: *s.db, Manager: managers.NewHealthManager(*s.db)}
+	c := s.getEchoContext("/healthz")
+	s.Require().NoError(api.LivenessHandler(c))
+	s.Equal(http.StatusOK, c.Response().Status)
+	s.JSONEq(`{"status":"ok"}`, c.Response().Writer.(*httptest.ResponseRecorder).Body.String())
+}
+
+func (s *HealthAPITestSuite) TestReadinessHandler() {
+	tests := []struct {
+		name               string
+		setUp              func()
+		failed             []string
+		expectedStatusCode int
+	}{
+		{
+			name:               "[001] Ready (ok)",
+			setUp:              func() {},
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name: "[002] Migrations behind (503)",
+			setUp: func() {
+				s.Require().NoError(database.UpdateVersion(s.db.Conn, 0))
+			},
+			failed:             []string{"migrations"},
+			expectedStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name: "[003] Disk full (503)",
+			setUp: func() {
+				config.Config.HealthMinFreeDisk = "18446744073709551615"
+			},
+			failed:             []string{"disk"},
+			expectedStatusCode: http.StatusServiceUnavailable,
+		},
+		{
+			name: "[004] Database closed (503)",
+			setUp: func() {
+				s.Require().NoError(s.db.Conn.Close())
+			},
+			failed:             []string{"database", "migrations"},
+			expectedStatusCode: http.StatusServiceUnavailable,
+		},
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			s.SetupTest()
+			defer s.TearDownTest()
+			t.setUp()
+			api := HealthAPI{DB: *s.db, Manager: managers.NewHealthManager(*s.db)}
+
+			c := s.getEchoContext("/readyz")
+			s.Require().NoError(api.ReadinessHandler(c))
+
+			health := new(models.Health)
+			s.NoError(jsoniter.Unmarshal(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes(), health))
+			s.Equal(t.expectedStatusCode, c.Response().Status)
+			s.Len(health.Checks, 3)
+			for name, check := range health.Checks {
+				if s.listed(t.failed, name) {
+					s.Equal(models.HealthFail, check.Status, name)
+				} else {
+					s.Equal(models.HealthOK, check.Status, name)
+				}
+			}
+			if len(t.failed) == 0 {
+				s.Equal(models.HealthOK, health.Status)
+				s.EqualValues(database.Version(), health.Checks["migrations"].Detail["version"])
+			}
+		})
+	}
+}
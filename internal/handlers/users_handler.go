@@ -1,8 +1,11 @@
 package handlers
 
 import (
+	"context"
 	"github.com/labstack/echo/v4"
 	"net/http"
+	"strconv"
+	"strings"
 	"users/internal"
 	"users/internal/managers"
 	"users/internal/models"
@@ -13,17 +16,19 @@ import (
 type UserAPI struct {
 	DB      database.Database
 	Manager managers.IUserManager
+	// RequireIfMatch rejects updates and deletions without an If-Match header.
+	RequireIfMatch bool
 }
 
 // Login endpoint
 func (a *UserAPI) Login(c echo.Context) error {
 	userReq := &models.User{}
 	if err := c.Bind(userReq); err != nil {
-		return internal.NewErrorResponse(c, internal.ErrWrongBody)
+		return internal.BindError(err)
 	}
-	user, err := a.Manager.Login(*userReq)
+	user, err := a.Manager.Login(c.Request().Context(), actorFromContext(c), *userReq)
 	if err != nil {
-		return internal.NewErrorResponse(c, err)
+		return err
 	}
 	cleanUser(user)
 	return c.JSON(http.StatusOK, user)
@@ -35,12 +40,17 @@ func (a *UserAPI) GetUserHandler(c echo.Context) error {
 	if err := url.ParseURLPath(c, url.PathMap{
 		internal.ParamUserID: {Target: &ID, Err: internal.ErrUserIDNotPresent},
 	}); err != nil {
-		return internal.NewErrorResponse(c, err)
+		return err
 	}
 
-	user, err := a.Manager.GetUser(ID)
+	user, err := a.Manager.GetUser(c.Request().Context(), ID)
 	if err != nil {
-		return internal.NewErrorResponse(c, err)
+		return err
+	}
+	etag := userETag(user)
+	c.Response().Header().Set(internal.HeaderETag, etag)
+	if matchesETag(c.Request().Header.Get(internal.HeaderIfNoneMatch), etag) {
+		return c.NoContent(http.StatusNotModified)
 	}
 	cleanUser(user)
 	return c.JSON(http.StatusOK, user)
@@ -50,12 +60,12 @@ func (a *UserAPI) GetUserHandler(c echo.Context) error {
 func (a *UserAPI) PostUserHandler(c echo.Context) error {
 	userReq := &models.User{}
 	if err := c.Bind(userReq); err != nil {
-		return internal.NewErrorResponse(c, internal.ErrWrongBody)
+		return internal.BindError(err)
 	}
 
-	user, err := a.Manager.CreateUser(*userReq)
+	user, err := a.Manager.CreateUser(c.Request().Context(), actorFromContext(c), *userReq)
 	if err != nil {
-		return internal.NewErrorResponse(c, err)
+		return err
 	}
 	cleanUser(user)
 	return c.JSON(http.StatusCreated, user)
@@ -67,18 +77,24 @@ func (a *UserAPI) PutUserHandler(c echo.Context) error {
 	if err := url.ParseURLPath(c, url.PathMap{
 		internal.ParamUserID: {Target: &ID, Err: internal.ErrUserIDNotPresent},
 	}); err != nil {
-		return internal.NewErrorResponse(c, err)
+		return err
+	}
+
+	version, err := a.ifMatchVersion(c)
+	if err != nil {
+		return err
 	}
 
 	userReq := &models.User{}
 	if err := c.Bind(userReq); err != nil {
-		return internal.NewErrorResponse(c, internal.ErrWrongBody)
+		return internal.BindError(err)
 	}
 
-	user, err := a.Manager.UpdateUser(ID, *userReq)
+	user, err := a.Manager.UpdateUser(c.Request().Context(), actorFromContext(c), ID, *userReq, version)
 	if err != nil {
-		return internal.NewErrorResponse(c, err)
+		return err
 	}
+	c.Response().Header().Set(internal.HeaderETag, userETag(user))
 	cleanUser(user)
 	return c.JSON(http.StatusOK, user)
 }
@@ -89,18 +105,111 @@ func (a *UserAPI) DeleteUserHandler(c echo.Context) error {
 	if err := url.ParseURLPath(c, url.PathMap{
 		internal.ParamUserID: {Target: &ID, Err: internal.ErrUserIDNotPresent},
 	}); err != nil {
-		return internal.NewErrorResponse(c, err)
+		return err
 	}
 
-	err := a.Manager.DeleteUser(ID)
+	version, err := a.ifMatchVersion(c)
 	if err != nil {
-		return internal.NewErrorResponse(c, err)
+		return err
+	}
+
+	err = a.Manager.DeleteUser(c.Request().Context(), actorFromContext(c), ID, version)
+	if err != nil {
+		return err
 	}
 
 	return c.NoContent(http.StatusNoContent)
 }
 
+// GetDeletionImpactHandler endpoint to preview what deleting a user affects
+func (a *UserAPI) GetDeletionImpactHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamUserID: {Target: &ID, Err: internal.ErrUserIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	impact, err := a.Manager.GetDeletionImpact(c.Request().Context(), ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, impact)
+}
+
+// AnonymizeUserHandler endpoint to erase the personal data of a user while
+// keeping its id
+func (a *UserAPI) AnonymizeUserHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamUserID: {Target: &ID, Err: internal.ErrUserIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	user, err := a.Manager.AnonymizeUser(c.Request().Context(), actorFromContext(c), ID)
+	if err != nil {
+		return err
+	}
+	cleanUser(user)
+	return c.JSON(http.StatusOK, user)
+}
+
+// ifMatchVersion reads the version of the user a request is conditioned on
+// from its If-Match header, 0 if there is none or it is "*". Weak or several
+// ETags can't match a single version.
+func (a *UserAPI) ifMatchVersion(c echo.Context) (int, error) {
+	header := strings.TrimSpace(c.Request().Header.Get(internal.HeaderIfMatch))
+	switch header {
+	case "":
+		if a.RequireIfMatch {
+			return 0, internal.ErrIfMatchRequired
+		}
+		return 0, nil
+	case "*":
+		return 0, nil
+	}
+	if len(header) < 3 || header[0] != '"' || header[len(header)-1] != '"' {
+		return 0, internal.ErrVersionMismatch
+	}
+	version, err := strconv.Atoi(header[1 : len(header)-1])
+	if err != nil || version <= 0 {
+		return 0, internal.ErrVersionMismatch
+	}
+	return version, nil
+}
+
+func userETag(user *models.User) string {
+	return `"` + strconv.Itoa(user.Version) + `"`
+}
+
 func cleanUser(user *models.User) *models.User {
 	user.Password = ""
 	return user
 }
+
+// ActorLocale returns the locale of the user making a request, so errors are
+// answered in their language when the request asks for none, or "" if there
+// is no such user.
+func (a *UserAPI) ActorLocale(ctx context.Context, actorID string) string {
+	user, err := a.Manager.GetUser(ctx, actorID)
+	if err != nil {
+		return ""
+	}
+	return user.Locale
+}
+
+// actorFromContext collects who is making the request for the audit trail.
+func actorFromContext(c echo.Context) models.Actor {
+	req := c.Request()
+	requestID := req.Header.Get(echo.HeaderXRequestID)
+	if requestID == "" {
+		requestID = c.Response().Header().Get(echo.HeaderXRequestID)
+	}
+	return models.Actor{
+		ID:        req.Header.Get(internal.HeaderActorID),
+		IP:        c.RealIP(),
+		UserAgent: req.UserAgent(),
+		RequestID: requestID,
+	}
+}
@@ -2,17 +2,32 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"github.com/json-iterator/go"
 	"github.com/labstack/echo/v4"
 	"github.com/oklog/ulid/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/suite"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"golang.org/x/exp/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 	"users/internal"
+	"users/internal/config"
 	"users/internal/managers"
 	"users/internal/models"
+	"users/internal/repositories"
 	"users/pkg/database"
+	"users/pkg/logging"
+	"users/pkg/metrics"
+	"users/pkg/tracing"
 )
 
 var databaseTest = "/amc_test.db"
@@ -66,12 +81,7 @@ func (s *UserAPITestSuite) TestLoginHandler() {
 				Mail:     "inventeduser@mail.com",
 				Password: "MyPassword2.123",
 			},
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusNotFound,
-					Message: internal.ErrUserNotFound.Error(),
-				},
-			},
+			expectedResp:       internal.ErrUserNotFound,
 			expectedStatusCode: http.StatusNotFound,
 			wantErr:            true,
 		},
@@ -81,24 +91,18 @@ func (s *UserAPITestSuite) TestLoginHandler() {
 				Mail:     "firstuser@mail.com",
 				Password: "MyPassword2.123",
 			},
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusBadRequest,
-					Message: internal.ErrWrongPassword.Error(),
-				},
-			},
+			expectedResp:       internal.ErrWrongPassword,
 			expectedStatusCode: http.StatusBadRequest,
 			wantErr:            true,
 		},
 		{
 			name:    "[004] Wrong struct sent (400)",
 			reqBody: "invalid",
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusBadRequest,
-					Message: internal.ErrWrongBody.Error(),
-				},
-			},
+			expectedResp: internal.ErrWrongBody.WithFields(internal.FieldError{
+				Rule:    "type",
+				Param:   "object",
+				Message: "debe ser de tipo object",
+			}),
 			expectedStatusCode: http.StatusBadRequest,
 			wantErr:            true,
 		},
@@ -120,7 +124,7 @@ func (s *UserAPITestSuite) TestLoginHandler() {
 			api := UserAPI{DB: *s.db, Manager: userManager}
 
 			c := getEchoContext(t.reqBody)
-			err := api.Login(c)
+			err := serve(api.Login, c)
 
 			if t.wantErr {
 				s.Equal(t.wantErr, err != nil)
@@ -128,9 +132,10 @@ func (s *UserAPITestSuite) TestLoginHandler() {
 				s.True(ok)
 				body := resp.Body.Bytes()
 
-				errorReturned := new(internal.ErrorResponse)
-				s.NoError(jsoniter.Unmarshal(body, errorReturned))
-				s.Equal(errorReturned, t.expectedResp)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
 			} else {
 				resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
 				s.True(ok)
@@ -138,6 +143,8 @@ func (s *UserAPITestSuite) TestLoginHandler() {
 
 				actualUser := new(models.User)
 				s.NoError(jsoniter.Unmarshal(body, actualUser))
+				s.NotNil(actualUser.LastLoginAt)
+				actualUser.LastLoginAt = nil
 				s.Equal(actualUser, t.expectedResp)
 			}
 
@@ -177,12 +184,7 @@ func (s *UserAPITestSuite) TestPostUserHandler() {
 				Mail:     "test1@testmail.com",
 				Password: "MyPassword2.123",
 			},
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusConflict,
-					Message: internal.ErrUserAlreadyExists.Error(),
-				},
-			},
+			expectedResp:       internal.ErrUserAlreadyExists,
 			expectedStatusCode: http.StatusConflict,
 			wantErr:            true,
 		},
@@ -191,24 +193,22 @@ func (s *UserAPITestSuite) TestPostUserHandler() {
 			reqBody: &models.User{
 				Password: "MyPassword2.123",
 			},
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusBadRequest,
-					Message: internal.ErrWrongBody.Error(),
-				},
-			},
+			expectedResp: internal.ErrWrongBody.WithFields(internal.FieldError{
+				Field:   "mail",
+				Rule:    "required",
+				Message: "es obligatorio",
+			}),
 			expectedStatusCode: http.StatusBadRequest,
 			wantErr:            true,
 		},
 		{
 			name:    "[004] Wrong struct sent (400)",
 			reqBody: "invalid",
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusBadRequest,
-					Message: internal.ErrWrongBody.Error(),
-				},
-			},
+			expectedResp: internal.ErrWrongBody.WithFields(internal.FieldError{
+				Rule:    "type",
+				Param:   "object",
+				Message: "debe ser de tipo object",
+			}),
 			expectedStatusCode: http.StatusBadRequest,
 			wantErr:            true,
 		},
@@ -230,7 +230,7 @@ func (s *UserAPITestSuite) TestPostUserHandler() {
 			api := UserAPI{DB: *s.db, Manager: userManager}
 
 			c := getEchoContext(t.reqBody)
-			err := api.PostUserHandler(c)
+			err := serve(api.PostUserHandler, c)
 
 			if t.wantErr {
 				s.Equal(t.wantErr, err != nil)
@@ -238,9 +238,10 @@ func (s *UserAPITestSuite) TestPostUserHandler() {
 				s.True(ok)
 				body := resp.Body.Bytes()
 
-				errorReturned := new(internal.ErrorResponse)
-				s.NoError(jsoniter.Unmarshal(body, errorReturned))
-				s.Equal(errorReturned, t.expectedResp)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
 			} else {
 				resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
 				s.True(ok)
@@ -248,6 +249,9 @@ func (s *UserAPITestSuite) TestPostUserHandler() {
 
 				actualUser := new(models.User)
 				s.NoError(jsoniter.Unmarshal(body, actualUser))
+				s.NotEmpty(actualUser.CreatedAt)
+				s.Equal(actualUser.CreatedAt, actualUser.UpdatedAt)
+				actualUser.CreatedAt, actualUser.UpdatedAt = "", ""
 				actualUser.Id = t.expectedULID.String()
 				s.Equal(actualUser, t.expectedResp)
 			}
@@ -278,25 +282,15 @@ func (s *UserAPITestSuite) TestGetUserHandler() {
 			wantErr:            false,
 		},
 		{
-			name: "[002] Get user, userId not indicated (400)",
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusBadRequest,
-					Message: internal.ErrUserIDNotPresent.Error(),
-				},
-			},
+			name:               "[002] Get user, userId not indicated (400)",
+			expectedResp:       internal.ErrUserIDNotPresent,
 			expectedStatusCode: http.StatusBadRequest,
 			wantErr:            true,
 		},
 		{
-			name:   "[003] User does not exist (404)",
-			userID: "01FN3EEB2NVFJAHAPU00000099",
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusNotFound,
-					Message: internal.ErrUserNotFound.Error(),
-				},
-			},
+			name:               "[003] User does not exist (404)",
+			userID:             "01FN3EEB2NVFJAHAPU00000099",
+			expectedResp:       internal.ErrUserNotFound,
 			expectedStatusCode: http.StatusNotFound,
 			wantErr:            true,
 		},
@@ -317,7 +311,7 @@ func (s *UserAPITestSuite) TestGetUserHandler() {
 			api := UserAPI{DB: *s.db, Manager: userManager}
 
 			c := getEchoContext(t.userID)
-			err := api.GetUserHandler(c)
+			err := serve(api.GetUserHandler, c)
 
 			if t.wantErr {
 				s.Equal(t.wantErr, err != nil)
@@ -325,9 +319,10 @@ func (s *UserAPITestSuite) TestGetUserHandler() {
 				s.True(ok)
 				body := resp.Body.Bytes()
 
-				errorReturned := new(internal.ErrorResponse)
-				s.NoError(jsoniter.Unmarshal(body, errorReturned))
-				s.Equal(errorReturned, t.expectedResp)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
 			} else {
 				resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
 				s.True(ok)
@@ -378,23 +373,13 @@ func (s *UserAPITestSuite) TestPutUserHandler() {
 				Mail:     "inventuser@mail.com",
 				Password: "MyPassword.123",
 			},
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusNotFound,
-					Message: internal.ErrUserNotFound.Error(),
-				},
-			},
+			expectedResp:       internal.ErrUserNotFound,
 			expectedStatusCode: http.StatusNotFound,
 			wantErr:            true,
 		},
 		{
-			name: "[003] User id not indicated (400)",
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusBadRequest,
-					Message: internal.ErrUserIDNotPresent.Error(),
-				},
-			},
+			name:               "[003] User id not indicated (400)",
+			expectedResp:       internal.ErrUserIDNotPresent,
 			expectedStatusCode: http.StatusBadRequest,
 			wantErr:            true,
 		},
@@ -402,12 +387,11 @@ func (s *UserAPITestSuite) TestPutUserHandler() {
 			name:    "[004] Wrong struct sent (400)",
 			userID:  "01FN3EEB2NVFJAHAPU00000001",
 			reqBody: "invalid",
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusBadRequest,
-					Message: internal.ErrWrongBody.Error(),
-				},
-			},
+			expectedResp: internal.ErrWrongBody.WithFields(internal.FieldError{
+				Rule:    "type",
+				Param:   "object",
+				Message: "debe ser de tipo object",
+			}),
 			expectedStatusCode: http.StatusBadRequest,
 			wantErr:            true,
 		},
@@ -431,7 +415,7 @@ func (s *UserAPITestSuite) TestPutUserHandler() {
 			api := UserAPI{DB: *s.db, Manager: userManager}
 
 			c := getEchoContext(t.userID, t.reqBody)
-			err := api.PutUserHandler(c)
+			err := serve(api.PutUserHandler, c)
 
 			if t.wantErr {
 				s.Equal(t.wantErr, err != nil)
@@ -439,9 +423,10 @@ func (s *UserAPITestSuite) TestPutUserHandler() {
 				s.True(ok)
 				body := resp.Body.Bytes()
 
-				errorReturned := new(internal.ErrorResponse)
-				s.NoError(jsoniter.Unmarshal(body, errorReturned))
-				s.Equal(errorReturned, t.expectedResp)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
 			} else {
 				resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
 				s.True(ok)
@@ -449,6 +434,8 @@ func (s *UserAPITestSuite) TestPutUserHandler() {
 
 				actualUser := new(models.User)
 				s.NoError(jsoniter.Unmarshal(body, actualUser))
+				s.NotEmpty(actualUser.UpdatedAt, "updated_at is kept by the database")
+				actualUser.UpdatedAt = ""
 				s.Equal(actualUser, t.expectedResp)
 			}
 
@@ -472,25 +459,15 @@ func (s *UserAPITestSuite) TestDeleteUserHandler() {
 			wantErr:            false,
 		},
 		{
-			name:   "[002] Delete user that does not exists (404)",
-			userId: "01FN3EEB2NVFJAHAPU00000099",
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusNotFound,
-					Message: internal.ErrUserNotFound.Error(),
-				},
-			},
+			name:               "[002] Delete user that does not exists (404)",
+			userId:             "01FN3EEB2NVFJAHAPU00000099",
+			expectedResp:       internal.ErrUserNotFound,
 			expectedStatusCode: http.StatusNotFound,
 			wantErr:            true,
 		},
 		{
-			name: "[003] User id not indicated (400)",
-			expectedResp: &internal.ErrorResponse{
-				Err: internal.ErrorBody{
-					Status:  http.StatusBadRequest,
-					Message: internal.ErrUserIDNotPresent.Error(),
-				},
-			},
+			name:               "[003] User id not indicated (400)",
+			expectedResp:       internal.ErrUserIDNotPresent,
 			expectedStatusCode: http.StatusBadRequest,
 			wantErr:            true,
 		},
@@ -511,7 +488,7 @@ func (s *UserAPITestSuite) TestDeleteUserHandler() {
 			api := UserAPI{DB: *s.db, Manager: userManager}
 
 			c := getEchoContext(t.userId)
-			err := api.DeleteUserHandler(c)
+			err := serve(api.DeleteUserHandler, c)
 
 			if t.wantErr {
 				s.Equal(t.wantErr, err != nil)
@@ -519,13 +496,626 @@ func (s *UserAPITestSuite) TestDeleteUserHandler() {
 				s.True(ok)
 				body := resp.Body.Bytes()
 
-				errorReturned := new(internal.ErrorResponse)
-				s.NoError(jsoniter.Unmarshal(body, errorReturned))
-				s.Equal(errorReturned, t.expectedResp)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
+			}
+			s.Equal(t.expectedStatusCode, c.Response().Status)
+		})
+	}
+}
+
+func (s *UserAPITestSuite) TestDeletionPolicies() {
+	insertData := func() {
+		s.db.Conn.Exec("INSERT INTO users(id,name,mail,password) VALUES (?,?,?,?)", "01FN3EEB2NVFJAHAPU00000002", "archive", "archive@mail.com", "-")
+		s.db.Conn.Exec("DELETE FROM meals")
+		s.db.Conn.Exec("DELETE FROM calendar")
+		s.db.Conn.Exec("INSERT INTO meals(id,user_id,name,kcal,type,ingredients,seasons) VALUES (?,?,?,?,?,?,?)", "meal1", "01FN3EEB2NVFJAHAPU00000001", "soup", 300, "lunch", "water", "winter")
+		s.db.Conn.Exec("INSERT INTO meals(id,user_id,name,kcal,type,ingredients,seasons) VALUES (?,?,?,?,?,?,?)", "meal2", "01FN3EEB2NVFJAHAPU00000001", "salad", 200, "dinner", "lettuce", "summer")
+		s.db.Conn.Exec("INSERT INTO calendar(user_id,meal_id,date,name) VALUES (?,?,?,?)", "01FN3EEB2NVFJAHAPU00000001", "meal1", "2023-05-01", "soup")
+		s.db.Conn.Exec("INSERT INTO calendar(user_id,meal_id,date,name) VALUES (?,?,?,?)", "01FN3EEB2NVFJAHAPU00000002", "meal9", "2023-05-01", "stew")
+	}
+	count := func(query string, args ...interface{}) (n int) {
+		s.NoError(s.db.Conn.Get(&n, query, args...))
+		return n
+	}
+	tests := []struct {
+		name               string
+		policy             string
+		expectedImpact     *models.DeletionImpact
+		expectedStatusCode int
+		expectedMeals      int
+		expectedCalendar   int
+	}{
+		{
+			name:               "[001] Cascade deletes meals and calendar (ok)",
+			policy:             models.DeletionCascade,
+			expectedImpact:     &models.DeletionImpact{UserId: "01FN3EEB2NVFJAHAPU00000001", Policy: models.DeletionCascade, Meals: 2, CalendarEntries: 1},
+			expectedStatusCode: http.StatusNoContent,
+			expectedMeals:      0,
+			expectedCalendar:   1,
+		},
+		{
+			name:               "[002] Block while the user has data (409)",
+			policy:             models.DeletionBlock,
+			expectedImpact:     &models.DeletionImpact{UserId: "01FN3EEB2NVFJAHAPU00000001", Policy: models.DeletionBlock, Meals: 2, CalendarEntries: 1, Blocked: true},
+			expectedStatusCode: http.StatusConflict,
+			expectedMeals:      2,
+			expectedCalendar:   2,
+		},
+		{
+			name:   "[003] Reassign to another user (ok)",
+			policy: models.DeletionReassign,
+			expectedImpact: &models.DeletionImpact{UserId: "01FN3EEB2NVFJAHAPU00000001", Policy: models.DeletionReassign,
+				ReassignTo: "01FN3EEB2NVFJAHAPU00000002", Meals: 2, CalendarEntries: 1, Conflicts: 1},
+			expectedStatusCode: http.StatusNoContent,
+			expectedMeals:      2,
+			expectedCalendar:   1,
+		},
+	}
+	getEchoContext := func(method, route string) echo.Context {
+		e := echo.New()
+		req := httptest.NewRequest(method, route, nil)
+		req.Header.Set(internal.HeaderActorID, "01FN3EEB2NVFJAHAPU00000001")
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames(internal.ParamUserID)
+		c.SetParamValues("01FN3EEB2NVFJAHAPU00000001")
+		return c
+	}
+	defer func() { config.Config.UserDeletionPolicy, config.Config.UserDeletionReassignTo = "", "" }()
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			s.SetupTest()
+			insertData()
+			config.Config.UserDeletionPolicy, config.Config.UserDeletionReassignTo = t.policy, "01FN3EEB2NVFJAHAPU00000002"
+			api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+
+			c := getEchoContext(http.MethodGet, internal.RouteUserDeletionImpact)
+			s.NoError(serve(RequireSelfOrAdmin(api.GetDeletionImpactHandler), c))
+			impact := new(models.DeletionImpact)
+			s.NoError(jsoniter.Unmarshal(c.Response().Writer.(*httptest.ResponseRecorder).Body.Bytes(), impact))
+			s.Equal(t.expectedImpact, impact)
+
+			c = getEchoContext(http.MethodDelete, internal.RouteUserID)
+			_ = serve(api.DeleteUserHandler, c)
+			s.Equal(t.expectedStatusCode, c.Response().Status)
+
+			s.Equal(t.expectedMeals, count("SELECT COUNT(*) FROM meals"))
+			s.Equal(t.expectedCalendar, count("SELECT COUNT(*) FROM calendar"))
+			if t.expectedStatusCode == http.StatusNoContent {
+				s.Zero(count("SELECT COUNT(*) FROM meals WHERE user_id = ?", "01FN3EEB2NVFJAHAPU00000001"))
+				s.Zero(count("SELECT COUNT(*) FROM calendar WHERE user_id = ?", "01FN3EEB2NVFJAHAPU00000001"))
+			}
+		})
+	}
+
+	c := getEchoContext(http.MethodGet, internal.RouteUserDeletionImpact)
+	c.Request().Header.Set(internal.HeaderActorID, "01FN3EEB2NVFJAHAPU00000002")
+	api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+	s.ErrorIs(serve(RequireSelfOrAdmin(api.GetDeletionImpactHandler), c), internal.ErrForbidden, "only the user or an admin previews it")
+}
+
+func (s *UserAPITestSuite) TestAnonymizeUserHandler() {
+	tests := []struct {
+		name               string
+		userId             string
+		actor              string
+		expectedResp       interface{}
+		expectedStatusCode int
+		wantErr            bool
+	}{
+		{
+			name:   "[001] Anonymize user (ok)",
+			userId: "01FN3EEB2NVFJAHAPU00000001",
+			actor:  "01FN3EEB2NVFJAHAPU00000001",
+			expectedResp: &models.User{
+				Id:   "01FN3EEB2NVFJAHAPU00000001",
+				Name: PointerString(models.AnonymizedName),
+				Mail: "anonymized-01fn3eeb2nvfjahapu00000001@anonymized.invalid",
+			},
+			expectedStatusCode: http.StatusOK,
+			wantErr:            false,
+		},
+		{
+			name:               "[002] Anonymize user twice (409)",
+			userId:             "01FN3EEB2NVFJAHAPU00000001",
+			actor:              "01FN3EEB2NVFJAHAPU00000001",
+			expectedResp:       internal.ErrUserAnonymized,
+			expectedStatusCode: http.StatusConflict,
+			wantErr:            true,
+		},
+		{
+			name:               "[003] Anonymize user that does not exists (404)",
+			userId:             "01FN3EEB2NVFJAHAPU00000099",
+			actor:              "01FN3EEB2NVFJAHAPU00000099",
+			expectedResp:       internal.ErrUserNotFound,
+			expectedStatusCode: http.StatusNotFound,
+			wantErr:            true,
+		},
+		{
+			name:               "[004] Anonymize another user (403)",
+			userId:             "01FN3EEB2NVFJAHAPU00000002",
+			actor:              "01FN3EEB2NVFJAHAPU00000001",
+			expectedResp:       internal.ErrForbidden,
+			expectedStatusCode: http.StatusForbidden,
+			wantErr:            true,
+		},
+		{
+			name:               "[005] Anonymize user anonymously (401)",
+			userId:             "01FN3EEB2NVFJAHAPU00000002",
+			expectedResp:       internal.ErrUnauthenticated,
+			expectedStatusCode: http.StatusUnauthorized,
+			wantErr:            true,
+		},
+	}
+	getEchoContext := func(userId, actor string) echo.Context {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, internal.RouteUserAnonymize, nil)
+		if actor != "" {
+			req.Header.Set(internal.HeaderActorID, actor)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames(internal.ParamUserID)
+		c.SetParamValues(userId)
+		return c
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+
+			c := getEchoContext(t.userId, t.actor)
+			err := serve(RequireSelfOrAdmin(api.AnonymizeUserHandler), c)
+
+			resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
+			s.True(ok)
+			body := resp.Body.Bytes()
+			if t.wantErr {
+				s.Equal(t.wantErr, err != nil)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
+			} else {
+				actual := new(models.User)
+				s.NoError(jsoniter.Unmarshal(body, actual))
+				s.Equal(t.expectedResp, actual)
 			}
 			s.Equal(t.expectedStatusCode, c.Response().Status)
 		})
 	}
 }
 
+func (s *UserAPITestSuite) TestAnonymizedMailIsBlocked() {
+	manager := managers.NewUserManager(*s.db)
+	_, err := manager.AnonymizeUser(context.Background(), models.Actor{}, "01FN3EEB2NVFJAHAPU00000001")
+	s.Require().NoError(err)
+
+	_, err = manager.Login(context.Background(), models.Actor{}, models.User{Mail: "firstuser@mail.com", Password: "MyPassword.123"})
+	s.Equal(internal.ErrUserNotFound, err)
+	_, err = manager.CreateUser(context.Background(), models.Actor{}, models.User{Mail: "FirstUser@mail.com", Password: "MyPassword.123"})
+	s.Equal(internal.ErrMailBlocked, err)
+
+	var events []string
+	s.NoError(s.db.Conn.Select(&events, "SELECT event FROM audit_events WHERE user_id = ?", "01FN3EEB2NVFJAHAPU00000001"))
+	s.Contains(events, models.AuditUserAnonymized)
+
+	// Once the period is over the mail can be used again.
+	s.db.Conn.Exec("UPDATE erased_mails SET blocked_until = ?", "2000-01-01T00:00:00.000000Z")
+	_, err = manager.CreateUser(context.Background(), models.Actor{}, models.User{Mail: "firstuser@mail.com", Password: "MyPassword.123"})
+	s.NoError(err)
+}
+
+func (s *UserAPITestSuite) TestProfileFields() {
+	manager := managers.NewUserManager(*s.db)
+	profile := models.User{
+		Mail:               "firstuser@mail.com",
+		Password:           "MyPassword.123",
+		Locale:             "es-ES",
+		Timezone:           "Europe/Madrid",
+		AvatarURL:          "https://cdn.local/avatars/firstuser.png",
+		DietaryPreferences: []string{"vegetarian", "gluten_free"},
+	}
+	_, err := manager.UpdateUser(context.Background(), models.Actor{}, "01FN3EEB2NVFJAHAPU00000001", profile, 0)
+	s.Require().NoError(err)
+
+	user, err := manager.GetUser(context.Background(), "01FN3EEB2NVFJAHAPU00000001")
+	s.Require().NoError(err)
+	s.Equal("es-ES", user.Locale)
+	s.Equal("Europe/Madrid", user.Timezone)
+	s.Equal("https://cdn.local/avatars/firstuser.png", user.AvatarURL)
+	s.Equal([]string{"vegetarian", "gluten_free"}, user.DietaryPreferences)
+	s.Len(user.UpdatedAt, len(models.TimestampLayout), "updated_at uses the service layout")
+
+	s.db.Conn.Exec("UPDATE users SET updated_at = ''")
+	_, err = manager.Login(context.Background(), models.Actor{}, models.User{Mail: "firstuser@mail.com", Password: "MyPassword.123"})
+	s.NoError(err)
+	user, _ = manager.GetUser(context.Background(), "01FN3EEB2NVFJAHAPU00000001")
+	s.Empty(user.UpdatedAt, "logging in does not update the profile")
+	s.NotNil(user.LastLoginAt)
+
+	for _, wrong := range []models.User{
+		{Mail: profile.Mail, Password: profile.Password, Timezone: "Mars/Olympus"},
+		{Mail: profile.Mail, Password: profile.Password, Locale: "not a locale"},
+		{Mail: profile.Mail, Password: profile.Password, DietaryPreferences: []string{"a,b"}},
+	} {
+		_, err = manager.UpdateUser(context.Background(), models.Actor{}, "01FN3EEB2NVFJAHAPU00000001", wrong, 0)
+		s.ErrorIs(err, internal.ErrWrongBody)
+	}
+}
+
+func (s *UserAPITestSuite) TestErrorLanguage() {
+	api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+	_, err := api.Manager.UpdateUser(context.Background(), models.Actor{}, "01FN3EEB2NVFJAHAPU00000001",
+		models.User{Mail: "firstuser@mail.com", Password: "MyPassword.123", Locale: "en-GB"}, 0)
+	s.Require().NoError(err)
+
+	e := echo.New()
+	e.HTTPErrorHandler = internal.NewHTTPErrorHandler(api.ActorLocale)
+	e.PUT(internal.RouteUserID, api.PutUserHandler)
+	e.POST(internal.RouteUser, api.PostUserHandler)
+	request := func(method, target, actor, acceptLanguage string, body interface{}) (*internal.Problem, string) {
+		reqBody, err := jsoniter.Marshal(body)
+		s.NoError(err)
+		req := httptest.NewRequest(method, target, bytes.NewBuffer(reqBody))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if actor != "" {
+			req.Header.Set(internal.HeaderActorID, actor)
+		}
+		if acceptLanguage != "" {
+			req.Header.Set(internal.HeaderAcceptLanguage, acceptLanguage)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		problem := new(internal.Problem)
+		s.NoError(jsoniter.Unmarshal(rec.Body.Bytes(), problem))
+		return problem, rec.Header().Get(internal.HeaderContentLanguage)
+	}
+	wrong := models.User{Mail: "firstuser@mail.com", Password: "MyPassword.123", Timezone: "Mars/Olympus"}
+
+	problem, lang := request(http.MethodPut, "/user/01FN3EEB2NVFJAHAPU00000001", "01FN3EEB2NVFJAHAPU00000001", "", wrong)
+	s.Equal("en", lang)
+	s.Equal("Bad Request", problem.Title, "answered in the locale of the user making the request")
+	s.Equal("the body sent is wrong", problem.Detail)
+	s.Equal([]internal.FieldError{{Field: "timezone", Rule: "timezone", Message: "is not a valid time zone"}}, problem.Errors)
+
+	problem, lang = request(http.MethodPut, "/user/01FN3EEB2NVFJAHAPU00000001", "01FN3EEB2NVFJAHAPU00000001", "es-ES,es;q=0.9", wrong)
+	s.Equal("es", lang)
+	s.Equal("Petición errónea", problem.Title, "Accept-Language comes first")
+	s.Equal("el cuerpo enviado es erróneo", problem.Detail)
+	s.Equal("no es una zona horaria válida", problem.Errors[0].Message)
+
+	problem, lang = request(http.MethodPut, "/user/01FN3EEB2NVFJAHAPU00000001", "", "", wrong)
+	s.Equal("es", lang, "the locale of the user the request is about is not leaked")
+	s.Equal("el cuerpo enviado es erróneo", problem.Detail)
+
+	problem, _ = request(http.MethodPost, internal.RouteUser, "", "", models.User{Password: "MyPassword.123"})
+	s.Equal("el cuerpo enviado es erróneo", problem.Detail, "no user to take the locale from")
+}
+
+func (s *UserAPITestSuite) TestBodyErrors() {
+	tests := []struct {
+		name               string
+		strict             bool
+		reqBody            string
+		expectedFields     []internal.FieldError
+		expectedStatusCode int
+	}{
+		{
+			name:               "[001] Wrong type (400)",
+			reqBody:            `{"mail": 5, "password": "MyPassword.123"}`,
+			expectedFields:     []internal.FieldError{{Field: "mail", Rule: "type", Param: "string", Message: "must be of type string"}},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "[002] Wrong type of list (400)",
+			reqBody:            `{"mail": "new@mail.com", "password": "MyPassword.123", "dietaryPreferences": "vegan"}`,
+			expectedFields:     []internal.FieldError{{Field: "dietaryPreferences", Rule: "type", Param: "array", Message: "must be of type array"}},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "[003] Unknown field in strict mode (400)",
+			strict:             true,
+			reqBody:            `{"mail": "new@mail.com", "password": "MyPassword.123", "nickname": "new"}`,
+			expectedFields:     []internal.FieldError{{Field: "nickname", Rule: "unknown", Message: "is not a known field"}},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "[004] Unknown field ignored (ok)",
+			reqBody:            `{"mail": "new@mail.com", "password": "MyPassword.123", "nickname": "new"}`,
+			expectedStatusCode: http.StatusCreated,
+		},
+		{
+			name:               "[005] Malformed JSON (400)",
+			reqBody:            `{"mail" "new@mail.com"}`,
+			expectedFields:     []internal.FieldError{{Rule: "syntax", Param: "9", Message: "malformed JSON at offset 9"}},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:               "[006] Truncated JSON (400)",
+			reqBody:            `{"mail": "new@mail.com"`,
+			expectedFields:     []internal.FieldError{{Rule: "syntax", Message: "the JSON is incomplete"}},
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+			e := echo.New()
+			e.HTTPErrorHandler = internal.HTTPErrorHandler
+			if t.strict {
+				e.JSONSerializer = internal.StrictJSONSerializer{}
+			}
+			e.POST(internal.RouteUser, api.PostUserHandler)
+			req := httptest.NewRequest(http.MethodPost, internal.RouteUser, strings.NewReader(t.reqBody))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			req.Header.Set(internal.HeaderAcceptLanguage, "en")
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			s.Equal(t.expectedStatusCode, rec.Code)
+			if t.expectedFields != nil {
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(rec.Body.Bytes(), problem))
+				s.Equal("invalid_body", problem.Code)
+				s.Equal(t.expectedFields, problem.Errors)
+			}
+		})
+	}
+}
+
+func (s *UserAPITestSuite) TestConditionalRequests() {
+	api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+	getEchoContext := func(method string, body interface{}, headers map[string]string) echo.Context {
+		reqBody, err := jsoniter.Marshal(body)
+		s.NoError(err)
+		e := echo.New()
+		req := httptest.NewRequest(method, internal.RouteUserID, bytes.NewBuffer(reqBody))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		for name, value := range headers {
+			req.Header.Set(name, value)
+		}
+		c := e.NewContext(req, httptest.NewRecorder())
+		c.SetParamNames(internal.ParamUserID)
+		c.SetParamValues("01FN3EEB2NVFJAHAPU00000001")
+		return c
+	}
+	update := &models.User{Mail: "firstuser@mail.com", Password: "MyPassword.123"}
+
+	c := getEchoContext(http.MethodGet, nil, nil)
+	s.NoError(api.GetUserHandler(c))
+	s.Equal(`"1"`, c.Response().Header().Get(internal.HeaderETag))
+
+	c = getEchoContext(http.MethodGet, nil, map[string]string{internal.HeaderIfNoneMatch: `"1"`})
+	s.NoError(api.GetUserHandler(c))
+	s.Equal(http.StatusNotModified, c.Response().Status)
+
+	c = getEchoContext(http.MethodPut, update, map[string]string{internal.HeaderIfMatch: `"1"`})
+	s.NoError(api.PutUserHandler(c))
+	s.Equal(http.StatusOK, c.Response().Status)
+	s.Equal(`"2"`, c.Response().Header().Get(internal.HeaderETag))
+
+	for _, ifMatch := range []string{`"1"`, `W/"2"`, "2"} {
+		c = getEchoContext(http.MethodPut, update, map[string]string{internal.HeaderIfMatch: ifMatch})
+		s.Error(serve(api.PutUserHandler, c))
+		s.Equal(http.StatusPreconditionFailed, c.Response().Status, ifMatch)
+	}
+
+	c = getEchoContext(http.MethodGet, nil, map[string]string{internal.HeaderIfNoneMatch: `"1"`})
+	s.NoError(api.GetUserHandler(c))
+	s.Equal(http.StatusOK, c.Response().Status, "the user changed since version 1")
+
+	// The repository checks the version again when writing, for updates racing
+	// past the check of the manager.
+	stale := repositories.NewSQLiteUserRepository(s.db).UpdateUser(context.Background(), "01FN3EEB2NVFJAHAPU00000001", update, 1)
+	s.Equal(internal.ErrVersionMismatch, stale)
+
+	c = getEchoContext(http.MethodDelete, nil, map[string]string{internal.HeaderIfMatch: `"1"`})
+	s.Error(serve(api.DeleteUserHandler, c))
+	s.Equal(http.StatusPreconditionFailed, c.Response().Status)
+
+	api.RequireIfMatch = true
+	c = getEchoContext(http.MethodDelete, nil, nil)
+	s.Error(serve(api.DeleteUserHandler, c))
+	s.Equal(http.StatusPreconditionRequired, c.Response().Status)
+
+	c = getEchoContext(http.MethodDelete, nil, map[string]string{internal.HeaderIfMatch: `"2"`})
+	s.NoError(api.DeleteUserHandler(c))
+	s.Equal(http.StatusNoContent, c.Response().Status)
+}
+
+func (s *UserAPITestSuite) TestUnitOfWork() {
+	users := repositories.NewSQLiteUserRepository(s.db)
+	id := "01FN3EEB2NVFJAHAPU00000001"
+	renamed := &models.User{Name: PointerString("renamed"), Mail: "firstuser@mail.com", Password: "-"}
+	count := func(table string) (count int) {
+		s.Require().NoError(s.db.Conn.Get(&count, "SELECT COUNT(*) FROM "+table))
+		return count
+	}
+
+	err := users.InTx(context.Background(), func(tx repositories.UnitOfWork) error {
+		s.Require().NoError(tx.Users().UpdateUser(context.Background(), id, renamed, 0))
+		user, err := tx.Users().GetUser(context.Background(), id)
+		s.Require().NoError(err)
+		s.Equal("renamed", *user.Name, "the unit of work sees its own changes")
+		s.Require().NoError(tx.Audit().CreateAuditEvent(context.Background(), &models.AuditEvent{Event: models.AuditUserUpdated, UserId: id}))
+		return internal.ErrUserAlreadyExists
+	})
+	s.Equal(internal.ErrUserAlreadyExists, err)
+	user, err := users.GetUser(context.Background(), id)
+	s.Require().NoError(err)
+	s.Equal("firstuser", *user.Name, "a failed unit of work is rolled back")
+	s.Zero(count("outbox"))
+	s.Zero(count("audit_events"), "audit events are rolled back with the unit of work")
+
+	err = users.InTx(context.Background(), func(tx repositories.UnitOfWork) error {
+		s.Equal(internal.ErrVersionMismatch, tx.Users().UpdateUser(context.Background(), id, renamed, 99))
+		if err := tx.Users().UpdateUser(context.Background(), id, renamed, 0); err != nil {
+			return err
+		}
+		return tx.Audit().CreateAuditEvent(context.Background(), &models.AuditEvent{Event: models.AuditUserUpdated, UserId: id})
+	})
+	s.NoError(err, "a failed step is undone without aborting the unit of work")
+	user, err = users.GetUser(context.Background(), id)
+	s.Require().NoError(err)
+	s.Equal("renamed", *user.Name)
+	s.Equal(2, user.Version)
+	s.Equal(1, count("outbox"))
+	s.Equal(1, count("audit_events"))
+}
+
+func (s *UserAPITestSuite) TestConcurrentCreateUser() {
+	manager := managers.NewUserManager(*s.db)
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := manager.CreateUser(context.Background(), models.Actor{}, models.User{Mail: "concurrent@mail.com", Password: "MyPassword.123"})
+			errs <- err
+		}()
+	}
+	created := 0
+	for i := 0; i < cap(errs); i++ {
+		switch err := <-errs; err {
+		case nil:
+			created++
+		default:
+			s.Equal(internal.ErrUserAlreadyExists, err)
+		}
+	}
+	s.Equal(1, created)
+}
+
 func PointerString(v string) *string { return &v }
+
+// serve runs handler as the server does, answering the error it returns.
+func serve(handler echo.HandlerFunc, c echo.Context) error {
+	err := handler(c)
+	if err != nil {
+		internal.HTTPErrorHandler(err, c)
+	}
+	return err
+}
+
+func (s *UserAPITestSuite) TestRequestContext() {
+	api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, internal.RouteUserID, nil).WithContext(ctx)
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetParamNames(internal.ParamUserID)
+	c.SetParamValues("01FN3EEB2NVFJAHAPU00000001")
+	s.Error(serve(api.GetUserHandler, c), "a cancelled request does not query the database")
+	s.Equal(http.StatusInternalServerError, c.Response().Status)
+
+	db := *s.db
+	db.Timeout = time.Nanosecond
+	_, err := repositories.NewSQLiteUserRepository(&db).GetUser(context.Background(), "01FN3EEB2NVFJAHAPU00000001")
+	s.Equal(internal.ErrSomethingWentWrong, err, "database calls are bounded by the timeout")
+}
+
+func (s *UserAPITestSuite) TestTracing() {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+	_, err := tracing.Setup(context.Background(), "", "amc-users")
+	s.Require().NoError(err)
+
+	api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+	e := echo.New()
+	e.Use(tracing.Middleware())
+	e.GET(internal.RouteUserID, api.GetUserHandler)
+	req := httptest.NewRequest(http.MethodGet, "/user/01FN3EEB2NVFJAHAPU00000001", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	s.Require().Equal(http.StatusOK, rec.Code)
+
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		s.Equal("4bf92f3577b34da6a3ce929d0e0e4736", span.SpanContext().TraceID().String(), span.Name())
+		spans[span.Name()] = span
+	}
+	s.Require().Len(spans, 3)
+	request, manager, statement := spans["GET /user/:id"], spans["UserManager.GetUser"], spans["SELECT"]
+	s.Require().NotNil(request)
+	s.Require().NotNil(manager)
+	s.Require().NotNil(statement)
+	s.Equal("00f067aa0ba902b7", request.Parent().SpanID().String(), "continues the trace of the caller")
+	s.Equal(request.SpanContext().SpanID(), manager.Parent().SpanID())
+	s.Equal(manager.SpanContext().SpanID(), statement.Parent().SpanID())
+	s.Contains(statement.Attributes(), attribute.String("db.statement", "SELECT * FROM users WHERE id = ?"))
+}
+
+func (s *UserAPITestSuite) TestRequestLogging() {
+	out := &bytes.Buffer{}
+	api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+	e := echo.New()
+	e.HTTPErrorHandler = internal.HTTPErrorHandler
+	e.Use(logging.Middleware(logging.New(out, slog.LevelInfo)))
+	e.GET(internal.RouteUserID, func(c echo.Context) error {
+		// Cancelled before reaching the database, so the repository fails.
+		ctx, cancel := context.WithCancel(c.Request().Context())
+		cancel()
+		c.SetRequest(c.Request().WithContext(ctx))
+		return api.GetUserHandler(c)
+	})
+	req := httptest.NewRequest(http.MethodGet, "/user/01FN3EEB2NVFJAHAPU00000001", nil)
+	req.Header.Set(echo.HeaderXRequestID, "req-42")
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	s.Equal(http.StatusInternalServerError, rec.Code)
+
+	var repositoryError map[string]interface{}
+	for _, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+		record := map[string]interface{}{}
+		s.Require().NoError(jsoniter.Unmarshal(line, &record))
+		s.Equal("req-42", record["requestId"], "every line is correlated to the request")
+		if record["repository"] != nil {
+			repositoryError = record
+		}
+	}
+	s.Require().NotNil(repositoryError)
+	s.Equal("users", repositoryError["repository"])
+	s.Equal("GetUser", repositoryError["method"])
+	s.Equal("ERROR", repositoryError["level"])
+}
+
+func (s *UserAPITestSuite) TestErrorHandledOnce() {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(previous)
+	_, err := tracing.Setup(context.Background(), "", "amc-users")
+	s.Require().NoError(err)
+
+	handled := 0
+	api := UserAPI{DB: *s.db, Manager: managers.NewUserManager(*s.db)}
+	e := echo.New()
+	e.HTTPErrorHandler = func(err error, c echo.Context) {
+		handled++
+		internal.HTTPErrorHandler(err, c)
+	}
+	e.Use(logging.Middleware(logging.New(&bytes.Buffer{}, slog.LevelInfo)))
+	e.Use(tracing.Middleware())
+	e.Use(metrics.Middleware())
+	e.GET(internal.RouteUserID, api.GetUserHandler)
+	notFound := metrics.Requests.WithLabelValues(internal.RouteUserID, http.MethodGet, "404")
+	before := testutil.ToFloat64(notFound)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/user/01FN3EEB2NVFJAHAPU00000099", nil))
+	s.Equal(http.StatusNotFound, rec.Code)
+	s.Equal(1, handled, "only the outermost middleware answers the error")
+	s.Equal(before+1, testutil.ToFloat64(notFound), "metrics record the status of the error")
+	var request sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		if span.Name() == "GET "+internal.RouteUserID {
+			request = span
+		}
+	}
+	s.Require().NotNil(request)
+	s.Contains(request.Attributes(), semconv.HTTPStatusCode(http.StatusNotFound), "the span records the status of the error")
+}
@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"users/internal"
+	"users/internal/managers"
+	"users/internal/models"
+	"users/pkg/database"
+	"users/pkg/url"
+)
+
+type WebhookAPI struct {
+	DB      database.Database
+	Manager managers.IWebhookManager
+}
+
+type deliveriesQuery struct {
+	Limit  int `query:"limit"`
+	Offset int `query:"offset"`
+}
+
+// PostWebhookHandler endpoint to register a new webhook subscription
+func (a *WebhookAPI) PostWebhookHandler(c echo.Context) error {
+	webhookReq := &models.WebhookRequest{}
+	if err := c.Bind(webhookReq); err != nil {
+		return internal.BindError(err)
+	}
+
+	webhook, err := a.Manager.CreateWebhook(c.Request().Context(), *webhookReq)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusCreated, webhook)
+}
+
+// GetWebhooksHandler endpoint to list the webhook subscriptions
+func (a *WebhookAPI) GetWebhooksHandler(c echo.Context) error {
+	webhooks, err := a.Manager.GetWebhooks(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+// GetWebhookHandler endpoint to get a webhook subscription
+func (a *WebhookAPI) GetWebhookHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamWebhookID: {Target: &ID, Err: internal.ErrWebhookIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	webhook, err := a.Manager.GetWebhook(c.Request().Context(), ID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, webhook)
+}
+
+// PutWebhookHandler endpoint to update or re-enable a webhook subscription
+func (a *WebhookAPI) PutWebhookHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamWebhookID: {Target: &ID, Err: internal.ErrWebhookIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	webhookReq := &models.WebhookRequest{}
+	if err := c.Bind(webhookReq); err != nil {
+		return internal.BindError(err)
+	}
+
+	webhook, err := a.Manager.UpdateWebhook(c.Request().Context(), ID, *webhookReq)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, webhook)
+}
+
+// DeleteWebhookHandler endpoint to remove a webhook subscription
+func (a *WebhookAPI) DeleteWebhookHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamWebhookID: {Target: &ID, Err: internal.ErrWebhookIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	if err := a.Manager.DeleteWebhook(c.Request().Context(), ID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetDeliveriesHandler endpoint to list the deliveries of a webhook
+func (a *WebhookAPI) GetDeliveriesHandler(c echo.Context) error {
+	var ID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamWebhookID: {Target: &ID, Err: internal.ErrWebhookIDNotPresent},
+	}); err != nil {
+		return err
+	}
+
+	query := deliveriesQuery{}
+	if err := (&echo.DefaultBinder{}).BindQueryParams(c, &query); err != nil {
+		return internal.ErrWrongQuery
+	}
+
+	deliveries, err := a.Manager.GetDeliveries(c.Request().Context(), ID, query.Limit, query.Offset)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, deliveries)
+}
+
+// RedeliverHandler endpoint to queue a delivery again
+func (a *WebhookAPI) RedeliverHandler(c echo.Context) error {
+	var ID, deliveryID string
+	if err := url.ParseURLPath(c, url.PathMap{
+		internal.ParamWebhookID:  {Target: &ID, Err: internal.ErrWebhookIDNotPresent},
+		internal.ParamDeliveryID: {Target: &deliveryID, Err: internal.ErrDeliveryNotFound},
+	}); err != nil {
+		return err
+	}
+
+	delivery, err := a.Manager.Redeliver(c.Request().Context(), ID, deliveryID)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusAccepted, delivery)
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"bytes"
+	"github.com/json-iterator/go"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/suite"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"users/internal"
+	"users/internal/config"
+	"users/internal/managers"
+	"users/internal/models"
+	"users/pkg/database"
+)
+
+type WebhookAPITestSuite struct {
+	suite.Suite
+	db *database.Database
+}
+
+func TestWebhookAPITestSuite(t *testing.T) {
+	suite.Run(t, new(WebhookAPITestSuite))
+}
+
+func (s *WebhookAPITestSuite) SetupTest() {
+	_ = database.RemoveDB(databaseTest)
+	s.db = database.InitDB(databaseTest)
+	s.db.Conn.Exec("INSERT INTO webhooks(id,url,events,secret,active,created_at) VALUES (?,?,?,?,?,?)",
+		"01FN3EEB2NVFJAHAPW00000001", "https://meals.local/hooks", "user.deleted", "0123456789abcdef", 1, "2023-05-01T10:00:00.000000Z")
+	s.db.Conn.Exec("INSERT INTO webhook_deliveries(id,webhook_id,event_id,event_type,payload,created_at,next_attempt_at) VALUES (?,?,?,?,?,?,?)",
+		"01FN3EEB2NVFJAHAPD00000001", "01FN3EEB2NVFJAHAPW00000001", "01FN3EEB2NVFJAHAPE00000001", "user.deleted", "{}", "2023-05-01T10:00:00.000000Z", "2023-05-01T10:00:00.000000Z")
+}
+
+func (s *WebhookAPITestSuite) TearDownTest() {
+	s.db = nil
+	_ = database.RemoveDB(databaseTest)
+}
+
+func (s *WebhookAPITestSuite) TestPostWebhookHandler() {
+	tests := []struct {
+		name               string
+		reqBody            interface{}
+		expectedResp       interface{}
+		expectedStatusCode int
+		wantErr            bool
+	}{
+		{
+			name: "[001] Create webhook (ok)",
+			reqBody: &models.WebhookRequest{
+				URL:    "https://calendar.local/hooks",
+				Events: []string{"user.deleted", "user.updated"},
+			},
+			expectedResp: &models.Webhook{
+				URL:    "https://calendar.local/hooks",
+				Events: []string{"user.deleted", "user.updated"},
+				Active: true,
+			},
+			expectedStatusCode: http.StatusCreated,
+			wantErr:            false,
+		},
+		{
+			name: "[002] Unknown event (400)",
+			reqBody: &models.WebhookRequest{
+				URL:    "https://calendar.local/hooks",
+				Events: []string{"meal.created"},
+			},
+			expectedResp: internal.ErrWrongBody.WithFields(internal.FieldError{
+				Field:   "events[0]",
+				Rule:    "oneof",
+				Param:   "* user.created user.updated user.deleted user.anonymized",
+				Message: "debe ser uno de: * user.created user.updated user.deleted user.anonymized",
+			}),
+			expectedStatusCode: http.StatusBadRequest,
+			wantErr:            true,
+		},
+		{
+			name: "[003] Wrong url (400)",
+			reqBody: &models.WebhookRequest{
+				URL:    "calendar",
+				Events: []string{"*"},
+			},
+			expectedResp: internal.ErrWrongBody.WithFields(internal.FieldError{
+				Field:   "url",
+				Rule:    "url",
+				Message: "no es una URL válida",
+			}),
+			expectedStatusCode: http.StatusBadRequest,
+			wantErr:            true,
+		},
+		{
+			name:    "[004] Wrong struct sent (400)",
+			reqBody: "invalid",
+			expectedResp: internal.ErrWrongBody.WithFields(internal.FieldError{
+				Rule:    "type",
+				Param:   "object",
+				Message: "debe ser de tipo object",
+			}),
+			expectedStatusCode: http.StatusBadRequest,
+			wantErr:            true,
+		},
+		{
+			name: "[005] Loopback url (400)",
+			reqBody: &models.WebhookRequest{
+				URL:    "http://127.0.0.1:3100/user",
+				Events: []string{"*"},
+			},
+			expectedResp:       internal.ErrWebhookURLPrivate,
+			expectedStatusCode: http.StatusBadRequest,
+			wantErr:            true,
+		},
+		{
+			name: "[006] Instance metadata url (400)",
+			reqBody: &models.WebhookRequest{
+				URL:    "http://169.254.169.254/latest/meta-data/",
+				Events: []string{"*"},
+			},
+			expectedResp:       internal.ErrWebhookURLPrivate,
+			expectedStatusCode: http.StatusBadRequest,
+			wantErr:            true,
+		},
+	}
+	getEchoContext := func(request interface{}) echo.Context {
+		body, err := jsoniter.Marshal(request)
+		s.NoError(err)
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, internal.RouteWebhooks, bytes.NewBuffer(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		return e.NewContext(req, rec)
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			api := WebhookAPI{DB: *s.db, Manager: managers.NewWebhookManager(*s.db)}
+
+			c := getEchoContext(t.reqBody)
+			err := serve(api.PostWebhookHandler, c)
+
+			resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
+			s.True(ok)
+			body := resp.Body.Bytes()
+			if t.wantErr {
+				s.Equal(t.wantErr, err != nil)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
+			} else {
+				actual := new(models.Webhook)
+				s.NoError(jsoniter.Unmarshal(body, actual))
+				s.NotEmpty(actual.Id)
+				s.Len(actual.Secret, 64, "a secret is generated and returned once")
+				actual.Id, actual.Secret, actual.CreatedAt = "", "", ""
+				s.Equal(actual, t.expectedResp)
+			}
+
+			s.Equal(t.expectedStatusCode, c.Response().Status)
+		})
+	}
+}
+
+func (s *WebhookAPITestSuite) TestRedeliverHandler() {
+	tests := []struct {
+		name               string
+		webhookID          string
+		deliveryID         string
+		expectedResp       interface{}
+		expectedStatusCode int
+		wantErr            bool
+	}{
+		{
+			name:               "[001] Redeliver (ok)",
+			webhookID:          "01FN3EEB2NVFJAHAPW00000001",
+			deliveryID:         "01FN3EEB2NVFJAHAPD00000001",
+			expectedStatusCode: http.StatusAccepted,
+			wantErr:            false,
+		},
+		{
+			name:               "[002] Webhook does not exist (404)",
+			webhookID:          "01FN3EEB2NVFJAHAPW00000099",
+			deliveryID:         "01FN3EEB2NVFJAHAPD00000001",
+			expectedResp:       internal.ErrWebhookNotFound,
+			expectedStatusCode: http.StatusNotFound,
+			wantErr:            true,
+		},
+		{
+			name:               "[003] Delivery does not exist (404)",
+			webhookID:          "01FN3EEB2NVFJAHAPW00000001",
+			deliveryID:         "01FN3EEB2NVFJAHAPD00000099",
+			expectedResp:       internal.ErrDeliveryNotFound,
+			expectedStatusCode: http.StatusNotFound,
+			wantErr:            true,
+		},
+	}
+	getEchoContext := func(webhookID, deliveryID string) echo.Context {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodPost, internal.RouteWebhookRedeliver, nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames(internal.ParamWebhookID, internal.ParamDeliveryID)
+		c.SetParamValues(webhookID, deliveryID)
+		return c
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			api := WebhookAPI{DB: *s.db, Manager: managers.NewWebhookManager(*s.db)}
+
+			c := getEchoContext(t.webhookID, t.deliveryID)
+			err := serve(api.RedeliverHandler, c)
+
+			resp, ok := c.Response().Writer.(*httptest.ResponseRecorder)
+			s.True(ok)
+			body := resp.Body.Bytes()
+			if t.wantErr {
+				s.Equal(t.wantErr, err != nil)
+				s.Equal(internal.MIMEProblemJSON, resp.Header().Get(echo.HeaderContentType))
+				problem := new(internal.Problem)
+				s.NoError(jsoniter.Unmarshal(body, problem))
+				s.Equal(internal.NewProblem(t.expectedResp.(error), c.Request().URL.Path, internal.DefaultLanguage), problem)
+			} else {
+				delivery := new(models.WebhookDelivery)
+				s.NoError(jsoniter.Unmarshal(body, delivery))
+				s.Equal(t.deliveryID, delivery.RedeliveryOf)
+				s.Equal(models.DeliveryPending, delivery.Status)
+			}
+
+			s.Equal(t.expectedStatusCode, c.Response().Status)
+		})
+	}
+}
+
+func (s *WebhookAPITestSuite) TestWebhookAuthorization() {
+	config.Config.AdminUsers = "01FN3EEB2NVFJAHAPU00000009"
+	defer func() { config.Config.AdminUsers = "" }()
+
+	tests := []struct {
+		name               string
+		actor              string
+		expectedResp       error
+		expectedStatusCode int
+	}{
+		{
+			name:               "[001] Admin lists webhooks (ok)",
+			actor:              "01FN3EEB2NVFJAHAPU00000009",
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "[002] User lists webhooks (403)",
+			actor:              "01FN3EEB2NVFJAHAPU00000001",
+			expectedResp:       internal.ErrForbidden,
+			expectedStatusCode: http.StatusForbidden,
+		},
+		{
+			name:               "[003] Anonymous lists webhooks (401)",
+			expectedResp:       internal.ErrUnauthenticated,
+			expectedStatusCode: http.StatusUnauthorized,
+		},
+	}
+	for _, t := range tests {
+		s.Run(t.name, func() {
+			api := WebhookAPI{DB: *s.db, Manager: managers.NewWebhookManager(*s.db)}
+
+			e := echo.New()
+			req := httptest.NewRequest(http.MethodGet, internal.RouteWebhooks, nil)
+			if t.actor != "" {
+				req.Header.Set(internal.HeaderActorID, t.actor)
+			}
+			rec := httptest.NewRecorder()
+			err := serve(RequireAdmin(api.GetWebhooksHandler), e.NewContext(req, rec))
+
+			s.Equal(t.expectedStatusCode, rec.Code)
+			if t.expectedResp != nil {
+				s.ErrorIs(err, t.expectedResp)
+			} else {
+				s.NoError(err)
+			}
+		})
+	}
+}
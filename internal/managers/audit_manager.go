@@ -0,0 +1,264 @@
+package managers
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"time"
+	"users/internal"
+	"users/internal/config"
+	"users/internal/models"
+	"users/internal/repositories"
+	"users/pkg/checkpoint"
+	"users/pkg/database"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 200
+	auditChainBatch   = 500
+)
+
+type IAuditManager interface {
+	GetAuditEvents(ctx context.Context, filter models.AuditFilter) (*models.AuditPage, error)
+	VerifyAuditChain(ctx context.Context) (*models.AuditVerification, error)
+	WriteAuditCheckpoint(ctx context.Context) (*checkpoint.Checkpoint, error)
+}
+
+type AuditManager struct {
+	db             *repositories.SQLiteAuditRepository
+	checkpointFile string
+	checkpointKey  string
+	// checkpointPublicKey verifies checkpoints, so verifying needs no access
+	// to checkpointKey.
+	checkpointPublicKey string
+	lastCheckpoint      int64
+}
+
+func NewAuditManager(db database.Database) *AuditManager {
+	return &AuditManager{
+		db:                  repositories.NewSQLiteAuditRepository(&db),
+		checkpointFile:      config.Config.AuditCheckpointFile,
+		checkpointKey:       config.Config.AuditCheckpointKey,
+		checkpointPublicKey: config.Config.AuditCheckpointPublicKey,
+	}
+}
+
+func (a *AuditManager) GetAuditEvents(ctx context.Context, filter models.AuditFilter) (*models.AuditPage, error) {
+	var err error
+	if filter.Limit < 0 || filter.Offset < 0 {
+		return nil, internal.ErrWrongQuery
+	}
+	if filter.Limit == 0 {
+		filter.Limit = defaultAuditLimit
+	}
+	if filter.Limit > maxAuditLimit {
+		filter.Limit = maxAuditLimit
+	}
+	if filter.From, err = normalizeTimestamp(filter.From); err != nil {
+		return nil, internal.ErrWrongQuery
+	}
+	if filter.To, err = normalizeTimestamp(filter.To); err != nil {
+		return nil, internal.ErrWrongQuery
+	}
+
+	events, total, err := a.db.GetAuditEvents(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return &models.AuditPage{Events: events, Total: total, Limit: filter.Limit, Offset: filter.Offset}, nil
+}
+
+// normalizeTimestamp converts an RFC 3339 query value to the stored layout.
+func normalizeTimestamp(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(models.TimestampLayout), nil
+}
+
+// VerifyAuditChain walks the whole audit chain and stops at the first event
+// whose link or content hash does not match. Redacted events are counted: their
+// details must match the hash recorded for them by the user.anonymized event
+// that redacted them, later in the chain. Events recorded before details were
+// hashed apart can't be redacted. When the checkpoint file and public key are
+// configured the signatures of the checkpoints are checked and the chain must
+// still contain every checkpointed head. Without the public key the
+// checkpoints are not checked and are counted as unverified.
+func (a *AuditManager) VerifyAuditChain(ctx context.Context) (*models.AuditVerification, error) {
+	result := &models.AuditVerification{}
+	checkpoints, err := a.readCheckpoints()
+	if err != nil {
+		return nil, err
+	}
+	if a.checkpointPublicKey == "" {
+		if len(checkpoints) > 0 {
+			slog.Warn("Audit checkpoints not verified, AUDIT_CHECKPOINT_PUBLIC_KEY is not set", "checkpoints", len(checkpoints))
+		}
+		result.UnverifiedCheckpoints = len(checkpoints)
+		checkpoints = nil
+	}
+	result.Checkpoints = len(checkpoints)
+	pinned := map[int64]checkpoint.Checkpoint{}
+	for _, cp := range checkpoints {
+		pinned[cp.Seq] = cp
+	}
+
+	broken := func(event models.AuditEvent, seq int64, reason string) (*models.AuditVerification, error) {
+		result.BrokenSeq = seq
+		result.BrokenId = event.Id
+		result.Reason = reason
+		return result, nil
+	}
+
+	// redacted holds the redacted events not yet vouched for by the event that
+	// redacted them.
+	redacted := map[string]models.AuditEvent{}
+	prevHash, next := "", int64(1)
+	for {
+		events, err := a.db.GetAuditChain(ctx, next-1, auditChainBatch)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range events {
+			switch {
+			case event.Seq != next:
+				return broken(event, next, fmt.Sprintf("missing event, found sequence %d", event.Seq))
+			case event.Hash == "":
+				return broken(event, event.Seq, "event is not sealed")
+			case event.PrevHash != prevHash:
+				return broken(event, event.Seq, "previous hash does not match")
+			case event.Redacted && event.DetailsHash == "":
+				return broken(event, event.Seq, "event recorded before details were hashed apart is redacted")
+			case repositories.AuditEventHash(&event) != event.Hash:
+				return broken(event, event.Seq, "content hash does not match")
+			case !event.Redacted && event.DetailsHash != "" && repositories.AuditDetailsHash(event.Details) != event.DetailsHash:
+				return broken(event, event.Seq, "details hash does not match")
+			}
+			if event.Redacted {
+				redacted[event.Id] = event
+				result.Redacted++
+			}
+			if event.Event == models.AuditUserAnonymized {
+				if reason := vouchRedactions(event, redacted); reason != "" {
+					return broken(event, event.Seq, reason)
+				}
+			}
+			if cp, ok := pinned[event.Seq]; ok && cp.Hash != event.Hash {
+				return broken(event, event.Seq, "hash differs from signed checkpoint")
+			}
+			prevHash = event.Hash
+			next++
+			result.Checked++
+		}
+		if len(events) < auditChainBatch {
+			break
+		}
+	}
+
+	var unvouched *models.AuditEvent
+	for _, event := range redacted {
+		if unvouched == nil || event.Seq < unvouched.Seq {
+			event := event
+			unvouched = &event
+		}
+	}
+	if unvouched != nil {
+		return broken(*unvouched, unvouched.Seq, "redaction is not recorded in the chain")
+	}
+	for _, cp := range checkpoints {
+		if cp.Seq >= next {
+			return broken(models.AuditEvent{}, cp.Seq, "chain is shorter than signed checkpoint")
+		}
+	}
+	result.Valid = true
+	return result, nil
+}
+
+// vouchRedactions checks the redacted details of the events the user.anonymized
+// event redacted against the hashes it records, and removes them from
+// redacted. It returns why they don't match, or "" if they do.
+func vouchRedactions(event models.AuditEvent, redacted map[string]models.AuditEvent) string {
+	var details struct {
+		RedactedEvents map[string]string `json:"redactedEvents"`
+	}
+	if err := event.Details.Unmarshal(&details); err != nil {
+		return "details are not valid JSON"
+	}
+	for id, hash := range details.RedactedEvents {
+		if redactedEvent, ok := redacted[id]; ok && repositories.AuditDetailsHash(redactedEvent.Details) != hash {
+			return fmt.Sprintf("redacted details of sequence %d do not match", redactedEvent.Seq)
+		}
+		delete(redacted, id)
+	}
+	return ""
+}
+
+// readCheckpoints reads the checkpoint file, if any, and checks the signature
+// of every checkpoint when the public key is configured.
+func (a *AuditManager) readCheckpoints() ([]checkpoint.Checkpoint, error) {
+	if a.checkpointFile == "" {
+		return nil, nil
+	}
+	checkpoints, err := checkpoint.ReadAll(a.checkpointFile)
+	if err != nil || a.checkpointPublicKey == "" {
+		return checkpoints, err
+	}
+	key, err := checkpoint.ParsePublicKey(a.checkpointPublicKey)
+	if err != nil {
+		return nil, err
+	}
+	for _, cp := range checkpoints {
+		if err = cp.Verify(key); err != nil {
+			return nil, fmt.Errorf("checkpoint at sequence %d: %w", cp.Seq, err)
+		}
+	}
+	return checkpoints, nil
+}
+
+// WriteAuditCheckpoint signs the current head of the chain and appends it to
+// the checkpoint file. Nothing is written if the head has not moved.
+func (a *AuditManager) WriteAuditCheckpoint(ctx context.Context) (*checkpoint.Checkpoint, error) {
+	key, err := checkpoint.ParseKey(a.checkpointKey)
+	if err != nil {
+		return nil, err
+	}
+	head, err := a.db.GetAuditChainHead(ctx)
+	if err != nil || head == nil || head.Hash == "" || head.Seq == a.lastCheckpoint {
+		return nil, err
+	}
+
+	cp := checkpoint.Checkpoint{
+		Seq:       head.Seq,
+		Hash:      head.Hash,
+		CreatedAt: time.Now().UTC().Format(models.TimestampLayout),
+	}
+	cp.Sign(key)
+	if err = checkpoint.Append(a.checkpointFile, cp); err != nil {
+		return nil, err
+	}
+	a.lastCheckpoint = head.Seq
+	return &cp, nil
+}
+
+// RunAuditCheckpoints writes a checkpoint every interval until ctx is done.
+func (a *AuditManager) RunAuditCheckpoints(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if cp, err := a.WriteAuditCheckpoint(ctx); err != nil {
+				slog.Error("Error writing audit checkpoint", "error", err)
+			} else if cp != nil {
+				slog.Info("Audit checkpoint written", "seq", cp.Seq)
+			}
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package managers
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/stretchr/testify/suite"
+	"path/filepath"
+	"testing"
+	"users/internal/config"
+	"users/internal/models"
+	"users/internal/repositories"
+	"users/pkg/checkpoint"
+	"users/pkg/database"
+)
+
+var auditDatabaseTest = "/amc_audit_test.db"
+
+type AuditChainTestSuite struct {
+	suite.Suite
+	db      *database.Database
+	manager *AuditManager
+}
+
+func TestAuditChainTestSuite(t *testing.T) {
+	suite.Run(t, new(AuditChainTestSuite))
+}
+
+func (s *AuditChainTestSuite) SetupTest() {
+	_ = database.RemoveDB(auditDatabaseTest)
+	s.db = database.InitDB(auditDatabaseTest)
+
+	seed := make([]byte, ed25519.SeedSize)
+	s.manager = NewAuditManager(*s.db)
+	s.manager.checkpointFile = filepath.Join(s.T().TempDir(), "checkpoints.jsonl")
+	s.manager.checkpointKey = base64.StdEncoding.EncodeToString(seed)
+	s.manager.checkpointPublicKey = checkpoint.EncodePublicKey(ed25519.NewKeyFromSeed(seed))
+
+	userManager := NewUserManager(*s.db)
+	actor := models.Actor{IP: "192.0.2.1"}
+	user, err := userManager.CreateUser(context.Background(), actor, models.User{Mail: "chain@mail.com", Password: "MyPassword.123"})
+	s.Require().NoError(err)
+	_, _ = userManager.Login(context.Background(), actor, models.User{Mail: "chain@mail.com", Password: "MyPassword.123"})
+	_, _ = userManager.Login(context.Background(), actor, models.User{Mail: "chain@mail.com", Password: "Wrong.123"})
+	s.Require().NoError(userManager.DeleteUser(context.Background(), actor, user.Id, 0))
+}
+
+func (s *AuditChainTestSuite) TearDownTest() {
+	s.db = nil
+	_ = database.RemoveDB(auditDatabaseTest)
+}
+
+func (s *AuditChainTestSuite) TestVerifyIntactChain() {
+	result, err := s.manager.VerifyAuditChain(context.Background())
+	s.NoError(err)
+	s.Equal(&models.AuditVerification{Valid: true, Checked: 4}, result)
+}
+
+func (s *AuditChainTestSuite) TestVerifyTamperedContent() {
+	_, err := s.db.Conn.Exec("UPDATE audit_events SET ip = '203.0.113.9' WHERE seq = 2")
+	s.NoError(err)
+
+	result, err := s.manager.VerifyAuditChain(context.Background())
+	s.NoError(err)
+	s.False(result.Valid)
+	s.Equal(int64(2), result.BrokenSeq)
+	s.Equal("content hash does not match", result.Reason)
+}
+
+func (s *AuditChainTestSuite) TestVerifyDeletedEvent() {
+	_, err := s.db.Conn.Exec("DELETE FROM audit_events WHERE seq = 3")
+	s.NoError(err)
+
+	result, err := s.manager.VerifyAuditChain(context.Background())
+	s.NoError(err)
+	s.False(result.Valid)
+	s.Equal(int64(3), result.BrokenSeq)
+}
+
+func (s *AuditChainTestSuite) TestCheckpoints() {
+	cp, err := s.manager.WriteAuditCheckpoint(context.Background())
+	s.NoError(err)
+	s.Equal(int64(4), cp.Seq)
+
+	cp, err = s.manager.WriteAuditCheckpoint(context.Background())
+	s.NoError(err)
+	s.Nil(cp, "no checkpoint is written while the head does not move")
+
+	checkpoints, err := checkpoint.ReadAll(s.manager.checkpointFile)
+	s.NoError(err)
+	s.Len(checkpoints, 1)
+
+	result, err := s.manager.VerifyAuditChain(context.Background())
+	s.NoError(err)
+	s.True(result.Valid)
+	s.Equal(1, result.Checkpoints)
+
+	// Dropping the tail keeps the remaining links valid, only the checkpoint
+	// reveals it.
+	_, err = s.db.Conn.Exec("DELETE FROM audit_events WHERE seq = 4")
+	s.NoError(err)
+	result, err = s.manager.VerifyAuditChain(context.Background())
+	s.NoError(err)
+	s.False(result.Valid)
+	s.Equal(int64(4), result.BrokenSeq)
+	s.Equal("chain is shorter than signed checkpoint", result.Reason)
+}
+
+func (s *AuditChainTestSuite) TestForgedCheckpoint() {
+	forged := checkpoint.Checkpoint{Seq: 4, Hash: "forged", CreatedAt: "2023-01-01T00:00:00.000000Z"}
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	forged.Sign(otherKey)
+	s.NoError(checkpoint.Append(s.manager.checkpointFile, forged))
+
+	_, err := s.manager.VerifyAuditChain(context.Background())
+	s.ErrorIs(err, checkpoint.ErrInvalidSignature)
+}
+
+func (s *AuditChainTestSuite) TestVerifyWithPublicKeyOnly() {
+	_, err := s.manager.WriteAuditCheckpoint(context.Background())
+	s.NoError(err)
+
+	verifier := NewAuditManager(*s.db)
+	verifier.checkpointFile = s.manager.checkpointFile
+	verifier.checkpointPublicKey = s.manager.checkpointPublicKey
+	result, err := verifier.VerifyAuditChain(context.Background())
+	s.NoError(err)
+	s.True(result.Valid)
+	s.Equal(1, result.Checkpoints)
+
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+	verifier.checkpointPublicKey = checkpoint.EncodePublicKey(otherKey)
+	_, err = verifier.VerifyAuditChain(context.Background())
+	s.ErrorIs(err, checkpoint.ErrInvalidSignature)
+
+	verifier.checkpointPublicKey = "c2VjcmV0"
+	_, err = verifier.VerifyAuditChain(context.Background())
+	s.ErrorIs(err, checkpoint.ErrInvalidPublicKey)
+}
+
+func (s *AuditChainTestSuite) TestVerifyWithoutPublicKey() {
+	_, err := s.manager.WriteAuditCheckpoint(context.Background())
+	s.NoError(err)
+
+	verifier := NewAuditManager(*s.db)
+	verifier.checkpointFile = s.manager.checkpointFile
+	result, err := verifier.VerifyAuditChain(context.Background())
+	s.NoError(err)
+	s.Equal(&models.AuditVerification{Valid: true, Checked: 4, UnverifiedCheckpoints: 1}, result, "checkpoints are reported unverified")
+}
+
+func (s *AuditChainTestSuite) TestVerifyTamperedDetails() {
+	_, err := s.db.Conn.Exec("UPDATE audit_events SET details = '{}' WHERE seq = 3")
+	s.NoError(err)
+
+	result, err := s.manager.VerifyAuditChain(context.Background())
+	s.NoError(err)
+	s.False(result.Valid)
+	s.Equal(int64(3), result.BrokenSeq)
+	s.Equal("details hash does not match", result.Reason)
+}
+
+func (s *AuditChainTestSuite) TestAnonymizeRedactsMail() {
+	ctx := context.Background()
+	userManager := NewUserManager(*s.db)
+	user, err := userManager.CreateUser(ctx, models.Actor{}, models.User{Mail: "redacted@mail.com", Password: "MyPassword.123"})
+	s.Require().NoError(err)
+
+	// Events recorded with the mail in their details, the last one before
+	// details were hashed apart.
+	audit := repositories.NewSQLiteAuditRepository(s.db)
+	s.Require().NoError(audit.CreateAuditEvent(ctx, &models.AuditEvent{Event: models.AuditLoginFailure, Details: types.JSONText(`{"mail":"Redacted@mail.com"}`)}))
+	legacy := &models.AuditEvent{Event: models.AuditUserCreated, UserId: user.Id, Details: types.JSONText(`{"mail":"redacted@mail.com"}`)}
+	s.Require().NoError(audit.CreateAuditEvent(ctx, legacy))
+	legacy.DetailsHash = ""
+	_, err = s.db.Conn.Exec("UPDATE audit_events SET details_hash = '', hash = ? WHERE id = ?", repositories.AuditEventHash(legacy), legacy.Id)
+	s.Require().NoError(err)
+
+	webhooks := repositories.NewSQLiteWebhookRepository(s.db)
+	s.Require().NoError(webhooks.CreateDelivery(ctx, &models.WebhookDelivery{WebhookId: "hook", EventId: "event", EventType: models.EventUserCreated,
+		Payload: types.JSONText(`{"type":"user.created","aggregateId":"` + user.Id + `","data":{"id":"` + user.Id + `","mail":"redacted@mail.com"}}`)}))
+
+	_, err = userManager.AnonymizeUser(ctx, models.Actor{}, user.Id)
+	s.Require().NoError(err)
+
+	var leaks []string
+	s.NoError(s.db.Conn.Select(&leaks, `SELECT id FROM audit_events WHERE details LIKE '%redacted@mail.com%'
+		UNION ALL SELECT event_id FROM outbox WHERE payload LIKE '%redacted@mail.com%'
+		UNION ALL SELECT event_id FROM webhook_deliveries WHERE payload LIKE '%redacted@mail.com%'`))
+	s.Equal([]string{legacy.Id}, leaks, "events recorded before details were hashed apart can't be redacted")
+	var hashes []string
+	s.NoError(s.db.Conn.Select(&hashes, "SELECT json_extract(details, '$.mailHash') FROM audit_events WHERE redacted = 1"))
+	s.Equal([]string{mailHash("redacted@mail.com")}, hashes)
+
+	result, err := s.manager.VerifyAuditChain(ctx)
+	s.NoError(err)
+	s.True(result.Valid, result.Reason)
+	s.Equal(int64(1), result.Redacted)
+}
+
+func (s *AuditChainTestSuite) TestVerifyForgedRedaction() {
+	tests := []struct {
+		name   string
+		query  string
+		reason string
+	}{
+		{
+			name:   "[001] Redacted flag set (error)",
+			query:  "UPDATE audit_events SET redacted = 1 WHERE seq = 3",
+			reason: "redaction is not recorded in the chain",
+		},
+		{
+			name:   "[002] Details rewritten as redacted (error)",
+			query:  `UPDATE audit_events SET redacted = 1, details = '{"mailHash":"forged"}' WHERE seq = 3`,
+			reason: "redaction is not recorded in the chain",
+		},
+		{
+			name:   "[003] Event without details hash redacted (error)",
+			query:  "UPDATE audit_events SET redacted = 1, details_hash = '' WHERE seq = 3",
+			reason: "event recorded before details were hashed apart is redacted",
+		},
+	}
+	for _, tt := range tests {
+		s.Run(tt.name, func() {
+			s.SetupTest()
+			_, err := s.db.Conn.Exec(tt.query)
+			s.Require().NoError(err)
+
+			result, err := s.manager.VerifyAuditChain(context.Background())
+			s.NoError(err)
+			s.False(result.Valid)
+			s.Equal(int64(3), result.BrokenSeq)
+			s.Equal(tt.reason, result.Reason)
+		})
+	}
+}
+
+func (s *AuditChainTestSuite) TestVerifyRewrittenRedaction() {
+	ctx := context.Background()
+	userManager := NewUserManager(*s.db)
+	user, err := userManager.CreateUser(ctx, models.Actor{}, models.User{Mail: "rewritten@mail.com", Password: "MyPassword.123"})
+	s.Require().NoError(err)
+	audit := repositories.NewSQLiteAuditRepository(s.db)
+	s.Require().NoError(audit.CreateAuditEvent(ctx, &models.AuditEvent{Event: models.AuditLoginFailure, Details: types.JSONText(`{"mail":"rewritten@mail.com"}`)}))
+	_, err = userManager.AnonymizeUser(ctx, models.Actor{}, user.Id)
+	s.Require().NoError(err)
+
+	var seq int64
+	s.Require().NoError(s.db.Conn.Get(&seq, "SELECT seq FROM audit_events WHERE redacted = 1"))
+	_, err = s.db.Conn.Exec(`UPDATE audit_events SET details = '{"mailHash":"forged"}' WHERE seq = ?`, seq)
+	s.Require().NoError(err)
+
+	result, err := s.manager.VerifyAuditChain(ctx)
+	s.NoError(err)
+	s.False(result.Valid)
+	s.Equal(fmt.Sprintf("redacted details of sequence %d do not match", seq), result.Reason)
+}
+
+func (s *AuditChainTestSuite) TestMailHashIsKeyed() {
+	defer func(key string) { config.Config.MailHashKey = key }(config.Config.MailHashKey)
+
+	config.Config.MailHashKey = "first-key-of-at-least-32-characters"
+	first := mailHash("chain@mail.com")
+	s.Equal(first, mailHash(" Chain@Mail.com "))
+	config.Config.MailHashKey = "other-key-of-at-least-32-characters"
+	s.NotEqual(first, mailHash("chain@mail.com"))
+}
@@ -0,0 +1,169 @@
+package managers
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"users/internal"
+	"users/internal/config"
+	"users/internal/models"
+	"users/internal/repositories"
+	"users/pkg/database"
+	"users/pkg/imaging"
+	"users/pkg/logging"
+	"users/pkg/storage"
+)
+
+const (
+	avatarMaxSize     = 5 << 20
+	AvatarContentType = "image/jpeg"
+	// DefaultAvatarSize is served when no size is asked for.
+	DefaultAvatarSize = 256
+)
+
+// AvatarSizes are the thumbnails generated for every uploaded avatar.
+var AvatarSizes = []int{64, 256}
+
+// avatarTypes are the uploads accepted, as sniffed from their content.
+var avatarTypes = map[string]bool{"image/jpeg": true, "image/png": true, "image/gif": true, "image/webp": true}
+
+type IAvatarManager interface {
+	MaxSize() int64
+	UploadAvatar(ctx context.Context, actor models.Actor, id string, data []byte) (*models.User, error)
+	GetAvatar(ctx context.Context, id string, size int) ([]byte, error)
+}
+
+type AvatarManager struct {
+	db      *repositories.SQLiteUserRepository
+	audit   *repositories.SQLiteAuditRepository
+	store   storage.BlobStore
+	maxSize int64
+}
+
+func NewAvatarManager(db database.Database) *AvatarManager {
+	maxSize, err := strconv.ParseInt(config.Config.AvatarMaxSize, 10, 64)
+	if err != nil || maxSize <= 0 {
+		maxSize = avatarMaxSize
+	}
+	return &AvatarManager{
+		db:      repositories.NewSQLiteUserRepository(&db),
+		audit:   repositories.NewSQLiteAuditRepository(&db),
+		store:   avatarStore(),
+		maxSize: maxSize,
+	}
+}
+
+// avatarStore builds the configured blob store, falling back to the local one.
+func avatarStore() storage.BlobStore {
+	switch config.Config.AvatarStore {
+	case "s3":
+		return storage.NewS3Store(storage.S3Config{
+			Endpoint:  config.Config.AvatarS3Endpoint,
+			Bucket:    config.Config.AvatarS3Bucket,
+			Region:    config.Config.AvatarS3Region,
+			AccessKey: config.Config.AvatarS3AccessKey,
+			SecretKey: config.Config.AvatarS3SecretKey,
+		})
+	case "", "local":
+	default:
+		slog.Warn("Unknown avatar store, using local", "store", config.Config.AvatarStore)
+	}
+	dir := config.Config.AvatarDir
+	if dir == "" {
+		dir = "avatars"
+	}
+	return storage.NewLocalStore(dir)
+}
+
+func avatarKey(id string, size int) string {
+	return fmt.Sprintf("avatars/%s/%d.jpg", id, size)
+}
+
+// MaxSize is the largest upload accepted, in bytes.
+func (a *AvatarManager) MaxSize() int64 {
+	return a.maxSize
+}
+
+// UploadAvatar stores square thumbnails of the image and points the avatar url
+// of the user to them. The image is re-encoded, so its EXIF data is dropped.
+func (a *AvatarManager) UploadAvatar(ctx context.Context, actor models.Actor, id string, data []byte) (*models.User, error) {
+	if _, err := a.db.GetUser(ctx, id); err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > a.maxSize {
+		return nil, internal.ErrAvatarTooLarge
+	}
+	if !avatarTypes[http.DetectContentType(data)] {
+		return nil, internal.ErrAvatarType
+	}
+
+	thumbnails, err := imaging.Thumbnails(data, AvatarSizes...)
+	switch err {
+	case nil:
+	case imaging.ErrTooManyPixels:
+		return nil, internal.ErrAvatarTooLarge
+	case imaging.ErrUnsupportedFormat:
+		return nil, internal.ErrAvatarType
+	default:
+		logging.FromContext(ctx).Error("Error generating avatar thumbnails", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	for size, thumbnail := range thumbnails {
+		if err = a.store.Put(ctx, avatarKey(id, size), thumbnail, AvatarContentType); err != nil {
+			logging.FromContext(ctx).Error("Error storing avatar", "userId", id, "error", err)
+			return nil, internal.ErrSomethingWentWrong
+		}
+	}
+
+	err = a.db.InTx(ctx, func(tx repositories.UnitOfWork) error {
+		if err := tx.Users().SetAvatarURL(ctx, id, strings.Replace(internal.RouteUserAvatar, ":"+internal.ParamUserID, id, 1)); err != nil {
+			return err
+		}
+		return recordAuditInTx(ctx, tx, actor, models.AuditUserUpdated, id, map[string]interface{}{"fields": []string{"avatar"}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.db.GetUser(ctx, id)
+}
+
+// GetAvatar returns the thumbnail of the given size, one of AvatarSizes.
+func (a *AvatarManager) GetAvatar(ctx context.Context, id string, size int) ([]byte, error) {
+	if !validAvatarSize(size) {
+		return nil, internal.ErrWrongQuery
+	}
+	if _, err := a.db.GetUser(ctx, id); err != nil {
+		return nil, err
+	}
+	data, err := a.store.Get(ctx, avatarKey(id, size))
+	if err == storage.ErrNotFound {
+		return nil, internal.ErrAvatarNotFound
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Error reading avatar", "userId", id, "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return data, nil
+}
+
+// deleteAvatar removes the thumbnails of a user. Failures are logged, the
+// files left behind are no longer referenced by the user.
+func deleteAvatar(store storage.BlobStore, id string) {
+	for _, size := range AvatarSizes {
+		if err := store.Delete(context.Background(), avatarKey(id, size)); err != nil {
+			slog.Error("Error deleting avatar", "userId", id, "error", err)
+		}
+	}
+}
+
+func validAvatarSize(size int) bool {
+	for _, s := range AvatarSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,317 @@
+package managers
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/exp/slog"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"users/internal"
+	"users/internal/config"
+	"users/internal/models"
+	"users/internal/repositories"
+	"users/pkg/database"
+	"users/pkg/export"
+	"users/pkg/logging"
+)
+
+const (
+	exportAsyncThreshold = 1000
+	exportTTL            = 24 * time.Hour
+)
+
+// exportTables are the tables with data of the user included in an export,
+// besides the profile.
+var exportTables = []string{"meals", "calendar", "audit_events"}
+
+type IExportManager interface {
+	IsLargeExport(ctx context.Context, userID string) (bool, error)
+	WriteExport(ctx context.Context, actor models.Actor, userID string, withCSV bool, w io.Writer) error
+	CreateExportJob(ctx context.Context, actor models.Actor, userID string, withCSV bool) (*models.ExportJob, error)
+	GetExportJob(ctx context.Context, userID, id string) (*models.ExportJob, error)
+	OpenExport(ctx context.Context, userID, id string) (*os.File, error)
+}
+
+type ExportManager struct {
+	db        *repositories.SQLiteExportRepository
+	users     *repositories.SQLiteUserRepository
+	audit     *repositories.SQLiteAuditRepository
+	dir       string
+	threshold int
+	// ttl is how long a generated export is kept.
+	ttl time.Duration
+	// ctx is the context jobs run with, and jobs the ones running.
+	ctx  context.Context
+	jobs sync.WaitGroup
+}
+
+func NewExportManager(db database.Database) *ExportManager {
+	threshold, err := strconv.Atoi(config.Config.ExportAsyncThreshold)
+	if err != nil || threshold <= 0 {
+		threshold = exportAsyncThreshold
+	}
+	ttl, err := time.ParseDuration(config.Config.ExportTTL)
+	if err != nil || ttl <= 0 {
+		ttl = exportTTL
+	}
+	dir := config.Config.ExportDir
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "amc-users-exports")
+	}
+	return &ExportManager{
+		db:        repositories.NewSQLiteExportRepository(&db),
+		users:     repositories.NewSQLiteUserRepository(&db),
+		audit:     repositories.NewSQLiteAuditRepository(&db),
+		dir:       dir,
+		threshold: threshold,
+		ttl:       ttl,
+		ctx:       context.Background(),
+	}
+}
+
+// IsLargeExport tells whether the data of the user exceeds the threshold of
+// rows exported within the request.
+func (m *ExportManager) IsLargeExport(ctx context.Context, userID string) (bool, error) {
+	if _, err := m.users.GetUser(ctx, userID); err != nil {
+		return false, err
+	}
+	count, err := m.db.CountUserData(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	return count > m.threshold, nil
+}
+
+// WriteExport writes a ZIP with the profile and every table holding data of
+// the user. The password hash is left out of the profile.
+func (m *ExportManager) WriteExport(ctx context.Context, actor models.Actor, userID string, withCSV bool, w io.Writer) error {
+	files, err := m.collect(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err = export.WriteZip(w, files, withCSV); err != nil {
+		logging.FromContext(ctx).Error("Error writing export", "userId", userID, "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	recordAudit(m.audit, actor, models.AuditUserExported, userID, map[string]interface{}{"csv": withCSV, "async": false})
+	return nil
+}
+
+func (m *ExportManager) collect(ctx context.Context, userID string) ([]export.File, error) {
+	user, err := m.users.GetUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	profile := map[string]interface{}{
+		"id":                 user.Id,
+		"name":               user.Name,
+		"mail":               user.Mail,
+		"locale":             user.Locale,
+		"timezone":           user.Timezone,
+		"avatarUrl":          user.AvatarURL,
+		"dietaryPreferences": strings.Join(user.DietaryPreferences, ","),
+		"createdAt":          user.CreatedAt,
+		"updatedAt":          user.UpdatedAt,
+		"lastLoginAt":        user.LastLoginAt,
+	}
+	files := []export.File{{Name: "profile", Records: []map[string]interface{}{profile}}}
+	for _, table := range exportTables {
+		records, err := m.db.GetUserData(ctx, table, userID)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, export.File{Name: table, Records: records})
+	}
+	return files, nil
+}
+
+// CreateExportJob queues the export of a user and generates it in the
+// background. Its status is polled with GetExportJob.
+func (m *ExportManager) CreateExportJob(ctx context.Context, actor models.Actor, userID string, withCSV bool) (*models.ExportJob, error) {
+	if _, err := m.users.GetUser(ctx, userID); err != nil {
+		return nil, err
+	}
+	job := &models.ExportJob{UserId: userID, WithCSV: withCSV}
+	if err := m.db.CreateExportJob(ctx, job); err != nil {
+		return nil, err
+	}
+	// The job outlives the request that queued it.
+	queued := *job
+	m.startExportJob(actor, &queued)
+	return job, nil
+}
+
+func (m *ExportManager) GetExportJob(ctx context.Context, userID, id string) (*models.ExportJob, error) {
+	return m.db.GetExportJob(ctx, userID, id)
+}
+
+// OpenExport opens the file of a finished export job of the user.
+func (m *ExportManager) OpenExport(ctx context.Context, userID, id string) (*os.File, error) {
+	job, err := m.db.GetExportJob(ctx, userID, id)
+	if err != nil {
+		return nil, err
+	}
+	if job.UserId != userID || job.ExpiresAt != nil && *job.ExpiresAt <= timestamp(time.Now()) {
+		return nil, internal.ErrExportNotFound
+	}
+	if job.Status != models.ExportDone {
+		return nil, internal.ErrExportNotReady
+	}
+	file, err := os.Open(job.File)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error opening export", "exportId", id, "error", err)
+		return nil, internal.ErrExportNotFound
+	}
+	return file, nil
+}
+
+// ResumeExportJobs runs again the jobs left unfinished by a previous process.
+// They, and the jobs queued afterwards, are stopped when ctx is done and
+// resumed by the next process. It is called once, before jobs are queued.
+func (m *ExportManager) ResumeExportJobs(ctx context.Context) {
+	m.ctx = ctx
+	jobs, err := m.db.GetUnfinishedExportJobs(ctx)
+	if err != nil {
+		slog.Error("Error resuming export jobs", "error", err)
+		return
+	}
+	for i := range jobs {
+		m.startExportJob(models.Actor{}, &jobs[i])
+	}
+}
+
+// Wait blocks until the jobs running have finished or stopped.
+func (m *ExportManager) Wait() {
+	m.jobs.Wait()
+}
+
+func (m *ExportManager) startExportJob(actor models.Actor, job *models.ExportJob) {
+	m.jobs.Add(1)
+	go func() {
+		defer m.jobs.Done()
+		m.runExportJob(m.ctx, actor, job)
+	}()
+}
+
+func (m *ExportManager) runExportJob(ctx context.Context, actor models.Actor, job *models.ExportJob) {
+	job.Status = models.ExportRunning
+	if err := m.db.UpdateExportJob(ctx, job); err != nil {
+		return
+	}
+
+	job.File = filepath.Join(m.dir, job.Id+".zip")
+	if err := m.writeExportFile(ctx, job); err != nil && ctx.Err() != nil {
+		// Stopped: the job is left running to be resumed.
+		_ = os.Remove(job.File)
+		return
+	} else if err != nil {
+		slog.Error("Error generating export", "exportId", job.Id, "error", err)
+		_ = os.Remove(job.File)
+		job.Status, job.File, job.Error = models.ExportFailed, "", internal.ErrSomethingWentWrong.Error()
+	} else {
+		job.Status = models.ExportDone
+		recordAudit(m.audit, actor, models.AuditUserExported, job.UserId, map[string]interface{}{"csv": job.WithCSV, "async": true, "exportId": job.Id})
+	}
+	completed := time.Now()
+	completedAt, expiresAt := timestamp(completed), timestamp(completed.Add(m.ttl))
+	job.CompletedAt, job.ExpiresAt = &completedAt, &expiresAt
+	_ = m.db.UpdateExportJob(ctx, job)
+	// The exports of a user deleted meanwhile are gone, so is this file.
+	if _, err := m.db.GetExportJob(ctx, job.UserId, job.Id); errors.Is(err, internal.ErrExportNotFound) && job.File != "" {
+		removeExportFile(job.File)
+	}
+}
+
+func (m *ExportManager) writeExportFile(ctx context.Context, job *models.ExportJob) error {
+	files, err := m.collect(ctx, job.UserId)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(m.dir, 0o700); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(job.File, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err = export.WriteZip(out, files, job.WithCSV); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// CleanUpExports deletes the jobs expired and their files, returning how many.
+func (m *ExportManager) CleanUpExports(ctx context.Context) (int, error) {
+	jobs, err := m.db.GetExpiredExportJobs(ctx, timestamp(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+	for _, job := range jobs {
+		if job.File != "" {
+			removeExportFile(job.File)
+		}
+		if err = m.db.DeleteExportJob(ctx, job.Id); err != nil {
+			return 0, err
+		}
+	}
+	return len(jobs), nil
+}
+
+// RunExportCleanup deletes the expired exports every interval until ctx is
+// done.
+func (m *ExportManager) RunExportCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if deleted, err := m.CleanUpExports(ctx); err != nil {
+				slog.Error("Error cleaning up exports", "error", err)
+			} else if deleted > 0 {
+				slog.Info("Expired exports deleted", "count", deleted)
+			}
+		}
+	}
+}
+
+// deleteExportJobs deletes every export job of the user as part of the unit of
+// work deleting or anonymizing it. The jobs are returned so their files are
+// removed with removeExportFiles once the unit of work is committed.
+func deleteExportJobs(ctx context.Context, exports repositories.ExportRepository, userID string) ([]models.ExportJob, error) {
+	jobs, err := exports.GetUserExportJobs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if err = exports.DeleteExportJob(ctx, job.Id); err != nil {
+			return nil, err
+		}
+	}
+	return jobs, nil
+}
+
+func removeExportFiles(jobs []models.ExportJob) {
+	for _, job := range jobs {
+		if job.File != "" {
+			removeExportFile(job.File)
+		}
+	}
+}
+
+func removeExportFile(file string) {
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		slog.Error("Error deleting export file", "file", file, "error", err)
+	}
+}
+
+func timestamp(t time.Time) string {
+	return t.UTC().Format(models.TimestampLayout)
+}
@@ -0,0 +1,89 @@
+package managers
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"users/internal/config"
+	"users/internal/models"
+	"users/internal/repositories"
+	"users/pkg/database"
+)
+
+const healthMinFreeDisk = 100 << 20
+
+type IHealthManager interface {
+	CheckReadiness(ctx context.Context) models.Health
+}
+
+type HealthManager struct {
+	db          *repositories.SQLiteHealthRepository
+	dir         string
+	minFreeDisk uint64
+}
+
+func NewHealthManager(db database.Database) *HealthManager {
+	minFreeDisk, err := strconv.ParseUint(config.Config.HealthMinFreeDisk, 10, 64)
+	if err != nil {
+		minFreeDisk = healthMinFreeDisk
+	}
+	return &HealthManager{
+		db:          repositories.NewSQLiteHealthRepository(&db),
+		dir:         filepath.Dir(database.Path(config.Config.DBName)),
+		minFreeDisk: minFreeDisk,
+	}
+}
+
+// CheckReadiness tells whether the service can serve requests: the database
+// answers, every migration has been executed and its disk has room left.
+func (m *HealthManager) CheckReadiness(ctx context.Context) models.Health {
+	health := models.Health{
+		Status: models.HealthOK,
+		Checks: map[string]models.HealthCheck{
+			"database":   m.checkDatabase(ctx),
+			"migrations": m.checkMigrations(ctx),
+			"disk":       m.checkDisk(),
+		},
+	}
+	for _, check := range health.Checks {
+		if check.Status != models.HealthOK {
+			health.Status = models.HealthFail
+		}
+	}
+	return health
+}
+
+func (m *HealthManager) checkDatabase(ctx context.Context) models.HealthCheck {
+	if err := m.db.Ping(ctx); err != nil {
+		return models.HealthCheck{Status: models.HealthFail, Error: err.Error()}
+	}
+	return models.HealthCheck{Status: models.HealthOK}
+}
+
+func (m *HealthManager) checkMigrations(ctx context.Context) models.HealthCheck {
+	check := models.HealthCheck{Status: models.HealthOK, Detail: map[string]interface{}{"expected": database.Version()}}
+	version, err := m.db.GetDBVersion(ctx)
+	if err != nil {
+		check.Status, check.Error = models.HealthFail, err.Error()
+		return check
+	}
+	check.Detail["version"] = version
+	if version != database.Version() {
+		check.Status = models.HealthFail
+	}
+	return check
+}
+
+func (m *HealthManager) checkDisk() models.HealthCheck {
+	check := models.HealthCheck{Status: models.HealthOK, Detail: map[string]interface{}{"minFreeBytes": m.minFreeDisk}}
+	free, err := database.FreeSpace(m.dir)
+	if err != nil {
+		check.Status, check.Error = models.HealthFail, err.Error()
+		return check
+	}
+	check.Detail["freeBytes"] = free
+	if free < m.minFreeDisk {
+		check.Status = models.HealthFail
+	}
+	return check
+}
@@ -0,0 +1,115 @@
+package managers
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"time"
+	"users/internal/models"
+	"users/internal/repositories"
+	"users/pkg/database"
+	"users/pkg/events"
+)
+
+const (
+	outboxBatch        = 100
+	outboxBaseBackoff  = time.Second
+	outboxMaxBackoff   = 10 * time.Minute
+	outboxDeliveredTTL = 7 * 24 * time.Hour
+	outboxCleanupEvery = time.Hour
+)
+
+// OutboxDispatcher delivers the events written to the outbox to every sink.
+// An event is marked as delivered only once all sinks accepted it, otherwise
+// it is retried with exponential backoff, so sinks may see it more than once.
+type OutboxDispatcher struct {
+	db          *repositories.SQLiteOutboxRepository
+	sinks       []events.Sink
+	lastCleanup time.Time
+}
+
+func NewOutboxDispatcher(db database.Database, sinks ...events.Sink) *OutboxDispatcher {
+	return &OutboxDispatcher{
+		db:    repositories.NewSQLiteOutboxRepository(&db),
+		sinks: sinks,
+	}
+}
+
+// Run dispatches pending events every interval until ctx is done.
+func (d *OutboxDispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := d.DispatchPending(ctx); err != nil {
+				slog.Error("Error dispatching outbox events", "error", err)
+			}
+		}
+	}
+}
+
+// DispatchPending sends the events that are due and returns how many were
+// delivered.
+func (d *OutboxDispatcher) DispatchPending(ctx context.Context) (int, error) {
+	pending, err := d.db.GetPendingEvents(ctx, outboxBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	delivered := 0
+	for _, outboxEvent := range pending {
+		if ctx.Err() != nil {
+			break
+		}
+		if err = d.send(ctx, outboxEvent); err != nil {
+			slog.Warn("Error sending outbox event", "eventId", outboxEvent.EventId, "attempt", outboxEvent.Attempts+1, "error", err)
+			next := time.Now().Add(outboxBackoff(outboxEvent.Attempts))
+			if err = d.db.MarkEventFailed(ctx, outboxEvent.Id, next, err.Error()); err != nil {
+				return delivered, err
+			}
+			continue
+		}
+		if err = d.db.MarkEventDelivered(ctx, outboxEvent.Id); err != nil {
+			return delivered, err
+		}
+		delivered++
+	}
+
+	if time.Since(d.lastCleanup) > outboxCleanupEvery {
+		d.lastCleanup = time.Now()
+		if err = d.db.DeleteDeliveredEvents(ctx, time.Now().Add(-outboxDeliveredTTL)); err != nil {
+			return delivered, err
+		}
+	}
+	return delivered, nil
+}
+
+func (d *OutboxDispatcher) send(ctx context.Context, outboxEvent models.OutboxEvent) error {
+	event := events.Event{
+		ID:          outboxEvent.EventId,
+		Type:        outboxEvent.Type,
+		AggregateID: outboxEvent.AggregateId,
+		CreatedAt:   outboxEvent.CreatedAt,
+		Data:        []byte(outboxEvent.Payload),
+	}
+	for _, sink := range d.sinks {
+		if err := sink.Send(ctx, event); err != nil {
+			return fmt.Errorf("%s sink: %w", sink.Name(), err)
+		}
+	}
+	return nil
+}
+
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxBaseBackoff
+	for i := 0; i < attempts && backoff < outboxMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > outboxMaxBackoff {
+		backoff = outboxMaxBackoff
+	}
+	return backoff
+}
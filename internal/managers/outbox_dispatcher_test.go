@@ -0,0 +1,108 @@
+package managers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/suite"
+	"testing"
+	"users/internal/models"
+	"users/pkg/database"
+	"users/pkg/events"
+)
+
+var outboxDatabaseTest = "/amc_outbox_test.db"
+
+type recordingSink struct {
+	fail   bool
+	events []events.Event
+}
+
+func (s *recordingSink) Name() string { return "recording" }
+
+func (s *recordingSink) Send(_ context.Context, event events.Event) error {
+	if s.fail {
+		return errors.New("sink unavailable")
+	}
+	s.events = append(s.events, event)
+	return nil
+}
+
+type OutboxDispatcherTestSuite struct {
+	suite.Suite
+	db *database.Database
+}
+
+func TestOutboxDispatcherTestSuite(t *testing.T) {
+	suite.Run(t, new(OutboxDispatcherTestSuite))
+}
+
+func (s *OutboxDispatcherTestSuite) SetupTest() {
+	_ = database.RemoveDB(outboxDatabaseTest)
+	s.db = database.InitDB(outboxDatabaseTest)
+}
+
+func (s *OutboxDispatcherTestSuite) TearDownTest() {
+	s.db = nil
+	_ = database.RemoveDB(outboxDatabaseTest)
+}
+
+func (s *OutboxDispatcherTestSuite) TestUserLifecycleEvents() {
+	userManager := NewUserManager(*s.db)
+	user, err := userManager.CreateUser(context.Background(), models.Actor{}, models.User{Mail: "outbox@mail.com", Password: "MyPassword.123"})
+	s.Require().NoError(err)
+	_, err = userManager.UpdateUser(context.Background(), models.Actor{}, user.Id, models.User{Mail: "renamed@mail.com", Password: "MyPassword.123"}, 0)
+	s.Require().NoError(err)
+	s.Require().NoError(userManager.DeleteUser(context.Background(), models.Actor{}, user.Id, 0))
+
+	sink := &recordingSink{}
+	delivered, err := NewOutboxDispatcher(*s.db, sink).DispatchPending(context.Background())
+	s.NoError(err)
+	s.Equal(3, delivered)
+
+	s.Require().Len(sink.events, 3)
+	for i, eventType := range []string{models.EventUserCreated, models.EventUserUpdated, models.EventUserDeleted} {
+		s.Equal(eventType, sink.events[i].Type)
+		s.Equal(user.Id, sink.events[i].AggregateID)
+	}
+	var updated models.UserEventData
+	s.NoError(json.Unmarshal(sink.events[1].Data, &updated))
+	s.Equal("renamed@mail.com", updated.Mail)
+	s.Equal("outbox@mail.com", updated.PreviousMail)
+
+	delivered, err = NewOutboxDispatcher(*s.db, sink).DispatchPending(context.Background())
+	s.NoError(err)
+	s.Zero(delivered, "delivered events are not sent again")
+}
+
+func (s *OutboxDispatcherTestSuite) TestFailedDeliveryIsRetried() {
+	_, err := NewUserManager(*s.db).CreateUser(context.Background(), models.Actor{}, models.User{Mail: "retry@mail.com", Password: "MyPassword.123"})
+	s.Require().NoError(err)
+
+	sink := &recordingSink{fail: true}
+	dispatcher := NewOutboxDispatcher(*s.db, sink)
+	delivered, err := dispatcher.DispatchPending(context.Background())
+	s.NoError(err)
+	s.Zero(delivered)
+
+	var outboxEvent models.OutboxEvent
+	s.NoError(s.db.Conn.Get(&outboxEvent, "SELECT * FROM outbox"))
+	s.Equal(1, outboxEvent.Attempts)
+	s.Equal("recording sink: sink unavailable", outboxEvent.LastError)
+	s.Nil(outboxEvent.DeliveredAt)
+
+	// Make the retry due instead of waiting for the backoff.
+	_, err = s.db.Conn.Exec("UPDATE outbox SET next_attempt_at = ''")
+	s.NoError(err)
+	sink.fail = false
+	delivered, err = dispatcher.DispatchPending(context.Background())
+	s.NoError(err)
+	s.Equal(1, delivered)
+	s.Len(sink.events, 1)
+}
+
+func (s *OutboxDispatcherTestSuite) TestBackoff() {
+	s.Equal(outboxBaseBackoff, outboxBackoff(0))
+	s.Equal(4*outboxBaseBackoff, outboxBackoff(2))
+	s.Equal(outboxMaxBackoff, outboxBackoff(50))
+}
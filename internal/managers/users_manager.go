@@ -1,88 +1,213 @@
 package managers
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"github.com/go-playground/validator/v10"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/exp/slog"
 	"strings"
+	"sync"
+	"time"
 	"users/internal"
+	"users/internal/config"
 	"users/internal/models"
 	"users/internal/repositories"
 	"users/pkg/database"
+	"users/pkg/logging"
+	"users/pkg/metrics"
+	"users/pkg/pwned"
+	"users/pkg/storage"
+	"users/pkg/tracing"
 )
 
 type IUserManager interface {
-	Login(userLogin models.User) (*models.User, error)
-	GetUser(id string) (*models.User, error)
-	UpdateUser(id string, userPut models.User) (*models.User, error)
-	CreateUser(userPost models.User) (*models.User, error)
-	DeleteUser(id string) error
+	Login(ctx context.Context, actor models.Actor, userLogin models.User) (*models.User, error)
+	GetUser(ctx context.Context, id string) (*models.User, error)
+	UpdateUser(ctx context.Context, actor models.Actor, id string, userPut models.User, version int) (*models.User, error)
+	CreateUser(ctx context.Context, actor models.Actor, userPost models.User) (*models.User, error)
+	DeleteUser(ctx context.Context, actor models.Actor, id string, version int) error
+	GetDeletionImpact(ctx context.Context, id string) (*models.DeletionImpact, error)
+	AnonymizeUser(ctx context.Context, actor models.Actor, id string) (*models.User, error)
 }
 type UserManager struct {
 	db       *repositories.SQLiteUserRepository
+	audit    *repositories.SQLiteAuditRepository
 	validate *validator.Validate
+	breached *breachedPolicy
+	deletion models.DeletionPolicy
+	// mailBlock is how long the mail of an anonymized user stays blocked.
+	mailBlock time.Duration
+	avatars   storage.BlobStore
 }
 
+const erasedMailBlockPeriod = 30 * 24 * time.Hour
+
 func NewUserManager(db database.Database) *UserManager {
 	return &UserManager{
-		db:       repositories.NewSQLiteUserRepository(&db),
-		validate: validator.New(),
+		db:        repositories.NewSQLiteUserRepository(&db),
+		audit:     repositories.NewSQLiteAuditRepository(&db),
+		validate:  internal.NewValidator(),
+		breached:  &breachedPolicy{},
+		deletion:  deletionPolicy(config.Config.UserDeletionPolicy, config.Config.UserDeletionReassignTo),
+		mailBlock: mailBlockPeriod(config.Config.ErasedMailBlockPeriod),
+		avatars:   avatarStore(),
+	}
+}
+
+// mailBlockPeriod parses the configured period, falling back to the default.
+func mailBlockPeriod(period string) time.Duration {
+	if period == "" {
+		return erasedMailBlockPeriod
+	}
+	duration, err := time.ParseDuration(period)
+	if err != nil || duration < 0 {
+		slog.Warn("Wrong erased mail block period, using the default", "period", period, "default", erasedMailBlockPeriod)
+		return erasedMailBlockPeriod
+	}
+	return duration
+}
+
+// deletionPolicy builds the configured policy, falling back to cascade.
+func deletionPolicy(mode, reassignTo string) models.DeletionPolicy {
+	switch mode {
+	case models.DeletionBlock, models.DeletionCascade:
+		return models.DeletionPolicy{Mode: mode}
+	case models.DeletionReassign:
+		if reassignTo != "" {
+			return models.DeletionPolicy{Mode: mode, ReassignTo: reassignTo}
+		}
+		slog.Warn("Reassign deletion policy without a target user, using cascade")
+	case "":
+	default:
+		slog.Warn("Unknown deletion policy, using cascade", "policy", mode)
 	}
+	return models.DeletionPolicy{Mode: models.DeletionCascade}
 }
 
-func (u *UserManager) Login(userLogin models.User) (*models.User, error) {
+func (u *UserManager) Login(ctx context.Context, actor models.Actor, userLogin models.User) (_ *models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserManager.Login")
+	defer func() { tracing.End(span, err) }()
 
-	user, err := u.db.GetUserByMail(userLogin.Mail)
+	user, err := u.db.GetUserByMail(ctx, userLogin.Mail)
 	if err != nil {
+		if errors.Is(err, internal.ErrUserNotFound) {
+			metrics.Logins.WithLabelValues("failure").Inc()
+			u.record(actor, models.AuditLoginFailure, "", map[string]interface{}{"mailHash": mailHash(userLogin.Mail), "reason": "user_not_found"})
+		}
 		return nil, err
 	}
 
 	correct := checkPasswordHash(userLogin.Password, user.Password)
 	if !correct {
+		metrics.Logins.WithLabelValues("failure").Inc()
+		u.record(actor, models.AuditLoginFailure, user.Id, map[string]interface{}{"reason": "wrong_password"})
 		return &models.User{}, internal.ErrWrongPassword
 	}
+	if actor.ID == "" {
+		actor.ID = user.Id
+	}
+	metrics.Logins.WithLabelValues("success").Inc()
+	u.record(actor, models.AuditLoginSuccess, user.Id, nil)
+	if loggedIn, err := u.db.RecordLogin(ctx, user.Id); err == nil {
+		user.LastLoginAt = &loggedIn
+	}
 	return user, nil
 }
 
-func (u *UserManager) GetUser(id string) (*models.User, error) {
-	return u.db.GetUser(id)
+func (u *UserManager) GetUser(ctx context.Context, id string) (_ *models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserManager.GetUser")
+	defer func() { tracing.End(span, err) }()
+
+	return u.db.GetUser(ctx, id)
 }
 
-func (u *UserManager) UpdateUser(id string, userUpdate models.User) (*models.User, error) {
-	var err error
-	if _, err = u.db.GetUser(id); err != nil {
+// UpdateUser replaces the profile of the user. When version is not 0 the
+// update only happens if it is still the current version of the user. Reading
+// the user, updating it and reading it back is a single unit of work.
+func (u *UserManager) UpdateUser(ctx context.Context, actor models.Actor, id string, userUpdate models.User, version int) (_ *models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserManager.UpdateUser")
+	defer func() { tracing.End(span, err) }()
+
+	// Checked up front so a missing user is reported before a wrong body,
+	// without holding the transaction open while hashing the password.
+	existing, err := u.db.GetUser(ctx, id)
+	if err != nil {
 		return nil, err
 	}
 
-	if err = u.validate.Struct(userUpdate); err != nil {
-		return nil, internal.ErrWrongBody
+	if err := u.validate.Struct(userUpdate); err != nil {
+		return nil, internal.ValidationError(err)
+	}
+
+	if err := u.checkBreachedPassword(userUpdate.Password); err != nil {
+		return nil, err
 	}
 
 	if userUpdate.Name == nil {
 		userUpdate.Name = &strings.Split(userUpdate.Mail, "@")[0]
 	}
 
-	userUpdate.Password, err = HashPassword(userUpdate.Password)
+	passwordChanged := !checkPasswordHash(userUpdate.Password, existing.Password)
+	hashed, err := HashPassword(userUpdate.Password)
 	if err != nil {
 		return &models.User{}, internal.ErrHashingPassword
 	}
+	userUpdate.Password = hashed
 
-	if err = u.db.UpdateUser(id, &userUpdate); err != nil {
+	var current, updated *models.User
+	err = u.db.InTx(ctx, func(tx repositories.UnitOfWork) error {
+		users := tx.Users()
+		if current, err = users.GetUser(ctx, id); err != nil {
+			return err
+		}
+		if version != 0 && version != current.Version {
+			return internal.ErrVersionMismatch
+		}
+		if userUpdate.Mail != current.Mail {
+			if err = checkMailBlocked(ctx, users, userUpdate.Mail); err != nil {
+				return err
+			}
+		}
+		if err = users.UpdateUser(ctx, id, &userUpdate, version); err != nil {
+			return err
+		}
+		if updated, err = users.GetUser(ctx, id); err != nil {
+			return err
+		}
+		if fields := changedFields(current, &userUpdate, passwordChanged); len(fields) > 0 {
+			if err = recordAuditInTx(ctx, tx, actor, models.AuditUserUpdated, id, map[string]interface{}{"fields": fields}); err != nil {
+				return err
+			}
+		}
+		if passwordChanged {
+			return recordAuditInTx(ctx, tx, actor, models.AuditPasswordChange, id, nil)
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
-
-	return u.db.GetUserByMail(userUpdate.Mail)
+	return updated, nil
 }
 
-func (u *UserManager) CreateUser(userCreate models.User) (*models.User, error) {
+// CreateUser registers a new user. Checking the mail is free, inserting the
+// user and reading it back is a single unit of work, so two sign ups with the
+// same mail can't both pass the check.
+func (u *UserManager) CreateUser(ctx context.Context, actor models.Actor, userCreate models.User) (_ *models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserManager.CreateUser")
+	defer func() { tracing.End(span, err) }()
 
-	err := u.validate.Struct(userCreate)
-	if err != nil {
-		return nil, internal.ErrWrongBody
+	if err = u.validate.Struct(userCreate); err != nil {
+		return nil, internal.ValidationError(err)
 	}
 
-	user, err := u.db.GetUserByMail(userCreate.Mail)
-	if user != nil {
-		return nil, internal.ErrUserAlreadyExists
+	if err = u.checkBreachedPassword(userCreate.Password); err != nil {
+		return nil, err
 	}
 
 	if userCreate.Name == nil {
@@ -94,27 +219,283 @@ func (u *UserManager) CreateUser(userCreate models.User) (*models.User, error) {
 		return nil, internal.ErrHashingPassword
 	}
 
-	if err = u.db.CreateUser(&userCreate); err != nil {
-		return nil, internal.ErrSomethingWentWrong
+	var user *models.User
+	err = u.db.InTx(ctx, func(tx repositories.UnitOfWork) error {
+		users := tx.Users()
+		if existing, _ := users.GetUserByMail(ctx, userCreate.Mail); existing != nil {
+			return internal.ErrUserAlreadyExists
+		}
+		if err := checkMailBlocked(ctx, users, userCreate.Mail); err != nil {
+			return err
+		}
+		if err := users.CreateUser(ctx, &userCreate); err != nil {
+			return err
+		}
+		if user, err = users.GetUser(ctx, userCreate.Id); err != nil {
+			return err
+		}
+		return recordAuditInTx(ctx, tx, actor, models.AuditUserCreated, user.Id, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+
+}
+
+// DeleteUser removes the user, applying the deletion policy. When version is
+// not 0 the user is only deleted if it is still its current version.
+func (u *UserManager) DeleteUser(ctx context.Context, actor models.Actor, id string, version int) (err error) {
+	ctx, span := tracing.Start(ctx, "UserManager.DeleteUser")
+	defer func() { tracing.End(span, err) }()
+
+	policy, err := u.deletionPolicyFor(ctx, id)
+	if err != nil {
+		return err
+	}
+	var exports []models.ExportJob
+	err = u.db.InTx(ctx, func(tx repositories.UnitOfWork) error {
+		impact, err := tx.Users().DeleteUser(ctx, id, policy, version)
+		if err != nil {
+			return err
+		}
+		if exports, err = deleteExportJobs(ctx, tx.Exports(), id); err != nil {
+			return err
+		}
+		return recordAuditInTx(ctx, tx, actor, models.AuditUserDeleted, id, map[string]interface{}{
+			"policy":          impact.Policy,
+			"reassignTo":      impact.ReassignTo,
+			"meals":           impact.Meals,
+			"calendarEntries": impact.CalendarEntries,
+		})
+	})
+	if err != nil {
+		return err
 	}
+	deleteAvatar(u.avatars, id)
+	removeExportFiles(exports)
+	return nil
+}
 
-	return u.db.GetUserByMail(userCreate.Mail)
+// AnonymizeUser erases the name, mail and password of the user, keeping its
+// id so the meals and calendar entries still add up in aggregate statistics.
+// The previous mail can't be registered again during the configured period.
+func (u *UserManager) AnonymizeUser(ctx context.Context, actor models.Actor, id string) (_ *models.User, err error) {
+	ctx, span := tracing.Start(ctx, "UserManager.AnonymizeUser")
+	defer func() { tracing.End(span, err) }()
 
+	user, err := u.db.GetUser(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(user.Mail, models.AnonymizedMailDomain) {
+		return nil, internal.ErrUserAnonymized
+	}
+
+	name := models.AnonymizedName
+	anonymized := &models.User{
+		Id:       id,
+		Name:     &name,
+		Mail:     models.AnonymizedName + "-" + strings.ToLower(id) + models.AnonymizedMailDomain,
+		Password: models.AnonymizedPassword,
+	}
+	var blockedUntil string
+	if u.mailBlock > 0 {
+		blockedUntil = time.Now().Add(u.mailBlock).UTC().Format(models.TimestampLayout)
+	}
+	details := map[string]interface{}{}
+	if blockedUntil != "" {
+		details["mailBlockedUntil"] = blockedUntil
+	}
+	var exports []models.ExportJob
+	err = u.db.InTx(ctx, func(tx repositories.UnitOfWork) error {
+		redacted, err := tx.Users().AnonymizeUser(ctx, id, anonymized, mailHash(user.Mail), blockedUntil)
+		if err != nil {
+			return err
+		}
+		if len(redacted) > 0 {
+			details[models.AuditRedactedEvents] = redacted
+		}
+		if exports, err = deleteExportJobs(ctx, tx.Exports(), id); err != nil {
+			return err
+		}
+		return recordAuditInTx(ctx, tx, actor, models.AuditUserAnonymized, id, details)
+	})
+	if err != nil {
+		return nil, err
+	}
+	deleteAvatar(u.avatars, id)
+	removeExportFiles(exports)
+	return anonymized, nil
 }
 
-func (u *UserManager) DeleteUser(id string) error {
-	if _, err := u.db.GetUser(id); err != nil {
+// checkMailBlocked rejects the mails of recently anonymized users.
+func checkMailBlocked(ctx context.Context, users repositories.UserRepository, mail string) error {
+	blocked, err := users.IsMailBlocked(ctx, mailHash(mail))
+	if err != nil {
 		return err
 	}
-	return u.db.DeleteUser(id)
+	if blocked {
+		return internal.ErrMailBlocked
+	}
+	return nil
+}
+
+// mailHash is what is kept of the mail of an anonymized user: its HMAC keyed
+// with MAIL_HASH_KEY, as mails are easily guessed.
+func mailHash(mail string) string {
+	h := hmac.New(sha256.New, []byte(config.Config.MailHashKey))
+	h.Write([]byte(strings.ToLower(strings.TrimSpace(mail))))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// GetDeletionImpact reports the data DeleteUser would remove or reassign.
+func (u *UserManager) GetDeletionImpact(ctx context.Context, id string) (_ *models.DeletionImpact, err error) {
+	ctx, span := tracing.Start(ctx, "UserManager.GetDeletionImpact")
+	defer func() { tracing.End(span, err) }()
+
+	policy, err := u.deletionPolicyFor(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return u.db.GetDeletionImpact(ctx, id, policy)
+}
+
+// deletionPolicyFor checks the user exists and returns the policy that applies
+// to them. The user receiving reassigned data cannot reassign it to itself, so
+// deleting it is blocked while it has data.
+func (u *UserManager) deletionPolicyFor(ctx context.Context, id string) (models.DeletionPolicy, error) {
+	if _, err := u.db.GetUser(ctx, id); err != nil {
+		return models.DeletionPolicy{}, err
+	}
+	if u.deletion.Mode != models.DeletionReassign {
+		return u.deletion, nil
+	}
+	if u.deletion.ReassignTo == id {
+		return models.DeletionPolicy{Mode: models.DeletionBlock}, nil
+	}
+	if _, err := u.db.GetUser(ctx, u.deletion.ReassignTo); err != nil {
+		logging.FromContext(ctx).Error("Error getting the deletion reassign target", "reassignTo", u.deletion.ReassignTo, "error", err)
+		return models.DeletionPolicy{}, internal.ErrSomethingWentWrong
+	}
+	return u.deletion, nil
+}
+
+// record appends an event to the audit trail. A failure to write it is logged
+// but does not undo the operation being audited. The event is written even if
+// the request is cancelled meanwhile, as the operation already happened.
+func (u *UserManager) record(actor models.Actor, event, userID string, details map[string]interface{}) {
+	recordAudit(u.audit, actor, event, userID, details)
+}
+
+// recordAudit records an event that is not part of a unit of work, logging
+// the error if it can't.
+func recordAudit(audit repositories.AuditRepository, actor models.Actor, event, userID string, details map[string]interface{}) {
+	if err := audit.CreateAuditEvent(context.Background(), auditEvent(actor, event, userID, details)); err != nil {
+		slog.Error("Error recording audit event", "event", event, "requestId", actor.RequestID, "error", err)
+	}
+}
+
+// recordAuditInTx records an event as part of the unit of work of the change
+// it audits, so neither is kept without the other.
+func recordAuditInTx(ctx context.Context, tx repositories.UnitOfWork, actor models.Actor, event, userID string, details map[string]interface{}) error {
+	return tx.Audit().CreateAuditEvent(ctx, auditEvent(actor, event, userID, details))
+}
+
+func auditEvent(actor models.Actor, event, userID string, details map[string]interface{}) *models.AuditEvent {
+	audited := &models.AuditEvent{
+		Event:     event,
+		UserId:    userID,
+		ActorId:   actor.ID,
+		IP:        actor.IP,
+		UserAgent: actor.UserAgent,
+		RequestId: actor.RequestID,
+	}
+	if details != nil {
+		body, err := json.Marshal(details)
+		if err != nil {
+			slog.Error("Error encoding audit details", "event", event, "requestId", actor.RequestID, "error", err)
+		}
+		audited.Details = body
+	}
+	return audited
+}
+
+// changedFields lists the user fields modified by an update. Values are left
+// out so the audit trail does not duplicate personal data.
+func changedFields(current, updated *models.User, passwordChanged bool) []string {
+	var fields []string
+	if current.Name == nil || updated.Name == nil || *current.Name != *updated.Name {
+		fields = append(fields, "name")
+	}
+	if current.Mail != updated.Mail {
+		fields = append(fields, "mail")
+	}
+	if current.Locale != updated.Locale {
+		fields = append(fields, "locale")
+	}
+	if current.Timezone != updated.Timezone {
+		fields = append(fields, "timezone")
+	}
+	if current.AvatarURL != updated.AvatarURL {
+		fields = append(fields, "avatarUrl")
+	}
+	if strings.Join(current.DietaryPreferences, ",") != strings.Join(updated.DietaryPreferences, ",") {
+		fields = append(fields, "dietaryPreferences")
+	}
+	if passwordChanged {
+		fields = append(fields, "password")
+	}
+	return fields
+}
+
+// breachedPolicy is the breached-password checker of the configuration in
+// effect, built again when a reload changes its sources.
+type breachedPolicy struct {
+	mu      sync.Mutex
+	file    string
+	url     string
+	built   bool
+	current pwned.Checker
+}
+
+func (p *breachedPolicy) checker(cfg config.Configuration) pwned.Checker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.built || p.file != cfg.PwnedPasswordsFile || p.url != cfg.PwnedPasswordsURL {
+		p.file, p.url, p.built = cfg.PwnedPasswordsFile, cfg.PwnedPasswordsURL, true
+		p.current = pwned.NewChecker(p.file, p.url)
+	}
+	return p.current
+}
+
+// checkBreachedPassword rejects passwords found in the breached-password corpus.
+// Lookup failures are logged and let through so an unavailable corpus does not
+// block sign ups.
+func (u *UserManager) checkBreachedPassword(password string) error {
+	checker := u.breached.checker(config.Current())
+	if checker == nil {
+		return nil
+	}
+	found, err := checker.IsPwned(password)
+	if err != nil {
+		slog.Error("Error checking breached passwords", "error", err)
+		return nil
+	}
+	if found {
+		return internal.ErrPasswordBreached
+	}
+	return nil
 }
 
 func HashPassword(password string) (string, error) {
+	defer metrics.Since(metrics.PasswordHashDuration.WithLabelValues("hash"), time.Now())
 	bytes, err := bcrypt.GenerateFromPassword([]byte(password), 7)
 	return string(bytes), err
 }
 
 func checkPasswordHash(password, hash string) bool {
+	defer metrics.Since(metrics.PasswordHashDuration.WithLabelValues("compare"), time.Now())
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	return err == nil
 }
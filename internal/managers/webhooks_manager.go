@@ -0,0 +1,329 @@
+package managers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-playground/validator/v10"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"strconv"
+	"time"
+	"users/internal"
+	"users/internal/config"
+	"users/internal/models"
+	"users/internal/repositories"
+	"users/pkg/database"
+	"users/pkg/events"
+	"users/pkg/logging"
+	"users/pkg/webhook"
+)
+
+const (
+	webhookBatch         = 50
+	webhookMaxAttempts   = 8
+	webhookBaseBackoff   = 10 * time.Second
+	webhookMaxBackoff    = time.Hour
+	webhookDisableAfter  = 20
+	webhookTimeout       = 10 * time.Second
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+type IWebhookManager interface {
+	CreateWebhook(ctx context.Context, req models.WebhookRequest) (*models.Webhook, error)
+	GetWebhooks(ctx context.Context) ([]models.Webhook, error)
+	GetWebhook(ctx context.Context, id string) (*models.Webhook, error)
+	UpdateWebhook(ctx context.Context, id string, req models.WebhookRequest) (*models.Webhook, error)
+	DeleteWebhook(ctx context.Context, id string) error
+	GetDeliveries(ctx context.Context, webhookID string, limit, offset int) ([]models.WebhookDelivery, error)
+	Redeliver(ctx context.Context, webhookID, deliveryID string) (*models.WebhookDelivery, error)
+}
+
+type WebhookManager struct {
+	db           *repositories.SQLiteWebhookRepository
+	validate     *validator.Validate
+	client       *http.Client
+	disableAfter int
+	allowPrivate bool
+}
+
+func NewWebhookManager(db database.Database) *WebhookManager {
+	disableAfter, err := strconv.Atoi(config.Config.WebhookDisableAfter)
+	if err != nil || disableAfter <= 0 {
+		disableAfter = webhookDisableAfter
+	}
+	allowPrivate, _ := strconv.ParseBool(config.Config.WebhookAllowPrivate)
+	return &WebhookManager{
+		db:           repositories.NewSQLiteWebhookRepository(&db),
+		validate:     internal.NewValidator(),
+		client:       webhook.NewClient(webhookTimeout, allowPrivate),
+		disableAfter: disableAfter,
+		allowPrivate: allowPrivate,
+	}
+}
+
+func (w *WebhookManager) CreateWebhook(ctx context.Context, req models.WebhookRequest) (*models.Webhook, error) {
+	var err error
+	if err = w.validate.Struct(req); err != nil {
+		return nil, internal.ValidationError(err)
+	}
+	if err = w.checkURL(ctx, req.URL); err != nil {
+		return nil, err
+	}
+	if req.Secret == "" {
+		if req.Secret, err = webhook.NewSecret(); err != nil {
+			logging.FromContext(ctx).Error("Error generating webhook secret", "error", err)
+			return nil, internal.ErrSomethingWentWrong
+		}
+	}
+
+	hook := &models.Webhook{URL: req.URL, Events: req.Events, Secret: req.Secret, Active: req.Active == nil || *req.Active}
+	if err = w.db.CreateWebhook(ctx, hook); err != nil {
+		return nil, err
+	}
+	return hook, nil
+}
+
+// checkURL rejects webhook URLs reaching addresses that are not public,
+// unless WEBHOOK_ALLOW_PRIVATE is set.
+func (w *WebhookManager) checkURL(ctx context.Context, url string) error {
+	if w.allowPrivate {
+		return nil
+	}
+	if err := webhook.CheckURL(ctx, url); err != nil {
+		return internal.ErrWebhookURLPrivate.Wrap(err)
+	}
+	return nil
+}
+
+func (w *WebhookManager) GetWebhooks(ctx context.Context) ([]models.Webhook, error) {
+	hooks, err := w.db.GetWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	return hooks, nil
+}
+
+func (w *WebhookManager) GetWebhook(ctx context.Context, id string) (*models.Webhook, error) {
+	hook, err := w.db.GetWebhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	hook.Secret = ""
+	return hook, nil
+}
+
+// UpdateWebhook replaces the url and events of a webhook. Activating it again
+// resets its failure count; the secret is only rotated when a new one is sent.
+func (w *WebhookManager) UpdateWebhook(ctx context.Context, id string, req models.WebhookRequest) (*models.Webhook, error) {
+	hook, err := w.db.GetWebhook(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err = w.validate.Struct(req); err != nil {
+		return nil, internal.ValidationError(err)
+	}
+	if err = w.checkURL(ctx, req.URL); err != nil {
+		return nil, err
+	}
+
+	hook.URL, hook.Events = req.URL, req.Events
+	if req.Secret != "" {
+		hook.Secret = req.Secret
+	}
+	if req.Active != nil && *req.Active != hook.Active {
+		hook.Active = *req.Active
+		hook.ConsecutiveFailures = 0
+		hook.DisabledAt = nil
+	}
+	if err = w.db.UpdateWebhook(ctx, hook); err != nil {
+		return nil, err
+	}
+	hook.Secret = ""
+	return hook, nil
+}
+
+func (w *WebhookManager) DeleteWebhook(ctx context.Context, id string) error {
+	if _, err := w.db.GetWebhook(ctx, id); err != nil {
+		return err
+	}
+	return w.db.DeleteWebhook(ctx, id)
+}
+
+func (w *WebhookManager) GetDeliveries(ctx context.Context, webhookID string, limit, offset int) ([]models.WebhookDelivery, error) {
+	if limit < 0 || offset < 0 {
+		return nil, internal.ErrWrongQuery
+	}
+	if limit == 0 {
+		limit = defaultDeliveryLimit
+	}
+	if limit > maxDeliveryLimit {
+		limit = maxDeliveryLimit
+	}
+	if _, err := w.db.GetWebhook(ctx, webhookID); err != nil {
+		return nil, err
+	}
+	return w.db.GetDeliveries(ctx, webhookID, limit, offset)
+}
+
+// Redeliver queues a new delivery of the same event, keeping the original one
+// untouched in the history.
+func (w *WebhookManager) Redeliver(ctx context.Context, webhookID, deliveryID string) (*models.WebhookDelivery, error) {
+	if _, err := w.db.GetWebhook(ctx, webhookID); err != nil {
+		return nil, err
+	}
+	original, err := w.db.GetDelivery(ctx, webhookID, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery := &models.WebhookDelivery{
+		WebhookId:    webhookID,
+		EventId:      original.EventId,
+		EventType:    original.EventType,
+		Payload:      original.Payload,
+		RedeliveryOf: original.Id,
+	}
+	if err = w.db.CreateDelivery(ctx, delivery); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+// Sink returns the outbox sink that queues a delivery for every active
+// webhook subscribed to the event.
+func (w *WebhookManager) Sink() events.Sink {
+	return webhookSink{manager: w}
+}
+
+type webhookSink struct {
+	manager *WebhookManager
+}
+
+func (s webhookSink) Name() string {
+	return "webhooks"
+}
+
+func (s webhookSink) Send(ctx context.Context, event events.Event) error {
+	hooks, err := s.manager.db.GetActiveWebhooks(ctx)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if !subscribed(hook, event.Type) {
+			continue
+		}
+		delivery := &models.WebhookDelivery{WebhookId: hook.Id, EventId: event.ID, EventType: event.Type, Payload: payload}
+		if err = s.manager.db.CreateDelivery(ctx, delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func subscribed(hook models.Webhook, eventType string) bool {
+	for _, e := range hook.Events {
+		if e == "*" || e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Run delivers pending webhook deliveries every interval until ctx is done.
+func (w *WebhookManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.DeliverPending(ctx); err != nil {
+				slog.Error("Error delivering webhooks", "error", err)
+			}
+		}
+	}
+}
+
+// DeliverPending makes one attempt for every delivery that is due. Failed
+// attempts are retried with exponential backoff up to webhookMaxAttempts, and
+// every failure counts towards disabling the webhook.
+func (w *WebhookManager) DeliverPending(ctx context.Context) error {
+	deliveries, err := w.db.GetPendingDeliveries(ctx, webhookBatch)
+	if err != nil {
+		return err
+	}
+	hooks := map[string]*models.Webhook{}
+	for i := range deliveries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		delivery := &deliveries[i]
+		hook, ok := hooks[delivery.WebhookId]
+		if !ok {
+			if hook, err = w.db.GetWebhook(ctx, delivery.WebhookId); err != nil {
+				return err
+			}
+			hooks[delivery.WebhookId] = hook
+		}
+		if !hook.Active {
+			continue
+		}
+		if err = w.attempt(ctx, hook, delivery); err != nil {
+			return err
+		}
+		if delivery.Status != models.DeliverySucceeded {
+			if refreshed, err := w.db.GetWebhook(ctx, hook.Id); err == nil {
+				hooks[hook.Id] = refreshed
+			}
+		}
+	}
+	return nil
+}
+
+func (w *WebhookManager) attempt(ctx context.Context, hook *models.Webhook, delivery *models.WebhookDelivery) error {
+	status, sendErr := webhook.Send(ctx, w.client, webhook.Request{
+		URL:        hook.URL,
+		Secret:     hook.Secret,
+		DeliveryID: delivery.Id,
+		Event:      delivery.EventType,
+		Body:       delivery.Payload,
+	})
+
+	delivery.Attempts++
+	delivery.ResponseStatus = status
+	if sendErr == nil {
+		delivered := time.Now().UTC().Format(models.TimestampLayout)
+		delivery.Status, delivery.LastError, delivery.DeliveredAt = models.DeliverySucceeded, "", &delivered
+	} else {
+		delivery.LastError = sendErr.Error()
+		if delivery.Attempts >= webhookMaxAttempts {
+			delivery.Status = models.DeliveryFailed
+		} else {
+			delivery.NextAttemptAt = time.Now().Add(webhookBackoff(delivery.Attempts - 1)).UTC().Format(models.TimestampLayout)
+		}
+	}
+	if err := w.db.UpdateDeliveryAttempt(ctx, delivery); err != nil {
+		return err
+	}
+	return w.db.RecordWebhookResult(ctx, hook.Id, sendErr == nil, w.disableAfter)
+}
+
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 0; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
@@ -0,0 +1,205 @@
+package managers
+
+import (
+	"context"
+	"github.com/stretchr/testify/suite"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+	"users/internal"
+	"users/internal/config"
+	"users/internal/models"
+	"users/pkg/database"
+	"users/pkg/webhook"
+)
+
+var webhookDatabaseTest = "/amc_webhook_test.db"
+
+type WebhookManagerTestSuite struct {
+	suite.Suite
+	db       *database.Database
+	manager  *WebhookManager
+	server   *httptest.Server
+	status   int
+	received []string
+}
+
+func TestWebhookManagerTestSuite(t *testing.T) {
+	suite.Run(t, new(WebhookManagerTestSuite))
+}
+
+func (s *WebhookManagerTestSuite) SetupTest() {
+	_ = database.RemoveDB(webhookDatabaseTest)
+	s.db = database.InitDB(webhookDatabaseTest)
+	// The test server listens on loopback.
+	config.Config.WebhookAllowPrivate = "true"
+	s.manager = NewWebhookManager(*s.db)
+	s.status = http.StatusOK
+	s.received = nil
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(webhook.HeaderTimestamp), 10, 64)
+		s.NoError(webhook.Verify("0123456789abcdef0123", r.Header.Get(webhook.HeaderSignature), timestamp, body, time.Minute))
+		s.received = append(s.received, r.Header.Get(webhook.HeaderEvent))
+		w.WriteHeader(s.status)
+	}))
+}
+
+func (s *WebhookManagerTestSuite) TearDownTest() {
+	config.Config.WebhookAllowPrivate = ""
+	s.server.Close()
+	s.db = nil
+	_ = database.RemoveDB(webhookDatabaseTest)
+}
+
+func (s *WebhookManagerTestSuite) createWebhook(events ...string) *models.Webhook {
+	hook, err := s.manager.CreateWebhook(context.Background(), models.WebhookRequest{URL: s.server.URL, Events: events, Secret: "0123456789abcdef0123"})
+	s.Require().NoError(err)
+	return hook
+}
+
+func (s *WebhookManagerTestSuite) dispatchUserEvents() {
+	userManager := NewUserManager(*s.db)
+	user, err := userManager.CreateUser(context.Background(), models.Actor{}, models.User{Mail: "hooked@mail.com", Password: "MyPassword.123"})
+	s.Require().NoError(err)
+	s.Require().NoError(userManager.DeleteUser(context.Background(), models.Actor{}, user.Id, 0))
+
+	_, err = NewOutboxDispatcher(*s.db, s.manager.Sink()).DispatchPending(context.Background())
+	s.Require().NoError(err)
+}
+
+// makeDue moves pending retries to the past instead of waiting for the backoff.
+func (s *WebhookManagerTestSuite) makeDue() {
+	_, err := s.db.Conn.Exec("UPDATE webhook_deliveries SET next_attempt_at = ''")
+	s.Require().NoError(err)
+}
+
+func (s *WebhookManagerTestSuite) TestDeliverSubscribedEvents() {
+	hook := s.createWebhook(models.EventUserDeleted)
+	s.createWebhook("*")
+	s.dispatchUserEvents()
+
+	s.NoError(s.manager.DeliverPending(context.Background()))
+	s.ElementsMatch([]string{models.EventUserDeleted, models.EventUserCreated, models.EventUserDeleted}, s.received)
+
+	deliveries, err := s.manager.GetDeliveries(context.Background(), hook.Id, 0, 0)
+	s.NoError(err)
+	s.Require().Len(deliveries, 1)
+	s.Equal(models.DeliverySucceeded, deliveries[0].Status)
+	s.Equal(http.StatusOK, deliveries[0].ResponseStatus)
+	s.Equal(1, deliveries[0].Attempts)
+
+	// Handing the same outbox event over again does not duplicate deliveries.
+	_, err = s.db.Conn.Exec("UPDATE outbox SET delivered_at = NULL")
+	s.NoError(err)
+	_, err = NewOutboxDispatcher(*s.db, s.manager.Sink()).DispatchPending(context.Background())
+	s.NoError(err)
+	s.NoError(s.manager.DeliverPending(context.Background()))
+	s.Len(s.received, 3)
+}
+
+func (s *WebhookManagerTestSuite) TestPrivateURLs() {
+	config.Config.WebhookAllowPrivate = "false"
+	manager := NewWebhookManager(*s.db)
+	hook := s.createWebhook("*")
+
+	for _, url := range []string{
+		s.server.URL,
+		"http://localhost:8080/hooks",
+		"http://10.0.0.7/hooks",
+		"http://169.254.169.254/latest/meta-data",
+		"http://[::1]/hooks",
+		"http://[fd00:ec2::254]/hooks",
+	} {
+		_, err := manager.CreateWebhook(context.Background(), models.WebhookRequest{URL: url, Events: []string{"*"}})
+		s.ErrorIs(err, internal.ErrWebhookURLPrivate, url)
+		_, err = manager.UpdateWebhook(context.Background(), hook.Id, models.WebhookRequest{URL: url, Events: []string{"*"}})
+		s.ErrorIs(err, internal.ErrWebhookURLPrivate, url)
+	}
+	_, err := manager.CreateWebhook(context.Background(), models.WebhookRequest{URL: "https://203.0.113.10/hooks", Events: []string{"*"}})
+	s.NoError(err)
+}
+
+func (s *WebhookManagerTestSuite) TestDeliverToPrivateAddress() {
+	// A webhook whose host resolved to a public address when registered is
+	// still refused once it points to a private one.
+	hook := s.createWebhook(models.EventUserCreated)
+	s.dispatchUserEvents()
+
+	config.Config.WebhookAllowPrivate = "false"
+	s.NoError(NewWebhookManager(*s.db).DeliverPending(context.Background()))
+	s.Empty(s.received)
+
+	deliveries, err := s.manager.GetDeliveries(context.Background(), hook.Id, 0, 0)
+	s.NoError(err)
+	s.Require().Len(deliveries, 1)
+	s.Equal(models.DeliveryPending, deliveries[0].Status)
+	s.Contains(deliveries[0].LastError, webhook.ErrPrivateAddress.Error())
+}
+
+func (s *WebhookManagerTestSuite) TestRetryAndRedeliver() {
+	hook := s.createWebhook(models.EventUserCreated)
+	s.dispatchUserEvents()
+
+	s.status = http.StatusServiceUnavailable
+	s.NoError(s.manager.DeliverPending(context.Background()))
+	deliveries, err := s.manager.GetDeliveries(context.Background(), hook.Id, 0, 0)
+	s.NoError(err)
+	s.Require().Len(deliveries, 1)
+	s.Equal(models.DeliveryPending, deliveries[0].Status)
+	s.Equal(http.StatusServiceUnavailable, deliveries[0].ResponseStatus)
+
+	s.NoError(s.manager.DeliverPending(context.Background()))
+	s.Len(s.received, 1, "the retry waits for its backoff")
+
+	s.status = http.StatusOK
+	s.makeDue()
+	s.NoError(s.manager.DeliverPending(context.Background()))
+	deliveries, err = s.manager.GetDeliveries(context.Background(), hook.Id, 0, 0)
+	s.NoError(err)
+	s.Equal(models.DeliverySucceeded, deliveries[0].Status)
+	s.Equal(2, deliveries[0].Attempts)
+
+	redelivery, err := s.manager.Redeliver(context.Background(), hook.Id, deliveries[0].Id)
+	s.NoError(err)
+	s.Equal(deliveries[0].Id, redelivery.RedeliveryOf)
+	s.NoError(s.manager.DeliverPending(context.Background()))
+	s.Equal([]string{models.EventUserCreated, models.EventUserCreated, models.EventUserCreated}, s.received)
+}
+
+func (s *WebhookManagerTestSuite) TestDisableAfterRepeatedFailures() {
+	s.manager.disableAfter = 3
+	hook := s.createWebhook("*")
+	s.dispatchUserEvents()
+
+	s.status = http.StatusInternalServerError
+	for i := 0; i < 3; i++ {
+		s.makeDue()
+		s.NoError(s.manager.DeliverPending(context.Background()))
+	}
+	s.Len(s.received, 3)
+
+	disabled, err := s.manager.GetWebhook(context.Background(), hook.Id)
+	s.NoError(err)
+	s.False(disabled.Active)
+	s.NotNil(disabled.DisabledAt)
+
+	s.makeDue()
+	s.NoError(s.manager.DeliverPending(context.Background()))
+	s.Len(s.received, 3, "disabled webhooks are not called")
+
+	active := true
+	enabled, err := s.manager.UpdateWebhook(context.Background(), hook.Id, models.WebhookRequest{URL: s.server.URL, Events: []string{"*"}, Active: &active})
+	s.NoError(err)
+	s.True(enabled.Active)
+	s.Zero(enabled.ConsecutiveFailures)
+}
+
+func (s *WebhookManagerTestSuite) TestBackoff() {
+	s.Equal(webhookBaseBackoff, webhookBackoff(0))
+	s.Equal(8*webhookBaseBackoff, webhookBackoff(3))
+	s.Equal(webhookMaxBackoff, webhookBackoff(40))
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"fmt"
+	"golang.org/x/text/language"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultLanguage is the language of errors logged and of the responses to
+// requests that ask for no language the catalogs have.
+const DefaultLanguage = "es"
+
+// languages are the languages there is a catalog for, the default first.
+var languages = []language.Tag{language.Spanish, language.English}
+
+var matcher = language.NewMatcher(languages)
+
+// catalogs hold the message of every error code, and of every rule a field
+// can break, in each language. Messages of rules taking a parameter have a
+// verb for it.
+var catalogs = map[string]map[string]string{
+	"es": {
+		"invalid_user_id":         "error con el ID del usuario dado",
+		"internal_error":          "error inesperado",
+		"user_already_exists":     "este usuario ya existe",
+		"invalid_body":            "el cuerpo enviado es erróneo",
+		"invalid_query":           "los parámetros de búsqueda son erróneos",
+		"user_not_found":          "usuario no encontrado",
+		"password_hashing_failed": "error encriptando la contraseña",
+		"wrong_password":          "contraseña errónea",
+		"invalid_webhook_id":      "error con el ID del webhook dado",
+		"webhook_not_found":       "webhook no encontrado",
+		"delivery_not_found":      "entrega de webhook no encontrada",
+		"webhook_url_private":     "la URL del webhook apunta a una dirección que no es pública",
+		"user_has_data":           "el usuario tiene comidas o entradas de calendario",
+		"password_breached":       "la contraseña aparece en una filtración de datos conocida",
+		"user_anonymized":         "el usuario ya ha sido anonimizado",
+		"mail_blocked":            "este correo pertenecía a un usuario borrado y todavía no se puede usar",
+		"version_mismatch":        "el usuario ha sido modificado por otra petición",
+		"if_match_required":       "se requiere la cabecera If-Match",
+		"avatar_not_found":        "avatar no encontrado",
+		"avatar_too_large":        "la imagen es demasiado grande",
+		"avatar_type_unsupported": "formato de imagen no soportado",
+		"invalid_export_id":       "error con el ID de la exportación dada",
+		"export_not_found":        "exportación no encontrada",
+		"export_not_ready":        "la exportación todavía no está lista",
+		"unauthenticated":         "la petición no indica el usuario que la hace",
+		"forbidden":               "el usuario no tiene permiso para esta operación",
+
+		"field.required":           "es obligatorio",
+		"field.min.chars":          "debe tener al menos %s caracteres",
+		"field.min.items":          "debe tener al menos %s elementos",
+		"field.max.chars":          "debe tener como mucho %s caracteres",
+		"field.max.items":          "debe tener como mucho %s elementos",
+		"field.oneof":              "debe ser uno de: %s",
+		"field.startswith":         "debe empezar por %q",
+		"field.excludes":           "contiene caracteres no permitidos",
+		"field.url":                "no es una URL válida",
+		"field.timezone":           "no es una zona horaria válida",
+		"field.bcp47_language_tag": "no es una etiqueta de idioma válida",
+		"field.invalid":            "no es válido",
+		"field.type":               "debe ser de tipo %s",
+		"field.unknown":            "no es un campo conocido",
+		"field.syntax":             "el JSON está mal formado en la posición %s",
+		"field.truncated":          "el JSON está incompleto",
+
+		"title.400": "Petición errónea",
+		"title.401": "No autenticado",
+		"title.403": "Prohibido",
+		"title.404": "No encontrado",
+		"title.405": "Método no permitido",
+		"title.409": "Conflicto",
+		"title.412": "Precondición fallida",
+		"title.413": "Contenido demasiado grande",
+		"title.415": "Tipo de contenido no soportado",
+		"title.428": "Precondición requerida",
+		"title.500": "Error interno del servidor",
+	},
+	"en": {
+		"invalid_user_id":         "the given user ID is wrong",
+		"internal_error":          "unexpected error",
+		"user_already_exists":     "this user already exists",
+		"invalid_body":            "the body sent is wrong",
+		"invalid_query":           "the search parameters are wrong",
+		"user_not_found":          "user not found",
+		"password_hashing_failed": "error hashing the password",
+		"wrong_password":          "wrong password",
+		"invalid_webhook_id":      "the given webhook ID is wrong",
+		"webhook_not_found":       "webhook not found",
+		"delivery_not_found":      "webhook delivery not found",
+		"webhook_url_private":     "the webhook URL points to an address that is not public",
+		"user_has_data":           "the user has meals or calendar entries",
+		"password_breached":       "the password appears in a known data breach",
+		"user_anonymized":         "the user has already been anonymized",
+		"mail_blocked":            "this mail belonged to a deleted user and can't be used yet",
+		"version_mismatch":        "the user was modified by another request",
+		"if_match_required":       "the If-Match header is required",
+		"avatar_not_found":        "avatar not found",
+		"avatar_too_large":        "the image is too large",
+		"avatar_type_unsupported": "unsupported image format",
+		"invalid_export_id":       "the given export ID is wrong",
+		"export_not_found":        "export not found",
+		"export_not_ready":        "the export is not ready yet",
+		"unauthenticated":         "the request does not tell the user making it",
+		"forbidden":               "the user is not allowed to do this",
+
+		"field.required":           "is required",
+		"field.min.chars":          "must have at least %s characters",
+		"field.min.items":          "must have at least %s items",
+		"field.max.chars":          "must have at most %s characters",
+		"field.max.items":          "must have at most %s items",
+		"field.oneof":              "must be one of: %s",
+		"field.startswith":         "must start with %q",
+		"field.excludes":           "contains characters that are not allowed",
+		"field.url":                "is not a valid URL",
+		"field.timezone":           "is not a valid time zone",
+		"field.bcp47_language_tag": "is not a valid language tag",
+		"field.invalid":            "is not valid",
+		"field.type":               "must be of type %s",
+		"field.unknown":            "is not a known field",
+		"field.syntax":             "malformed JSON at offset %s",
+		"field.truncated":          "the JSON is incomplete",
+
+		"title.400": "Bad Request",
+		"title.401": "Unauthorized",
+		"title.403": "Forbidden",
+		"title.404": "Not Found",
+		"title.405": "Method Not Allowed",
+		"title.409": "Conflict",
+		"title.412": "Precondition Failed",
+		"title.413": "Request Entity Too Large",
+		"title.415": "Unsupported Media Type",
+		"title.428": "Precondition Required",
+		"title.500": "Internal Server Error",
+	},
+}
+
+// Language picks the language with a catalog that best matches preferences,
+// each an Accept-Language header or a locale, the first preferred.
+func Language(preferences ...string) string {
+	_, index := language.MatchStrings(matcher, preferences...)
+	base, _ := languages[index].Base()
+	return base.String()
+}
+
+// title returns the title of status in lang, or its standard text in English
+// if the catalogs have no title for it.
+func title(lang string, status int) string {
+	if message := translate(lang, "title."+strconv.Itoa(status), ""); message != "" {
+		return message
+	}
+	return http.StatusText(status)
+}
+
+// translate returns the message of key in lang, formatted with param if it
+// takes one, or in DefaultLanguage if lang has no such message.
+func translate(lang, key, param string) string {
+	message, ok := catalogs[lang][key]
+	if !ok {
+		message = catalogs[DefaultLanguage][key]
+	}
+	if strings.Contains(message, "%") {
+		return fmt.Sprintf(message, param)
+	}
+	return message
+}
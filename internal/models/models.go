@@ -1,8 +1,252 @@
 package models
 
+import "github.com/jmoiron/sqlx/types"
+
+// TimestampLayout is the fixed width UTC layout timestamps are stored with, so
+// they sort correctly as text.
+const TimestampLayout = "2006-01-02T15:04:05.000000Z"
+
 type User struct {
-	Id       string  `db:"id" json:"id,omitempty"`
-	Name     *string `db:"name" json:"name,omitempty"`
-	Mail     string  `db:"mail" json:"mail" validate:"required,excludes= "`
-	Password string  `db:"password" json:"password" validate:"required,excludes= "`
+	Id        string  `db:"id" json:"id,omitempty"`
+	Name      *string `db:"name" json:"name,omitempty"`
+	Mail      string  `db:"mail" json:"mail" validate:"required,excludes= "`
+	Password  string  `db:"password" json:"password" validate:"required,excludes= "`
+	Locale    string  `db:"locale" json:"locale,omitempty" validate:"omitempty,bcp47_language_tag"`
+	Timezone  string  `db:"timezone" json:"timezone,omitempty" validate:"omitempty,timezone"`
+	AvatarURL string  `db:"avatar_url" json:"avatarUrl,omitempty" validate:"omitempty,uri"`
+	// DietaryPreferences are free tags, such as vegetarian or gluten_free,
+	// stored comma separated in DietaryPreferenceList.
+	DietaryPreferenceList string   `db:"dietary_preferences" json:"-"`
+	DietaryPreferences    []string `db:"-" json:"dietaryPreferences,omitempty" validate:"omitempty,max=20,dive,required,max=32,excludesall=0x2C"`
+	// CreatedAt, UpdatedAt and LastLoginAt are maintained by the service and
+	// ignored in requests.
+	CreatedAt   string  `db:"created_at" json:"createdAt,omitempty"`
+	UpdatedAt   string  `db:"updated_at" json:"updatedAt,omitempty"`
+	LastLoginAt *string `db:"last_login_at" json:"lastLoginAt,omitempty"`
+	// Version grows with every update. It is sent as the ETag of the user.
+	Version int `db:"version" json:"-"`
+}
+
+// Placeholders an anonymized user is left with. The password placeholder is not
+// a valid hash, so no password matches it.
+const (
+	AnonymizedName       = "anonymized"
+	AnonymizedMailDomain = "@anonymized.invalid"
+	AnonymizedPassword   = "!"
+)
+
+// Actor identifies who performed an operation and from where.
+type Actor struct {
+	ID        string
+	IP        string
+	UserAgent string
+	RequestID string
+}
+
+type AuditEvent struct {
+	Id        string         `db:"id" json:"id"`
+	Event     string         `db:"event" json:"event"`
+	UserId    string         `db:"user_id" json:"userId,omitempty"`
+	ActorId   string         `db:"actor_id" json:"actorId,omitempty"`
+	IP        string         `db:"ip" json:"ip,omitempty"`
+	UserAgent string         `db:"user_agent" json:"userAgent,omitempty"`
+	RequestId string         `db:"request_id" json:"requestId,omitempty"`
+	Details   types.JSONText `db:"details" json:"details"`
+	CreatedAt string         `db:"created_at" json:"createdAt"`
+	Seq       int64          `db:"seq" json:"seq"`
+	PrevHash  string         `db:"prev_hash" json:"prevHash"`
+	Hash      string         `db:"hash" json:"hash"`
+	// DetailsHash is what the chain hashes of the details, so they can be
+	// redacted later. Events recorded before it hash the details themselves.
+	DetailsHash string `db:"details_hash" json:"detailsHash,omitempty"`
+	// Redacted tells the details no longer are the ones recorded.
+	Redacted bool `db:"redacted" json:"redacted,omitempty"`
+}
+
+type AuditFilter struct {
+	UserId  string `query:"userId"`
+	ActorId string `query:"actorId"`
+	Event   string `query:"event"`
+	From    string `query:"from"`
+	To      string `query:"to"`
+	Limit   int    `query:"limit"`
+	Offset  int    `query:"offset"`
+}
+
+type AuditPage struct {
+	Events []AuditEvent `json:"events"`
+	Total  int          `json:"total"`
+	Limit  int          `json:"limit"`
+	Offset int          `json:"offset"`
+}
+
+const (
+	AuditLoginSuccess   = "login.success"
+	AuditLoginFailure   = "login.failure"
+	AuditUserCreated    = "user.created"
+	AuditUserUpdated    = "user.updated"
+	AuditUserDeleted    = "user.deleted"
+	AuditPasswordChange = "password.changed"
+	AuditUserExported   = "user.exported"
+	AuditUserAnonymized = "user.anonymized"
+)
+
+// AuditRedactedEvents is the detail of a user.anonymized event holding the
+// hash of the redacted details of each event it redacted, by event id.
+const AuditRedactedEvents = "redactedEvents"
+
+// AuditVerification is the outcome of walking the audit hash chain.
+type AuditVerification struct {
+	Valid       bool  `json:"valid"`
+	Checked     int64 `json:"checked"`
+	Checkpoints int   `json:"checkpoints"`
+	// UnverifiedCheckpoints counts the checkpoints neither checked nor held
+	// against the chain, as AUDIT_CHECKPOINT_PUBLIC_KEY is not set.
+	UnverifiedCheckpoints int    `json:"unverifiedCheckpoints,omitempty"`
+	Redacted              int64  `json:"redacted"`
+	BrokenSeq             int64  `json:"brokenSeq,omitempty"`
+	BrokenId              string `json:"brokenId,omitempty"`
+	Reason                string `json:"reason,omitempty"`
+}
+
+const (
+	EventUserCreated    = "user.created"
+	EventUserUpdated    = "user.updated"
+	EventUserDeleted    = "user.deleted"
+	EventUserAnonymized = "user.anonymized"
+)
+
+// OutboxEvent is a domain event waiting in the outbox to be dispatched.
+type OutboxEvent struct {
+	Id            int64          `db:"id"`
+	EventId       string         `db:"event_id"`
+	Type          string         `db:"type"`
+	AggregateId   string         `db:"aggregate_id"`
+	Payload       types.JSONText `db:"payload"`
+	CreatedAt     string         `db:"created_at"`
+	Attempts      int            `db:"attempts"`
+	NextAttemptAt string         `db:"next_attempt_at"`
+	LastError     string         `db:"last_error"`
+	DeliveredAt   *string        `db:"delivered_at"`
+}
+
+// UserEventData is the payload of user lifecycle events.
+type UserEventData struct {
+	Id           string  `json:"id"`
+	Name         *string `json:"name,omitempty"`
+	Mail         string  `json:"mail,omitempty"`
+	PreviousMail string  `json:"previousMail,omitempty"`
+	// DietaryPreferences of the user, for the meals service.
+	DietaryPreferences []string `json:"dietaryPreferences,omitempty"`
+	// DeletionPolicy and ReassignedTo describe what happened to the meals
+	// and calendar entries of a deleted user.
+	DeletionPolicy string `json:"deletionPolicy,omitempty"`
+	ReassignedTo   string `json:"reassignedTo,omitempty"`
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// Webhook is a subscription to user lifecycle events. The secret is only
+// returned when the webhook is created.
+type Webhook struct {
+	Id                  string   `db:"id" json:"id"`
+	URL                 string   `db:"url" json:"url"`
+	EventList           string   `db:"events" json:"-"`
+	Events              []string `db:"-" json:"events"`
+	Secret              string   `db:"secret" json:"secret,omitempty"`
+	Active              bool     `db:"active" json:"active"`
+	ConsecutiveFailures int      `db:"consecutive_failures" json:"consecutiveFailures"`
+	CreatedAt           string   `db:"created_at" json:"createdAt"`
+	DisabledAt          *string  `db:"disabled_at" json:"disabledAt,omitempty"`
+}
+
+type WebhookRequest struct {
+	URL    string   `json:"url" validate:"required,url,startswith=http"`
+	Events []string `json:"events" validate:"required,min=1,dive,oneof=* user.created user.updated user.deleted user.anonymized"`
+	Secret string   `json:"secret,omitempty" validate:"omitempty,min=16"`
+	Active *bool    `json:"active,omitempty"`
+}
+
+type WebhookDelivery struct {
+	Id             string         `db:"id" json:"id"`
+	WebhookId      string         `db:"webhook_id" json:"webhookId"`
+	EventId        string         `db:"event_id" json:"eventId"`
+	EventType      string         `db:"event_type" json:"eventType"`
+	Payload        types.JSONText `db:"payload" json:"payload"`
+	Status         string         `db:"status" json:"status"`
+	Attempts       int            `db:"attempts" json:"attempts"`
+	ResponseStatus int            `db:"response_status" json:"responseStatus"`
+	LastError      string         `db:"last_error" json:"lastError,omitempty"`
+	RedeliveryOf   string         `db:"redelivery_of" json:"redeliveryOf,omitempty"`
+	CreatedAt      string         `db:"created_at" json:"createdAt"`
+	NextAttemptAt  string         `db:"next_attempt_at" json:"nextAttemptAt,omitempty"`
+	DeliveredAt    *string        `db:"delivered_at" json:"deliveredAt,omitempty"`
+}
+
+const (
+	DeletionCascade  = "cascade"
+	DeletionReassign = "reassign"
+	DeletionBlock    = "block"
+)
+
+// DeletionPolicy decides what happens to the meals and calendar entries of a
+// deleted user. ReassignTo is the user receiving them with DeletionReassign.
+type DeletionPolicy struct {
+	Mode       string
+	ReassignTo string
+}
+
+// DeletionImpact reports the data affected by deleting a user.
+type DeletionImpact struct {
+	UserId          string `json:"userId"`
+	Policy          string `json:"policy"`
+	ReassignTo      string `json:"reassignTo,omitempty"`
+	Meals           int    `json:"meals"`
+	CalendarEntries int    `json:"calendarEntries"`
+	// Conflicts counts the entries that cannot be reassigned because the
+	// target user already has one with the same key; they are deleted.
+	Conflicts int  `json:"conflicts,omitempty"`
+	Blocked   bool `json:"blocked"`
+}
+
+const (
+	HealthOK   = "ok"
+	HealthFail = "fail"
+)
+
+// Health reports whether the service is ready, with the result of each check.
+type Health struct {
+	Status string                 `json:"status"`
+	Checks map[string]HealthCheck `json:"checks,omitempty"`
+}
+
+type HealthCheck struct {
+	Status string                 `json:"status"`
+	Error  string                 `json:"error,omitempty"`
+	Detail map[string]interface{} `json:"detail,omitempty"`
+}
+
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportDone    = "done"
+	ExportFailed  = "failed"
+)
+
+// ExportJob tracks the asynchronous generation of a user data export.
+type ExportJob struct {
+	Id          string  `db:"id" json:"id"`
+	UserId      string  `db:"user_id" json:"userId"`
+	WithCSV     bool    `db:"with_csv" json:"csv"`
+	Status      string  `db:"status" json:"status"`
+	File        string  `db:"file" json:"-"`
+	Error       string  `db:"error" json:"error,omitempty"`
+	CreatedAt   string  `db:"created_at" json:"createdAt"`
+	CompletedAt *string `db:"completed_at" json:"completedAt,omitempty"`
+	// ExpiresAt is when a finished job and its file are deleted.
+	ExpiresAt *string `db:"expires_at" json:"expiresAt,omitempty"`
 }
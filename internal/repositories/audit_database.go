@@ -0,0 +1,251 @@
+package repositories
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"github.com/jmoiron/sqlx"
+	"strconv"
+	"strings"
+	"sync"
+	"users/internal"
+	"users/internal/models"
+	"users/pkg/database"
+	"users/pkg/logging"
+)
+
+const (
+	createAuditEvent  = "INSERT INTO audit_events(id,event,user_id,actor_id,ip,user_agent,request_id,details,details_hash,created_at,seq,prev_hash,hash) VALUES (?,?,?,?,?,?,?,?,?,?,?,?,?)"
+	getAuditEvents    = "SELECT * FROM audit_events"
+	countAuditEvents  = "SELECT COUNT(*) FROM audit_events"
+	orderAuditEvents  = " ORDER BY seq DESC LIMIT ? OFFSET ?"
+	getAuditChainHead = "SELECT * FROM audit_events ORDER BY seq DESC LIMIT 1"
+	getAuditChain     = "SELECT * FROM audit_events WHERE seq > ? ORDER BY seq LIMIT ?"
+	getUnsealedEvents = "SELECT * FROM audit_events WHERE hash = '' ORDER BY seq"
+	sealAuditEvent    = "UPDATE audit_events SET prev_hash = ?, hash = ? WHERE id = ?"
+	getMailEvents     = `SELECT id FROM audit_events WHERE details_hash != '' AND redacted = 0
+		AND json_valid(details) AND lower(json_extract(details, '$.mail')) = lower(?)`
+	redactAuditEvent = "UPDATE audit_events SET details = json_set(json_remove(details, '$.mail'), '$.mailHash', ?), redacted = 1 WHERE id = ?"
+	getAuditDetails  = "SELECT details FROM audit_events WHERE id = ?"
+)
+
+// auditChainMu serializes appends so every event links to the latest head.
+var auditChainMu sync.Mutex
+
+type SQLiteAuditRepository struct {
+	db *database.Database
+	// tx is the unit of work the repository is bound to, if any.
+	tx *sqlx.Tx
+}
+
+type AuditRepository interface {
+	CreateAuditEvent(ctx context.Context, event *models.AuditEvent) error
+	GetAuditEvents(ctx context.Context, filter models.AuditFilter) ([]models.AuditEvent, int, error)
+	GetAuditChain(ctx context.Context, afterSeq int64, limit int) ([]models.AuditEvent, error)
+	GetAuditChainHead(ctx context.Context) (*models.AuditEvent, error)
+}
+
+var _ AuditRepository = (*SQLiteAuditRepository)(nil)
+
+func NewSQLiteAuditRepository(db *database.Database) *SQLiteAuditRepository {
+	return &SQLiteAuditRepository{
+		db: db,
+	}
+}
+
+// WithTx returns a copy of the repository that runs its statements in tx.
+func (r *SQLiteAuditRepository) WithTx(tx *sqlx.Tx) *SQLiteAuditRepository {
+	return &SQLiteAuditRepository{db: r.db, tx: tx}
+}
+
+func (r *SQLiteAuditRepository) conn() database.Querier {
+	return querier(r.db, r.tx)
+}
+
+// CreateAuditEvent appends the event to the hash chain: it takes the next
+// sequence number and stores the hash of its content linked to the previous one.
+// Bound to a unit of work, the event is only kept if the unit of work is.
+func (r *SQLiteAuditRepository) CreateAuditEvent(ctx context.Context, event *models.AuditEvent) (err error) {
+	ctx, cancel := r.db.Call(ctx, "audit", "CreateAuditEvent")
+	defer cancel()
+
+	event.Id = newID()
+	event.CreatedAt = now()
+	if len(event.Details) == 0 {
+		event.Details = []byte("{}")
+	}
+
+	// Transactions take the write lock as they begin, so the unit of work
+	// already holds it and no other append can take the same head.
+	if r.tx == nil {
+		auditChainMu.Lock()
+		defer auditChainMu.Unlock()
+	}
+	err = transaction(ctx, r.db, r.tx, func(tx *sqlx.Tx) error {
+		head, err := chainHead(ctx, tx)
+		if err != nil {
+			return err
+		}
+		event.Seq = head.Seq + 1
+		event.PrevHash = head.Hash
+		event.DetailsHash = AuditDetailsHash(event.Details)
+		event.Hash = AuditEventHash(event)
+
+		_, err = tx.ExecContext(ctx, createAuditEvent, event.Id, event.Event, event.UserId, event.ActorId, event.IP,
+			event.UserAgent, event.RequestId, string(event.Details), event.DetailsHash, event.CreatedAt,
+			event.Seq, event.PrevHash, event.Hash)
+		return err
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+// chainHead returns the last event of the chain, sealing events recorded
+// before the chain existed first. An empty chain returns a zero event.
+func chainHead(ctx context.Context, tx *sqlx.Tx) (*models.AuditEvent, error) {
+	head := &models.AuditEvent{}
+	if err := tx.GetContext(ctx, head, getAuditChainHead); err == sql.ErrNoRows {
+		return head, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if head.Hash != "" {
+		return head, nil
+	}
+
+	var unsealed []models.AuditEvent
+	if err := tx.SelectContext(ctx, &unsealed, getUnsealedEvents); err != nil {
+		return nil, err
+	}
+	prevHash := ""
+	for i := range unsealed {
+		unsealed[i].PrevHash = prevHash
+		unsealed[i].Hash = AuditEventHash(&unsealed[i])
+		if _, err := tx.ExecContext(ctx, sealAuditEvent, unsealed[i].PrevHash, unsealed[i].Hash, unsealed[i].Id); err != nil {
+			return nil, err
+		}
+		prevHash = unsealed[i].Hash
+	}
+	return &unsealed[len(unsealed)-1], nil
+}
+
+// AuditEventHash is the SHA-256 of the event content and the hash of the
+// previous event. Fields are length prefixed so they cannot be shifted. The
+// details are hashed through DetailsHash when the event has one.
+func AuditEventHash(event *models.AuditEvent) string {
+	details := string(event.Details)
+	if event.DetailsHash != "" {
+		details = event.DetailsHash
+	}
+	h := sha256.New()
+	for _, field := range []string{
+		strconv.FormatInt(event.Seq, 10), event.PrevHash, event.Id, event.Event, event.UserId, event.ActorId,
+		event.IP, event.UserAgent, event.RequestId, details, event.CreatedAt,
+	} {
+		h.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditDetailsHash is the SHA-256 of the details of an event.
+func AuditDetailsHash(details []byte) string {
+	sum := sha256.Sum256(details)
+	return hex.EncodeToString(sum[:])
+}
+
+// redactAuditMail replaces the mail in the details of the events that carry it
+// with its hash, as part of the transaction that erases the user, and returns
+// the hash of the redacted details of each event by its id, to be recorded in
+// the chain. Events recorded before details were hashed apart are left as they
+// are, as their redaction could not be told from tampering.
+func redactAuditMail(ctx context.Context, q database.Querier, mail, mailHash string) (map[string]string, error) {
+	var ids []string
+	if err := q.SelectContext(ctx, &ids, getMailEvents, mail); err != nil {
+		return nil, err
+	}
+	redacted := make(map[string]string, len(ids))
+	for _, id := range ids {
+		if _, err := q.ExecContext(ctx, redactAuditEvent, mailHash, id); err != nil {
+			return nil, err
+		}
+		var details string
+		if err := q.GetContext(ctx, &details, getAuditDetails, id); err != nil {
+			return nil, err
+		}
+		redacted[id] = AuditDetailsHash([]byte(details))
+	}
+	return redacted, nil
+}
+
+// GetAuditChain returns up to limit events following afterSeq in chain order.
+func (r *SQLiteAuditRepository) GetAuditChain(ctx context.Context, afterSeq int64, limit int) (events []models.AuditEvent, err error) {
+	ctx, cancel := r.db.Call(ctx, "audit", "GetAuditChain")
+	defer cancel()
+
+	if err = r.conn().SelectContext(ctx, &events, getAuditChain, afterSeq, limit); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return events, nil
+}
+
+// GetAuditChainHead returns the last event of the chain, or nil if it is empty.
+func (r *SQLiteAuditRepository) GetAuditChainHead(ctx context.Context) (*models.AuditEvent, error) {
+	ctx, cancel := r.db.Call(ctx, "audit", "GetAuditChainHead")
+	defer cancel()
+
+	head := &models.AuditEvent{}
+	if err := r.conn().GetContext(ctx, head, getAuditChainHead); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return head, nil
+}
+
+func (r *SQLiteAuditRepository) GetAuditEvents(ctx context.Context, filter models.AuditFilter) (events []models.AuditEvent, total int, err error) {
+	ctx, cancel := r.db.Call(ctx, "audit", "GetAuditEvents")
+	defer cancel()
+
+	where, args := auditWhere(filter)
+
+	if err = r.conn().GetContext(ctx, &total, countAuditEvents+where, args...); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, 0, internal.ErrSomethingWentWrong
+	}
+
+	events = []models.AuditEvent{}
+	args = append(args, filter.Limit, filter.Offset)
+	if err = r.conn().SelectContext(ctx, &events, getAuditEvents+where+orderAuditEvents, args...); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, 0, internal.ErrSomethingWentWrong
+	}
+	return events, total, nil
+}
+
+func auditWhere(filter models.AuditFilter) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	add := func(condition string, value string) {
+		if value != "" {
+			conditions = append(conditions, condition)
+			args = append(args, value)
+		}
+	}
+	add("user_id = ?", filter.UserId)
+	add("actor_id = ?", filter.ActorId)
+	add("event = ?", filter.Event)
+	add("created_at >= ?", filter.From)
+	add("created_at <= ?", filter.To)
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
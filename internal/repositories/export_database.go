@@ -0,0 +1,204 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"users/internal"
+	"users/internal/models"
+	"users/pkg/database"
+	"users/pkg/logging"
+)
+
+const (
+	countUserData = `SELECT (SELECT COUNT(*) FROM meals WHERE user_id = ?) +
+		(SELECT COUNT(*) FROM calendar WHERE user_id = ?) +
+		(SELECT COUNT(*) FROM audit_events WHERE user_id = ?)`
+	createExportJob   = "INSERT INTO export_jobs(id,user_id,with_csv,status,created_at) VALUES (?,?,?,?,?)"
+	getExportJob      = "SELECT * FROM export_jobs WHERE user_id = ? AND id = ?"
+	getUnfinishedJobs = "SELECT * FROM export_jobs WHERE status IN ('pending','running') ORDER BY created_at"
+	getExpiredJobs    = "SELECT * FROM export_jobs WHERE expires_at <= ? ORDER BY expires_at"
+	getUserExportJobs = "SELECT * FROM export_jobs WHERE user_id = ?"
+	updateExportJob   = "UPDATE export_jobs SET status = ?, file = ?, error = ?, completed_at = ?, expires_at = ? WHERE id = ?"
+	deleteExportJob   = "DELETE FROM export_jobs WHERE id = ?"
+)
+
+// userDataQueries are the tables holding data of a user, with the query used
+// to export them. Every column is exported so the export follows the schema of
+// the services owning the tables.
+var userDataQueries = map[string]string{
+	"meals":        "SELECT * FROM meals WHERE user_id = ? ORDER BY id",
+	"calendar":     "SELECT * FROM calendar WHERE user_id = ? ORDER BY date",
+	"audit_events": "SELECT id, event, actor_id, ip, user_agent, request_id, details, created_at FROM audit_events WHERE user_id = ? ORDER BY seq",
+}
+
+type SQLiteExportRepository struct {
+	db *database.Database
+	// tx is the unit of work the repository is bound to, if any.
+	tx *sqlx.Tx
+}
+
+type ExportRepository interface {
+	CountUserData(ctx context.Context, userID string) (int, error)
+	GetUserData(ctx context.Context, table, userID string) ([]map[string]interface{}, error)
+	CreateExportJob(ctx context.Context, job *models.ExportJob) error
+	GetExportJob(ctx context.Context, userID, id string) (*models.ExportJob, error)
+	GetUnfinishedExportJobs(ctx context.Context) ([]models.ExportJob, error)
+	UpdateExportJob(ctx context.Context, job *models.ExportJob) error
+	GetExpiredExportJobs(ctx context.Context, before string) ([]models.ExportJob, error)
+	GetUserExportJobs(ctx context.Context, userID string) ([]models.ExportJob, error)
+	DeleteExportJob(ctx context.Context, id string) error
+}
+
+var _ ExportRepository = (*SQLiteExportRepository)(nil)
+
+func NewSQLiteExportRepository(db *database.Database) *SQLiteExportRepository {
+	return &SQLiteExportRepository{
+		db: db,
+	}
+}
+
+// WithTx returns a copy of the repository that runs its statements in tx.
+func (r *SQLiteExportRepository) WithTx(tx *sqlx.Tx) *SQLiteExportRepository {
+	return &SQLiteExportRepository{db: r.db, tx: tx}
+}
+
+func (r *SQLiteExportRepository) conn() database.Querier {
+	return querier(r.db, r.tx)
+}
+
+// CountUserData returns how many rows an export of the user would contain.
+func (r *SQLiteExportRepository) CountUserData(ctx context.Context, userID string) (count int, err error) {
+	ctx, cancel := r.db.Call(ctx, "export", "CountUserData")
+	defer cancel()
+
+	if err = r.conn().GetContext(ctx, &count, countUserData, userID, userID, userID); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return 0, internal.ErrSomethingWentWrong
+	}
+	return count, nil
+}
+
+func (r *SQLiteExportRepository) GetUserData(ctx context.Context, table, userID string) ([]map[string]interface{}, error) {
+	ctx, cancel := r.db.Call(ctx, "export", "GetUserData")
+	defer cancel()
+
+	rows, err := r.conn().QueryxContext(ctx, userDataQueries[table], userID)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	defer rows.Close()
+
+	records := []map[string]interface{}{}
+	for rows.Next() {
+		record := map[string]interface{}{}
+		if err = rows.MapScan(record); err != nil {
+			logging.FromContext(ctx).Error("Error querying the database", "error", err)
+			return nil, internal.ErrSomethingWentWrong
+		}
+		for column, value := range record {
+			if b, ok := value.([]byte); ok {
+				record[column] = string(b)
+			}
+		}
+		if details, ok := record["details"].(string); ok && json.Valid([]byte(details)) {
+			record["details"] = json.RawMessage(details)
+		}
+		records = append(records, record)
+	}
+	if err = rows.Err(); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return records, nil
+}
+
+func (r *SQLiteExportRepository) CreateExportJob(ctx context.Context, job *models.ExportJob) (err error) {
+	ctx, cancel := r.db.Call(ctx, "export", "CreateExportJob")
+	defer cancel()
+
+	job.Id = newID()
+	job.CreatedAt = now()
+	job.Status = models.ExportPending
+	if _, err = r.conn().ExecContext(ctx, createExportJob, job.Id, job.UserId, job.WithCSV, job.Status, job.CreatedAt); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+func (r *SQLiteExportRepository) GetExportJob(ctx context.Context, userID, id string) (*models.ExportJob, error) {
+	ctx, cancel := r.db.Call(ctx, "export", "GetExportJob")
+	defer cancel()
+
+	var jobs []models.ExportJob
+	if err := r.conn().SelectContext(ctx, &jobs, getExportJob, userID, id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	if len(jobs) == 0 {
+		return nil, internal.ErrExportNotFound
+	}
+	return &jobs[0], nil
+}
+
+func (r *SQLiteExportRepository) GetUnfinishedExportJobs(ctx context.Context) ([]models.ExportJob, error) {
+	ctx, cancel := r.db.Call(ctx, "export", "GetUnfinishedExportJobs")
+	defer cancel()
+
+	var jobs []models.ExportJob
+	if err := r.conn().SelectContext(ctx, &jobs, getUnfinishedJobs); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return jobs, nil
+}
+
+func (r *SQLiteExportRepository) UpdateExportJob(ctx context.Context, job *models.ExportJob) (err error) {
+	ctx, cancel := r.db.Call(ctx, "export", "UpdateExportJob")
+	defer cancel()
+
+	if _, err = r.conn().ExecContext(ctx, updateExportJob, job.Status, job.File, job.Error, job.CompletedAt, job.ExpiresAt, job.Id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+// GetExpiredExportJobs returns the finished jobs expiring at or before the
+// given timestamp.
+func (r *SQLiteExportRepository) GetExpiredExportJobs(ctx context.Context, before string) ([]models.ExportJob, error) {
+	ctx, cancel := r.db.Call(ctx, "export", "GetExpiredExportJobs")
+	defer cancel()
+
+	var jobs []models.ExportJob
+	if err := r.conn().SelectContext(ctx, &jobs, getExpiredJobs, before); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return jobs, nil
+}
+
+func (r *SQLiteExportRepository) GetUserExportJobs(ctx context.Context, userID string) ([]models.ExportJob, error) {
+	ctx, cancel := r.db.Call(ctx, "export", "GetUserExportJobs")
+	defer cancel()
+
+	var jobs []models.ExportJob
+	if err := r.conn().SelectContext(ctx, &jobs, getUserExportJobs, userID); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return jobs, nil
+}
+
+func (r *SQLiteExportRepository) DeleteExportJob(ctx context.Context, id string) (err error) {
+	ctx, cancel := r.db.Call(ctx, "export", "DeleteExportJob")
+	defer cancel()
+
+	if _, err = r.conn().ExecContext(ctx, deleteExportJob, id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
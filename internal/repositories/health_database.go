@@ -0,0 +1,38 @@
+package repositories
+
+import (
+	"context"
+	"users/pkg/database"
+)
+
+type SQLiteHealthRepository struct {
+	db *database.Database
+}
+
+type HealthRepository interface {
+	Ping(ctx context.Context) error
+	GetDBVersion(ctx context.Context) (int, error)
+}
+
+var _ HealthRepository = (*SQLiteHealthRepository)(nil)
+
+func NewSQLiteHealthRepository(db *database.Database) *SQLiteHealthRepository {
+	return &SQLiteHealthRepository{
+		db: db,
+	}
+}
+
+func (r *SQLiteHealthRepository) Ping(ctx context.Context) error {
+	ctx, cancel := r.db.Call(ctx, "health", "Ping")
+	defer cancel()
+
+	return r.db.Conn.PingContext(ctx)
+}
+
+// GetDBVersion returns the version recorded by the last script executed.
+func (r *SQLiteHealthRepository) GetDBVersion(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return database.GetDBVersion(r.db.Conn)
+}
@@ -0,0 +1,114 @@
+package repositories
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/jmoiron/sqlx"
+	"time"
+	"users/internal"
+	"users/internal/models"
+	"users/pkg/database"
+	"users/pkg/logging"
+)
+
+const (
+	createOutboxEvent    = "INSERT INTO outbox(event_id,type,aggregate_id,payload,created_at,next_attempt_at) VALUES (?,?,?,?,?,?)"
+	getPendingEvents     = "SELECT * FROM outbox WHERE delivered_at IS NULL AND next_attempt_at <= ? ORDER BY id LIMIT ?"
+	markEventDelivered   = "UPDATE outbox SET delivered_at = ?, attempts = attempts + 1, last_error = '' WHERE id = ?"
+	markEventFailed      = "UPDATE outbox SET attempts = attempts + 1, next_attempt_at = ?, last_error = ? WHERE id = ?"
+	deleteDeliveredEvent = "DELETE FROM outbox WHERE delivered_at IS NOT NULL AND delivered_at < ?"
+	redactOutboxEvent    = "UPDATE outbox SET payload = json_remove(payload, '$.name', '$.mail', '$.previousMail', '$.dietaryPreferences') WHERE aggregate_id = ?"
+)
+
+type SQLiteOutboxRepository struct {
+	db *database.Database
+	// tx is the unit of work the repository is bound to, if any.
+	tx *sqlx.Tx
+}
+
+type OutboxRepository interface {
+	GetPendingEvents(ctx context.Context, limit int) ([]models.OutboxEvent, error)
+	MarkEventDelivered(ctx context.Context, id int64) error
+	MarkEventFailed(ctx context.Context, id int64, nextAttempt time.Time, cause string) error
+	DeleteDeliveredEvents(ctx context.Context, before time.Time) error
+}
+
+var _ OutboxRepository = (*SQLiteOutboxRepository)(nil)
+
+func NewSQLiteOutboxRepository(db *database.Database) *SQLiteOutboxRepository {
+	return &SQLiteOutboxRepository{
+		db: db,
+	}
+}
+
+// WithTx returns a copy of the repository that runs its statements in tx.
+func (r *SQLiteOutboxRepository) WithTx(tx *sqlx.Tx) *SQLiteOutboxRepository {
+	return &SQLiteOutboxRepository{db: r.db, tx: tx}
+}
+
+func (r *SQLiteOutboxRepository) conn() database.Querier {
+	return querier(r.db, r.tx)
+}
+
+// insertOutboxEvent stores an event in the outbox as part of the transaction
+// that changes the aggregate, so the event exists if and only if the change does.
+func insertOutboxEvent(ctx context.Context, q database.Querier, eventType, aggregateID string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	created := now()
+	_, err = q.ExecContext(ctx, createOutboxEvent, newID(), eventType, aggregateID, string(payload), created, created)
+	return err
+}
+
+// redactOutboxEvents removes the personal data from the events of the
+// aggregate, delivered or not, as part of the transaction that erases it.
+func redactOutboxEvents(ctx context.Context, q database.Querier, aggregateID string) error {
+	_, err := q.ExecContext(ctx, redactOutboxEvent, aggregateID)
+	return err
+}
+
+func (r *SQLiteOutboxRepository) GetPendingEvents(ctx context.Context, limit int) (events []models.OutboxEvent, err error) {
+	ctx, cancel := r.db.Call(ctx, "outbox", "GetPendingEvents")
+	defer cancel()
+
+	if err = r.conn().SelectContext(ctx, &events, getPendingEvents, now(), limit); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return events, nil
+}
+
+func (r *SQLiteOutboxRepository) MarkEventDelivered(ctx context.Context, id int64) (err error) {
+	ctx, cancel := r.db.Call(ctx, "outbox", "MarkEventDelivered")
+	defer cancel()
+
+	if _, err = r.conn().ExecContext(ctx, markEventDelivered, now(), id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+func (r *SQLiteOutboxRepository) MarkEventFailed(ctx context.Context, id int64, nextAttempt time.Time, cause string) (err error) {
+	ctx, cancel := r.db.Call(ctx, "outbox", "MarkEventFailed")
+	defer cancel()
+
+	if _, err = r.conn().ExecContext(ctx, markEventFailed, nextAttempt.UTC().Format(models.TimestampLayout), cause, id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+func (r *SQLiteOutboxRepository) DeleteDeliveredEvents(ctx context.Context, before time.Time) (err error) {
+	ctx, cancel := r.db.Call(ctx, "outbox", "DeleteDeliveredEvents")
+	defer cancel()
+
+	if _, err = r.conn().ExecContext(ctx, deleteDeliveredEvent, before.UTC().Format(models.TimestampLayout)); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
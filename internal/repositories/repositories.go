@@ -0,0 +1,41 @@
+package repositories
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"github.com/oklog/ulid/v2"
+	"math/rand"
+	"time"
+	"users/internal/models"
+	"users/pkg/database"
+)
+
+// newID returns a new ULID, sorting by creation time, for the rows the
+// repositories insert.
+func newID() string {
+	id, _ := ulid.New(ulid.Now(), ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0))
+	return id.String()
+}
+
+// now returns the current time as the repositories store it.
+func now() string {
+	return time.Now().UTC().Format(models.TimestampLayout)
+}
+
+// querier is the transaction of the unit of work a repository is bound to, if
+// any, or else the connection.
+func querier(db *database.Database, tx *sqlx.Tx) database.Querier {
+	if tx != nil {
+		return tx
+	}
+	return db.Conn
+}
+
+// transaction runs fn in a transaction committed only if fn succeeds, or in a
+// savepoint of the unit of work a repository is bound to.
+func transaction(ctx context.Context, db *database.Database, tx *sqlx.Tx, fn func(tx *sqlx.Tx) error) error {
+	if tx != nil {
+		return database.Savepoint(ctx, tx, fn)
+	}
+	return db.Transaction(ctx, fn)
+}
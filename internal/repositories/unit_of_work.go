@@ -0,0 +1,42 @@
+package repositories
+
+import (
+	"github.com/jmoiron/sqlx"
+	"users/pkg/database"
+)
+
+// UnitOfWork gives the repositories a unit of work runs its statements with,
+// all bound to its transaction: what they write is committed together or not
+// at all.
+type UnitOfWork interface {
+	Users() UserRepository
+	Audit() AuditRepository
+	Outbox() OutboxRepository
+	Webhooks() WebhookRepository
+	Exports() ExportRepository
+}
+
+type sqliteUnitOfWork struct {
+	db *database.Database
+	tx *sqlx.Tx
+}
+
+func (u sqliteUnitOfWork) Users() UserRepository {
+	return NewSQLiteUserRepository(u.db).WithTx(u.tx)
+}
+
+func (u sqliteUnitOfWork) Audit() AuditRepository {
+	return NewSQLiteAuditRepository(u.db).WithTx(u.tx)
+}
+
+func (u sqliteUnitOfWork) Outbox() OutboxRepository {
+	return NewSQLiteOutboxRepository(u.db).WithTx(u.tx)
+}
+
+func (u sqliteUnitOfWork) Webhooks() WebhookRepository {
+	return NewSQLiteWebhookRepository(u.db).WithTx(u.tx)
+}
+
+func (u sqliteUnitOfWork) Exports() ExportRepository {
+	return NewSQLiteExportRepository(u.db).WithTx(u.tx)
+}
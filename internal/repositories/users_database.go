@@ -1,92 +1,376 @@
 package repositories
 
 import (
-	"github.com/labstack/gommon/log"
-	"github.com/oklog/ulid/v2"
-	"math/rand"
-	"time"
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	"strings"
 	"users/internal"
 	"users/internal/models"
 	"users/pkg/database"
+	"users/pkg/logging"
 )
 
 const (
-	getUser     = "SELECT * FROM users WHERE id = ?"
-	getUserMail = "SELECT * FROM users WHERE mail = ?"
-	createUser  = "INSERT INTO users(id,name,mail,password) VALUES (?,?,?,?)"
-	updateUser  = "UPDATE users SET name = ?, mail = ?, password = ? WHERE id = ?"
-	deleteUser  = "DELETE FROM users WHERE id = ?"
+	getUser         = "SELECT * FROM users WHERE id = ?"
+	getUserMailByID = "SELECT mail FROM users WHERE id = ?"
+	getUserMail     = "SELECT * FROM users WHERE mail = ?"
+	createUser      = `INSERT INTO users(id,name,mail,password,locale,timezone,avatar_url,dietary_preferences,created_at,updated_at)
+		VALUES (?,?,?,?,?,?,?,?,?,?)`
+	updateUser = `UPDATE users SET name = ?, mail = ?, password = ?, locale = ?, timezone = ?, avatar_url = ?,
+		dietary_preferences = ?, version = version + 1 WHERE id = ? AND (? = 0 OR version = ?)`
+	updateLastLogin = "UPDATE users SET last_login_at = ? WHERE id = ?"
+	updateAvatarURL = "UPDATE users SET avatar_url = ?, version = version + 1 WHERE id = ?"
+	deleteUser      = "DELETE FROM users WHERE id = ? AND (? = 0 OR version = ?)"
+
+	blockErasedMail   = "INSERT OR REPLACE INTO erased_mails(mail_hash,blocked_until) VALUES (?,?)"
+	countBlockedMails = "SELECT COUNT(*) FROM erased_mails WHERE mail_hash = ? AND blocked_until > ?"
+
+	countUserMeals        = "SELECT COUNT(*) FROM meals WHERE user_id = ?"
+	countUserCalendar     = "SELECT COUNT(*) FROM calendar WHERE user_id = ?"
+	countMealConflicts    = "SELECT COUNT(*) FROM meals m WHERE m.user_id = ? AND EXISTS (SELECT 1 FROM meals t WHERE t.user_id = ? AND t.id = m.id)"
+	countCalendarConflict = "SELECT COUNT(*) FROM calendar c WHERE c.user_id = ? AND EXISTS (SELECT 1 FROM calendar t WHERE t.user_id = ? AND t.date = c.date)"
+	deleteUserMeals       = "DELETE FROM meals WHERE user_id = ?"
+	deleteUserCalendar    = "DELETE FROM calendar WHERE user_id = ?"
+	reassignUserMeals     = "UPDATE OR IGNORE meals SET user_id = ? WHERE user_id = ?"
+	reassignUserCalendar  = "UPDATE OR IGNORE calendar SET user_id = ? WHERE user_id = ?"
 )
 
 type SQLiteUserRepository struct {
 	db *database.Database
+	// tx is the unit of work the repository is bound to, if any.
+	tx *sqlx.Tx
 }
 
 type UserRepository interface {
-	GetUser(id string) (*models.User, error)
-	GetUserByMail(mail string) (*models.User, error)
-	UpdateUser(user *models.User) error
-	CreateUser(user *models.User) error
-	DeleteUser(id string) error
+	GetUser(ctx context.Context, id string) (*models.User, error)
+	GetUserByMail(ctx context.Context, mail string) (*models.User, error)
+	UpdateUser(ctx context.Context, id string, user *models.User, version int) error
+	CreateUser(ctx context.Context, user *models.User) error
+	DeleteUser(ctx context.Context, id string, policy models.DeletionPolicy, version int) (*models.DeletionImpact, error)
+	GetDeletionImpact(ctx context.Context, id string, policy models.DeletionPolicy) (*models.DeletionImpact, error)
+	AnonymizeUser(ctx context.Context, id string, user *models.User, mailHash, blockedUntil string) (map[string]string, error)
+	IsMailBlocked(ctx context.Context, mailHash string) (bool, error)
+	RecordLogin(ctx context.Context, id string) (string, error)
+	SetAvatarURL(ctx context.Context, id, avatarURL string) error
+	InTx(ctx context.Context, fn func(tx UnitOfWork) error) error
 }
 
+var _ UserRepository = (*SQLiteUserRepository)(nil)
+
 func NewSQLiteUserRepository(db *database.Database) *SQLiteUserRepository {
 	return &SQLiteUserRepository{
 		db: db,
 	}
 }
 
-func (r *SQLiteUserRepository) GetUser(id string) (user *models.User, err error) {
+// InTx runs fn as a unit of work: the repositories fn is given run all their
+// statements in one transaction, committed only if fn succeeds.
+func (r *SQLiteUserRepository) InTx(ctx context.Context, fn func(tx UnitOfWork) error) error {
+	ctx, cancel := r.db.Call(ctx, "users", "InTx")
+	defer cancel()
+
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		return fn(sqliteUnitOfWork{db: r.db, tx: tx})
+	})
+}
+
+// WithTx returns a copy of the repository that runs its statements in tx.
+func (r *SQLiteUserRepository) WithTx(tx *sqlx.Tx) *SQLiteUserRepository {
+	return &SQLiteUserRepository{db: r.db, tx: tx}
+}
+
+// conn is the transaction the repository is bound to, or else the connection,
+// tracing its statements.
+func (r *SQLiteUserRepository) conn() database.Querier {
+	if r.tx != nil {
+		return database.Traced(r.tx)
+	}
+	return database.Traced(r.db.Conn)
+}
+
+func (r *SQLiteUserRepository) GetUser(ctx context.Context, id string) (user *models.User, err error) {
+	ctx, cancel := r.db.Call(ctx, "users", "GetUser")
+	defer cancel()
+
 	var usersAux []models.User
 
-	if err = r.db.Conn.Select(&usersAux, getUser, id); err != nil {
-		log.Error(err)
+	if err = r.conn().SelectContext(ctx, &usersAux, getUser, id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
 		return user, internal.ErrSomethingWentWrong
 	}
 	if len(usersAux) == 0 {
 		return user, internal.ErrUserNotFound
 	}
 
-	return &usersAux[0], nil
+	return loadUser(&usersAux[0]), nil
 }
 
-func (r *SQLiteUserRepository) GetUserByMail(mail string) (user *models.User, err error) {
+func (r *SQLiteUserRepository) GetUserByMail(ctx context.Context, mail string) (user *models.User, err error) {
+	ctx, cancel := r.db.Call(ctx, "users", "GetUserByMail")
+	defer cancel()
+
 	var usersAux []models.User
 
-	if err = r.db.Conn.Select(&usersAux, getUserMail, mail); err != nil {
-		log.Error(err)
+	if err = r.conn().SelectContext(ctx, &usersAux, getUserMail, mail); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
 		return user, internal.ErrSomethingWentWrong
 	}
 
 	if len(usersAux) == 0 {
 		return user, internal.ErrUserNotFound
 	}
-	return &usersAux[0], nil
+	return loadUser(&usersAux[0]), nil
 }
 
-func (r *SQLiteUserRepository) UpdateUser(id string, user *models.User) (err error) {
-	if _, err = r.db.Conn.Exec(updateUser, user.Name, user.Mail, user.Password, id); err != nil {
-		log.Error(err)
-		return internal.ErrSomethingWentWrong
+// UpdateUser replaces the profile of the user. A version other than 0 must be
+// the current one, otherwise ErrVersionMismatch is returned.
+func (r *SQLiteUserRepository) UpdateUser(ctx context.Context, id string, user *models.User, version int) (err error) {
+	ctx, cancel := r.db.Call(ctx, "users", "UpdateUser")
+	defer cancel()
+
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		q := database.Traced(tx)
+		var previousMail string
+		if err := q.GetContext(ctx, &previousMail, getUserMailByID, id); err != nil {
+			return err
+		}
+		if err := execUpdateUser(ctx, q, id, user, version); err != nil {
+			return err
+		}
+		data := models.UserEventData{Id: id, Name: user.Name, Mail: user.Mail, DietaryPreferences: user.DietaryPreferences}
+		if previousMail != user.Mail {
+			data.PreviousMail = previousMail
+		}
+		return insertOutboxEvent(ctx, q, models.EventUserUpdated, id, data)
+	})
+}
+
+func (r *SQLiteUserRepository) CreateUser(ctx context.Context, user *models.User) (err error) {
+	ctx, cancel := r.db.Call(ctx, "users", "CreateUser")
+	defer cancel()
+
+	id, created := newID(), now()
+	return r.inTx(ctx, func(tx *sqlx.Tx) error {
+		q := database.Traced(tx)
+		if _, err := q.ExecContext(ctx, createUser, id, user.Name, user.Mail, user.Password, user.Locale, user.Timezone,
+			user.AvatarURL, strings.Join(user.DietaryPreferences, ","), created, created); err != nil {
+			return err
+		}
+		user.Id, user.CreatedAt, user.UpdatedAt = id, created, created
+		return insertOutboxEvent(ctx, q, models.EventUserCreated, user.Id,
+			models.UserEventData{Id: user.Id, Name: user.Name, Mail: user.Mail, DietaryPreferences: user.DietaryPreferences})
+	})
+}
+
+// RecordLogin stores the time of a successful login and returns it.
+func (r *SQLiteUserRepository) RecordLogin(ctx context.Context, id string) (string, error) {
+	ctx, cancel := r.db.Call(ctx, "users", "RecordLogin")
+	defer cancel()
+
+	loggedIn := now()
+	if _, err := r.conn().ExecContext(ctx, updateLastLogin, loggedIn, id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return "", internal.ErrSomethingWentWrong
 	}
-	return
+	return loggedIn, nil
 }
 
-func (r *SQLiteUserRepository) CreateUser(user *models.User) (err error) {
+func (r *SQLiteUserRepository) SetAvatarURL(ctx context.Context, id, avatarURL string) error {
+	ctx, cancel := r.db.Call(ctx, "users", "SetAvatarURL")
+	defer cancel()
 
-	id, _ := ulid.New(ulid.Now(), ulid.Monotonic(rand.New(rand.NewSource(time.Now().UnixNano())), 0))
-	if _, err = r.db.Conn.Exec(createUser, id.String(), user.Name, user.Mail, user.Password); err != nil {
-		log.Error(err)
+	if _, err := r.conn().ExecContext(ctx, updateAvatarURL, avatarURL, id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
 		return internal.ErrSomethingWentWrong
 	}
-	return
+	return nil
 }
 
-func (r *SQLiteUserRepository) DeleteUser(id string) (err error) {
+func execUpdateUser(ctx context.Context, q database.Querier, id string, user *models.User, version int) error {
+	result, err := q.ExecContext(ctx, updateUser, user.Name, user.Mail, user.Password, user.Locale, user.Timezone, user.AvatarURL,
+		strings.Join(user.DietaryPreferences, ","), id, version, version)
+	if err != nil {
+		return err
+	}
+	return checkVersion(result)
+}
 
-	if _, err = r.db.Conn.Exec(deleteUser, id); err != nil {
-		log.Error(err)
-		return internal.ErrSomethingWentWrong
+// checkVersion fails with ErrVersionMismatch when a statement conditioned on
+// the version of the user changed nothing.
+func checkVersion(result sql.Result) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return internal.ErrVersionMismatch
+	}
+	return nil
+}
+
+// loadUser decodes the columns stored in a different shape than returned.
+func loadUser(user *models.User) *models.User {
+	if user.DietaryPreferenceList != "" {
+		user.DietaryPreferences = strings.Split(user.DietaryPreferenceList, ",")
+	}
+	return user
+}
+
+// DeleteUser removes the user and applies the deletion policy to their meals
+// and calendar entries in the same transaction. With DeletionBlock nothing is
+// removed if the user still has data, and nothing either if version is not 0
+// nor the current one.
+func (r *SQLiteUserRepository) DeleteUser(ctx context.Context, id string, policy models.DeletionPolicy, version int) (impact *models.DeletionImpact, err error) {
+	ctx, cancel := r.db.Call(ctx, "users", "DeleteUser")
+	defer cancel()
+
+	err = r.inTx(ctx, func(tx *sqlx.Tx) error {
+		q := database.Traced(tx)
+		if impact, err = deletionImpact(ctx, q, id, policy); err != nil {
+			return err
+		}
+		if impact.Blocked {
+			return internal.ErrUserHasData
+		}
+
+		statements := []string{deleteUserMeals, deleteUserCalendar}
+		if policy.Mode == models.DeletionReassign {
+			for _, reassign := range []string{reassignUserMeals, reassignUserCalendar} {
+				if _, err := q.ExecContext(ctx, reassign, policy.ReassignTo, id); err != nil {
+					return err
+				}
+			}
+		}
+		// After reassigning, only the conflicting entries are left behind.
+		for _, statement := range statements {
+			if _, err := q.ExecContext(ctx, statement, id); err != nil {
+				return err
+			}
+		}
+		result, err := q.ExecContext(ctx, deleteUser, id, version, version)
+		if err != nil {
+			return err
+		}
+		if err = checkVersion(result); err != nil {
+			return err
+		}
+
+		data := models.UserEventData{Id: id, DeletionPolicy: policy.Mode}
+		if policy.Mode == models.DeletionReassign {
+			data.ReassignedTo = policy.ReassignTo
+		}
+		return insertOutboxEvent(ctx, q, models.EventUserDeleted, id, data)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return impact, nil
+}
+
+// AnonymizeUser replaces the personal data of the user with the given
+// placeholders, keeping its id and data, and redacts its previous mail and
+// name from the audit details, outbox events and webhook deliveries. When
+// blockedUntil is set, the hash of the previous mail is kept until then so it
+// cannot be registered again. It returns the hash of the redacted details of
+// each audit event by its id.
+func (r *SQLiteUserRepository) AnonymizeUser(ctx context.Context, id string, user *models.User, mailHash, blockedUntil string) (redacted map[string]string, err error) {
+	ctx, cancel := r.db.Call(ctx, "users", "AnonymizeUser")
+	defer cancel()
+
+	err = r.inTx(ctx, func(tx *sqlx.Tx) error {
+		q := database.Traced(tx)
+		var previousMail string
+		if err := q.GetContext(ctx, &previousMail, getUserMailByID, id); err != nil {
+			return err
+		}
+		if err := execUpdateUser(ctx, q, id, user, 0); err != nil {
+			return err
+		}
+		var err error
+		if redacted, err = redactAuditMail(ctx, q, previousMail, mailHash); err != nil {
+			return err
+		}
+		if err := redactOutboxEvents(ctx, q, id); err != nil {
+			return err
+		}
+		if err := redactDeliveries(ctx, q, id); err != nil {
+			return err
+		}
+		if blockedUntil != "" {
+			if _, err := q.ExecContext(ctx, blockErasedMail, mailHash, blockedUntil); err != nil {
+				return err
+			}
+		}
+		return insertOutboxEvent(ctx, q, models.EventUserAnonymized, id, models.UserEventData{Id: id})
+	})
+	return redacted, err
+}
+
+// IsMailBlocked tells whether the mail with the given hash belongs to a user
+// anonymized less than the blocking period ago.
+func (r *SQLiteUserRepository) IsMailBlocked(ctx context.Context, mailHash string) (bool, error) {
+	ctx, cancel := r.db.Call(ctx, "users", "IsMailBlocked")
+	defer cancel()
+
+	var count int
+	if err := r.conn().GetContext(ctx, &count, countBlockedMails, mailHash, now()); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return false, internal.ErrSomethingWentWrong
+	}
+	return count > 0, nil
+}
+
+// GetDeletionImpact reports what DeleteUser would do without changing anything.
+func (r *SQLiteUserRepository) GetDeletionImpact(ctx context.Context, id string, policy models.DeletionPolicy) (*models.DeletionImpact, error) {
+	ctx, cancel := r.db.Call(ctx, "users", "GetDeletionImpact")
+	defer cancel()
+
+	impact, err := deletionImpact(ctx, r.conn(), id, policy)
+	if err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return impact, nil
+}
+
+func deletionImpact(ctx context.Context, q sqlx.QueryerContext, id string, policy models.DeletionPolicy) (*models.DeletionImpact, error) {
+	impact := &models.DeletionImpact{UserId: id, Policy: policy.Mode}
+	if err := sqlx.GetContext(ctx, q, &impact.Meals, countUserMeals, id); err != nil {
+		return nil, err
+	}
+	if err := sqlx.GetContext(ctx, q, &impact.CalendarEntries, countUserCalendar, id); err != nil {
+		return nil, err
+	}
+
+	switch policy.Mode {
+	case models.DeletionBlock:
+		impact.Blocked = impact.Meals+impact.CalendarEntries > 0
+	case models.DeletionReassign:
+		impact.ReassignTo = policy.ReassignTo
+		var meals, calendar int
+		if err := sqlx.GetContext(ctx, q, &meals, countMealConflicts, id, policy.ReassignTo); err != nil {
+			return nil, err
+		}
+		if err := sqlx.GetContext(ctx, q, &calendar, countCalendarConflict, id, policy.ReassignTo); err != nil {
+			return nil, err
+		}
+		impact.Conflicts = meals + calendar
+	}
+	return impact, nil
+}
+
+// inTx runs fn in a transaction that is committed only if fn succeeds. On a
+// repository bound to a unit of work it runs in a savepoint of it instead.
+func (r *SQLiteUserRepository) inTx(ctx context.Context, fn func(tx *sqlx.Tx) error) (err error) {
+	if r.tx != nil {
+		err = database.Savepoint(ctx, r.tx, fn)
+	} else {
+		err = r.db.Transaction(ctx, fn)
+	}
+	if err == nil || internal.IsKnownError(err) {
+		return err
 	}
-	return
+	logging.FromContext(ctx).Error("Error querying the database", "error", err)
+	return internal.ErrSomethingWentWrong
 }
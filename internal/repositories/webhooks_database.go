@@ -0,0 +1,245 @@
+package repositories
+
+import (
+	"context"
+	"github.com/jmoiron/sqlx"
+	"strings"
+	"users/internal"
+	"users/internal/models"
+	"users/pkg/database"
+	"users/pkg/logging"
+)
+
+const (
+	createWebhook         = "INSERT INTO webhooks(id,url,events,secret,active,created_at) VALUES (?,?,?,?,?,?)"
+	getWebhooks           = "SELECT * FROM webhooks ORDER BY created_at"
+	getActiveWebhooks     = "SELECT * FROM webhooks WHERE active = 1"
+	getWebhook            = "SELECT * FROM webhooks WHERE id = ?"
+	updateWebhook         = "UPDATE webhooks SET url = ?, events = ?, secret = ?, active = ?, consecutive_failures = ?, disabled_at = ? WHERE id = ?"
+	deleteWebhook         = "DELETE FROM webhooks WHERE id = ?"
+	deleteWebhookDelivery = "DELETE FROM webhook_deliveries WHERE webhook_id = ?"
+	recordWebhookSuccess  = "UPDATE webhooks SET consecutive_failures = 0 WHERE id = ?"
+	recordWebhookFailure  = `UPDATE webhooks SET consecutive_failures = consecutive_failures + 1,
+		active = CASE WHEN consecutive_failures + 1 >= ? THEN 0 ELSE active END,
+		disabled_at = CASE WHEN consecutive_failures + 1 >= ? AND active = 1 THEN ? ELSE disabled_at END
+		WHERE id = ?`
+
+	createDelivery        = "INSERT OR IGNORE INTO webhook_deliveries(id,webhook_id,event_id,event_type,payload,redelivery_of,created_at,next_attempt_at) VALUES (?,?,?,?,?,?,?,?)"
+	getDeliveries         = "SELECT * FROM webhook_deliveries WHERE webhook_id = ? ORDER BY created_at DESC, id DESC LIMIT ? OFFSET ?"
+	getDelivery           = "SELECT * FROM webhook_deliveries WHERE webhook_id = ? AND id = ?"
+	getPendingDeliveries  = "SELECT d.* FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id WHERE w.active = 1 AND d.status = 'pending' AND d.next_attempt_at <= ? ORDER BY d.created_at LIMIT ?"
+	updateDeliveryAttempt = "UPDATE webhook_deliveries SET status = ?, attempts = ?, response_status = ?, last_error = ?, next_attempt_at = ?, delivered_at = ? WHERE id = ?"
+	redactDelivery        = `UPDATE webhook_deliveries SET payload = json_remove(payload, '$.data.name', '$.data.mail', '$.data.previousMail', '$.data.dietaryPreferences')
+		WHERE json_extract(payload, '$.aggregateId') = ?`
+)
+
+type SQLiteWebhookRepository struct {
+	db *database.Database
+	// tx is the unit of work the repository is bound to, if any.
+	tx *sqlx.Tx
+}
+
+type WebhookRepository interface {
+	CreateWebhook(ctx context.Context, webhook *models.Webhook) error
+	GetWebhooks(ctx context.Context) ([]models.Webhook, error)
+	GetActiveWebhooks(ctx context.Context) ([]models.Webhook, error)
+	GetWebhook(ctx context.Context, id string) (*models.Webhook, error)
+	UpdateWebhook(ctx context.Context, webhook *models.Webhook) error
+	DeleteWebhook(ctx context.Context, id string) error
+	RecordWebhookResult(ctx context.Context, id string, success bool, disableAfter int) error
+	CreateDelivery(ctx context.Context, delivery *models.WebhookDelivery) error
+	GetDeliveries(ctx context.Context, webhookID string, limit, offset int) ([]models.WebhookDelivery, error)
+	GetDelivery(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error)
+	GetPendingDeliveries(ctx context.Context, limit int) ([]models.WebhookDelivery, error)
+	UpdateDeliveryAttempt(ctx context.Context, delivery *models.WebhookDelivery) error
+}
+
+var _ WebhookRepository = (*SQLiteWebhookRepository)(nil)
+
+func NewSQLiteWebhookRepository(db *database.Database) *SQLiteWebhookRepository {
+	return &SQLiteWebhookRepository{
+		db: db,
+	}
+}
+
+// WithTx returns a copy of the repository that runs its statements in tx.
+func (r *SQLiteWebhookRepository) WithTx(tx *sqlx.Tx) *SQLiteWebhookRepository {
+	return &SQLiteWebhookRepository{db: r.db, tx: tx}
+}
+
+func (r *SQLiteWebhookRepository) conn() database.Querier {
+	return querier(r.db, r.tx)
+}
+
+func (r *SQLiteWebhookRepository) CreateWebhook(ctx context.Context, webhook *models.Webhook) (err error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", "CreateWebhook")
+	defer cancel()
+
+	webhook.Id = newID()
+	webhook.CreatedAt = now()
+	if _, err = r.conn().ExecContext(ctx, createWebhook, webhook.Id, webhook.URL, strings.Join(webhook.Events, ","),
+		webhook.Secret, webhook.Active, webhook.CreatedAt); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+func (r *SQLiteWebhookRepository) GetWebhooks(ctx context.Context) ([]models.Webhook, error) {
+	return r.selectWebhooks(ctx, "GetWebhooks", getWebhooks)
+}
+
+func (r *SQLiteWebhookRepository) GetActiveWebhooks(ctx context.Context) ([]models.Webhook, error) {
+	return r.selectWebhooks(ctx, "GetActiveWebhooks", getActiveWebhooks)
+}
+
+// selectWebhooks runs a query for webhooks on behalf of method.
+func (r *SQLiteWebhookRepository) selectWebhooks(ctx context.Context, method, query string, args ...interface{}) ([]models.Webhook, error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", method)
+	defer cancel()
+
+	webhooks := []models.Webhook{}
+	if err := r.conn().SelectContext(ctx, &webhooks, query, args...); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	for i := range webhooks {
+		webhooks[i].Events = strings.Split(webhooks[i].EventList, ",")
+	}
+	return webhooks, nil
+}
+
+func (r *SQLiteWebhookRepository) GetWebhook(ctx context.Context, id string) (*models.Webhook, error) {
+	webhooks, err := r.selectWebhooks(ctx, "GetWebhook", getWebhook, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(webhooks) == 0 {
+		return nil, internal.ErrWebhookNotFound
+	}
+	return &webhooks[0], nil
+}
+
+func (r *SQLiteWebhookRepository) UpdateWebhook(ctx context.Context, webhook *models.Webhook) (err error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", "UpdateWebhook")
+	defer cancel()
+
+	if _, err = r.conn().ExecContext(ctx, updateWebhook, webhook.URL, strings.Join(webhook.Events, ","), webhook.Secret,
+		webhook.Active, webhook.ConsecutiveFailures, webhook.DisabledAt, webhook.Id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+func (r *SQLiteWebhookRepository) DeleteWebhook(ctx context.Context, id string) (err error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", "DeleteWebhook")
+	defer cancel()
+
+	err = transaction(ctx, r.db, r.tx, func(tx *sqlx.Tx) error {
+		if _, err := tx.ExecContext(ctx, deleteWebhookDelivery, id); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, deleteWebhook, id)
+		return err
+	})
+	if err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+// RecordWebhookResult keeps the count of consecutive failed attempts and
+// disables the webhook once it reaches disableAfter.
+func (r *SQLiteWebhookRepository) RecordWebhookResult(ctx context.Context, id string, success bool, disableAfter int) (err error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", "RecordWebhookResult")
+	defer cancel()
+
+	if success {
+		_, err = r.conn().ExecContext(ctx, recordWebhookSuccess, id)
+	} else {
+		_, err = r.conn().ExecContext(ctx, recordWebhookFailure, disableAfter, disableAfter, now(), id)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+// CreateDelivery queues a delivery. Original deliveries are unique per webhook
+// and event, so an event handed over twice is only delivered once.
+func (r *SQLiteWebhookRepository) CreateDelivery(ctx context.Context, delivery *models.WebhookDelivery) (err error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", "CreateDelivery")
+	defer cancel()
+
+	delivery.Id = newID()
+	delivery.CreatedAt = now()
+	delivery.NextAttemptAt = delivery.CreatedAt
+	delivery.Status = models.DeliveryPending
+	if _, err = r.conn().ExecContext(ctx, createDelivery, delivery.Id, delivery.WebhookId, delivery.EventId, delivery.EventType,
+		string(delivery.Payload), delivery.RedeliveryOf, delivery.CreatedAt, delivery.NextAttemptAt); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+func (r *SQLiteWebhookRepository) GetDeliveries(ctx context.Context, webhookID string, limit, offset int) ([]models.WebhookDelivery, error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", "GetDeliveries")
+	defer cancel()
+
+	deliveries := []models.WebhookDelivery{}
+	if err := r.conn().SelectContext(ctx, &deliveries, getDeliveries, webhookID, limit, offset); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return deliveries, nil
+}
+
+func (r *SQLiteWebhookRepository) GetDelivery(ctx context.Context, webhookID, id string) (*models.WebhookDelivery, error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", "GetDelivery")
+	defer cancel()
+
+	var deliveries []models.WebhookDelivery
+	if err := r.conn().SelectContext(ctx, &deliveries, getDelivery, webhookID, id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	if len(deliveries) == 0 {
+		return nil, internal.ErrDeliveryNotFound
+	}
+	return &deliveries[0], nil
+}
+
+func (r *SQLiteWebhookRepository) GetPendingDeliveries(ctx context.Context, limit int) ([]models.WebhookDelivery, error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", "GetPendingDeliveries")
+	defer cancel()
+
+	var deliveries []models.WebhookDelivery
+	if err := r.conn().SelectContext(ctx, &deliveries, getPendingDeliveries, now(), limit); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return nil, internal.ErrSomethingWentWrong
+	}
+	return deliveries, nil
+}
+
+func (r *SQLiteWebhookRepository) UpdateDeliveryAttempt(ctx context.Context, delivery *models.WebhookDelivery) (err error) {
+	ctx, cancel := r.db.Call(ctx, "webhooks", "UpdateDeliveryAttempt")
+	defer cancel()
+
+	if _, err = r.conn().ExecContext(ctx, updateDeliveryAttempt, delivery.Status, delivery.Attempts, delivery.ResponseStatus,
+		delivery.LastError, delivery.NextAttemptAt, delivery.DeliveredAt, delivery.Id); err != nil {
+		logging.FromContext(ctx).Error("Error querying the database", "error", err)
+		return internal.ErrSomethingWentWrong
+	}
+	return
+}
+
+// redactDeliveries removes the personal data from the deliveries of the events
+// of the aggregate, as part of the transaction that erases it.
+func redactDeliveries(ctx context.Context, q database.Querier, aggregateID string) error {
+	_, err := q.ExecContext(ctx, redactDelivery, aggregateID)
+	return err
+}
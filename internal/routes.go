@@ -1,56 +1,43 @@
 package internal
 
-import (
-	"errors"
-	"fmt"
-	"github.com/labstack/echo/v4"
-	"net/http"
-)
-
 const (
-	RouteLogin  = "/login"
-	RouteUser   = "/user"
-	RouteUserID = "/user/:id"
-
-	ParamUserID = "id"
-)
-
-type ErrorResponse struct {
-	Err ErrorBody `json:"error"`
-}
-
-func (e *ErrorResponse) Error() string {
-	return fmt.Sprintf("Error %d: %s", e.Err.Status, e.Err.Message)
-}
-
-type ErrorBody struct {
-	Status  int    `json:"status"`
-	Message string `json:"message"`
-}
-
-func NewErrorResponse(c echo.Context, err error) error {
-	errResponse := &ErrorResponse{Err: errorsMap[err.Error()]}
-	if err := c.JSON(errResponse.Err.Status, errResponse); err != nil {
-		return err
-	}
-	return errResponse
-}
-
-var errorsMap = map[string]ErrorBody{
-	ErrUserIDNotPresent.Error():   {Status: http.StatusBadRequest, Message: ErrUserIDNotPresent.Error()},
-	ErrWrongBody.Error():          {Status: http.StatusBadRequest, Message: ErrWrongBody.Error()},
-	ErrHashingPassword.Error():    {Status: http.StatusBadRequest, Message: ErrHashingPassword.Error()},
-	ErrWrongPassword.Error():      {Status: http.StatusBadRequest, Message: ErrWrongPassword.Error()},
-	ErrUserNotFound.Error():       {Status: http.StatusNotFound, Message: ErrUserNotFound.Error()},
-	ErrUserAlreadyExists.Error():  {Status: http.StatusConflict, Message: ErrUserAlreadyExists.Error()},
-	ErrSomethingWentWrong.Error(): {Status: http.StatusInternalServerError, Message: ErrSomethingWentWrong.Error()},
-}
-var (
-	ErrUserIDNotPresent   = errors.New("error con el ID del usuario dado")
-	ErrSomethingWentWrong = errors.New("error inesperado")
-	ErrUserAlreadyExists  = errors.New("este usuario ya existe")
-	ErrWrongBody          = errors.New("el cuerpo enviado es erróneo")
-	ErrUserNotFound       = errors.New("usuario no encontrado")
-	ErrHashingPassword    = errors.New("error encriptando la contraseña")
-	ErrWrongPassword      = errors.New("contraseña errónea")
+	RouteLogin              = "/login"
+	RouteUser               = "/user"
+	RouteUserID             = "/user/:id"
+	RouteUserAudit          = "/user/:id/audit"
+	RouteUserDeletionImpact = "/user/:id/deletion-impact"
+	RouteUserAnonymize      = "/user/:id/anonymize"
+	RouteUserAvatar         = "/user/:id/avatar"
+	RouteAudit              = "/audit"
+
+	RouteUserExport         = "/user/:id/export"
+	RouteUserExportID       = "/user/:id/export/:exportId"
+	RouteUserExportDownload = "/user/:id/export/:exportId/download"
+
+	RouteWebhooks          = "/webhooks"
+	RouteWebhookID         = "/webhooks/:id"
+	RouteWebhookDeliveries = "/webhooks/:id/deliveries"
+	RouteWebhookRedeliver  = "/webhooks/:id/deliveries/:deliveryId/redeliver"
+
+	RouteLiveness  = "/healthz"
+	RouteReadiness = "/readyz"
+	RouteMetrics   = "/metrics"
+
+	ParamUserID     = "id"
+	ParamWebhookID  = "id"
+	ParamDeliveryID = "deliveryId"
+	ParamExportID   = "exportId"
+
+	// HeaderActorID carries the id of the user acting on behalf of the request,
+	// set by the gateway once it authenticated the caller. The service trusts
+	// it as is, so it must only be reachable through a gateway that drops the
+	// header from the requests of clients.
+	HeaderActorID = "X-User-ID"
+
+	HeaderETag        = "ETag"
+	HeaderIfMatch     = "If-Match"
+	HeaderIfNoneMatch = "If-None-Match"
+
+	HeaderAcceptLanguage  = "Accept-Language"
+	HeaderContentLanguage = "Content-Language"
 )
@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-playground/validator/v10"
+	"github.com/labstack/echo/v4"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// StrictJSONSerializer decodes request bodies as echo does, but rejects the
+// fields they have that the target does not declare.
+type StrictJSONSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (StrictJSONSerializer) Deserialize(c echo.Context, i interface{}) error {
+	decoder := json.NewDecoder(c.Request().Body)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(i)
+}
+
+// BindError turns a request body that could not be decoded into ErrWrongBody
+// detailing the field of the wrong type, the unknown field or where the JSON
+// is malformed.
+func BindError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	switch {
+	case errors.As(err, &typeErr):
+		kind := jsonKind(typeErr.Type)
+		return ErrWrongBody.Wrap(err).WithFields(FieldError{Field: typeErr.Field, Rule: "type", Param: kind, key: "field.type"})
+	case errors.As(err, &syntaxErr):
+		return ErrWrongBody.Wrap(err).WithFields(FieldError{Rule: "syntax", Param: strconv.FormatInt(syntaxErr.Offset, 10), key: "field.syntax"})
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return ErrWrongBody.Wrap(err).WithFields(FieldError{Rule: "syntax", key: "field.truncated"})
+	}
+	// The decoder reports unknown fields only in its message.
+	const unknownField = "json: unknown field "
+	for cause := err; cause != nil; cause = errors.Unwrap(cause) {
+		if strings.HasPrefix(cause.Error(), unknownField) {
+			field, _ := strconv.Unquote(strings.TrimPrefix(cause.Error(), unknownField))
+			return ErrWrongBody.Wrap(err).WithFields(FieldError{Field: field, Rule: "unknown", key: "field.unknown"})
+		}
+	}
+	return ErrWrongBody.Wrap(err)
+}
+
+// jsonKind names the JSON type a Go type is decoded from.
+func jsonKind(t reflect.Type) string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	case reflect.Struct, reflect.Map:
+		return "object"
+	}
+	return "number"
+}
+
+// NewValidator returns a validator naming fields as they are sent in JSON, so
+// the fields ValidationError reports match the request body.
+func NewValidator() *validator.Validate {
+	validate := validator.New()
+	validate.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	return validate
+}
+
+// ValidationError turns what a validator found wrong in a request body into
+// ErrWrongBody detailing every wrong field.
+func ValidationError(err error) error {
+	var errs validator.ValidationErrors
+	if !errors.As(err, &errs) {
+		return ErrWrongBody.Wrap(err)
+	}
+	fields := make([]FieldError, 0, len(errs))
+	for _, fe := range errs {
+		field := fe.Namespace()
+		if i := strings.Index(field, "."); i >= 0 {
+			field = field[i+1:]
+		}
+		fields = append(fields, FieldError{Field: field, Rule: fe.Tag(), Param: fe.Param(), key: fieldMessageKey(fe)})
+	}
+	return ErrWrongBody.WithFields(fields...)
+}
+
+// fieldMessageKey is the key in the catalogs of the message of the rule fe
+// broke, telling characters from items for rules on length.
+func fieldMessageKey(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "min", "max":
+		switch fe.Kind() {
+		case reflect.Slice, reflect.Array, reflect.Map:
+			return "field." + fe.Tag() + ".items"
+		}
+		return "field." + fe.Tag() + ".chars"
+	case "excludesall":
+		return "field.excludes"
+	case "required", "oneof", "startswith", "excludes", "url", "timezone", "bcp47_language_tag":
+		return "field." + fe.Tag()
+	}
+	return "field.invalid"
+}
@@ -0,0 +1,118 @@
+package checkpoint
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+var (
+	ErrInvalidKey       = errors.New("checkpoint key must be a base64 encoded 32 byte ed25519 seed")
+	ErrInvalidPublicKey = errors.New("checkpoint public key must be a base64 encoded 32 byte ed25519 public key")
+	ErrInvalidSignature = errors.New("checkpoint signature does not match")
+)
+
+// Checkpoint pins the head of a hash chain at a given sequence number.
+type Checkpoint struct {
+	Seq       int64  `json:"seq"`
+	Hash      string `json:"hash"`
+	CreatedAt string `json:"createdAt"`
+	Signature string `json:"signature"`
+}
+
+// ParseKey decodes a base64 ed25519 seed into a signing key.
+func ParseKey(encoded string) (ed25519.PrivateKey, error) {
+	seed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidKey
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParsePublicKey decodes a base64 ed25519 public key, the one checkpoints are
+// verified with.
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, ErrInvalidPublicKey
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// EncodePublicKey encodes the public key of a signing key as ParsePublicKey
+// reads it.
+func EncodePublicKey(key ed25519.PrivateKey) string {
+	return base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+}
+
+func (c *Checkpoint) message() []byte {
+	return []byte(strconv.FormatInt(c.Seq, 10) + "\n" + c.Hash + "\n" + c.CreatedAt)
+}
+
+// Sign fills the signature of the checkpoint.
+func (c *Checkpoint) Sign(key ed25519.PrivateKey) {
+	c.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, c.message()))
+}
+
+// Verify checks the signature of the checkpoint.
+func (c *Checkpoint) Verify(key ed25519.PublicKey) error {
+	signature, err := base64.StdEncoding.DecodeString(c.Signature)
+	if err != nil || !ed25519.Verify(key, c.message(), signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// Append writes the checkpoint as a new JSON line at the end of the file.
+func Append(path string, c Checkpoint) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(c)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ReadAll returns every checkpoint stored in the file, oldest first. A missing
+// file holds no checkpoints.
+func ReadAll(path string) ([]Checkpoint, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var checkpoints []Checkpoint
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var c Checkpoint
+		if err = json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("checkpoint line %d: %w", line, err)
+		}
+		checkpoints = append(checkpoints, c)
+	}
+	return checkpoints, scanner.Err()
+}
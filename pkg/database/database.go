@@ -1,16 +1,86 @@
 package database
 
 import (
+	"context"
 	"github.com/jmoiron/sqlx"
-	"github.com/labstack/gommon/log"
+	"golang.org/x/exp/slog"
 	_ "modernc.org/sqlite"
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
+	"users/pkg/logging"
+	"users/pkg/metrics"
 )
 
+// connectionOptions make transactions take the write lock when they begin, so
+// one that reads before writing can't fail upgrading its lock, and make them
+// wait for the lock instead of failing while another one holds it.
+const connectionOptions = "?_txlock=immediate&_pragma=busy_timeout(5000)"
+
 type Database struct {
 	Conn *sqlx.DB
+	// Timeout bounds every call made on the database for a request, 0 for none.
+	Timeout time.Duration
+}
+
+// Querier runs statements either on the connection itself or in a transaction
+// opened on it, so the same code serves both.
+type Querier interface {
+	sqlx.ExtContext
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+// WithTimeout returns the context a call on the database runs with: ctx, so
+// it is cancelled along with the request, bounded by Timeout.
+func (d *Database) WithTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if d.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d.Timeout)
+}
+
+// Call returns the context a repository method runs with, as WithTimeout
+// does, with a logger naming the method, and records how long the method took
+// once it is cancelled.
+func (d *Database) Call(ctx context.Context, repository, method string) (context.Context, context.CancelFunc) {
+	ctx, cancel := d.WithTimeout(ctx)
+	ctx = logging.WithContext(ctx, logging.FromContext(ctx).With("repository", repository, "method", method))
+	start := time.Now()
+	return ctx, func() {
+		cancel()
+		metrics.Since(metrics.QueryDuration.WithLabelValues(repository, method), start)
+	}
+}
+
+// Transaction runs fn in a transaction that is committed only if fn succeeds.
+// It is rolled back as well if ctx is done before.
+func (d *Database) Transaction(ctx context.Context, fn func(tx *sqlx.Tx) error) error {
+	tx, err := d.Conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Savepoint runs fn within a transaction already open, undoing only what fn
+// did if it fails and leaving the rest of the transaction usable.
+func Savepoint(ctx context.Context, tx *sqlx.Tx, fn func(tx *sqlx.Tx) error) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT nested"); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		_, _ = tx.ExecContext(ctx, "ROLLBACK TO nested")
+		_, _ = tx.ExecContext(ctx, "RELEASE nested")
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "RELEASE nested")
+	return err
 }
 
 func InitDB(bbddName string) *Database {
@@ -20,26 +90,50 @@ func InitDB(bbddName string) *Database {
 	db.Conn, err = SqlLiteConnect(bbddName)
 
 	if err != nil {
-		log.Error("Error connecting database: ", err)
+		slog.Error("Error connecting database", "error", err)
 	} else {
-		log.Info("Database connected")
+		slog.Info("Database connected")
 	}
 
 	return db
 }
 
-func SqlLiteConnect(bbddName string) (*sqlx.DB, error) {
+// Close closes the connection, once the statements running have finished.
+func (d *Database) Close() error {
+	return d.Conn.Close()
+}
+
+// Path is the file a database is stored in, relative to the parent of the
+// working directory.
+func Path(bbddName string) string {
 	dir, _ := os.Getwd()
-	db, err := sqlx.Connect("sqlite", filepath.Dir(dir)+bbddName)
-	numbSc, err := GetDBVersion(db)
-	if numbSc < len(scripts)-1 {
-		err = CreateScripts(db, numbSc)
+	return filepath.Dir(dir) + bbddName
+}
+
+// Version is the version of a database with every script executed.
+func Version() int {
+	return len(scripts) - 1
+}
+
+func SqlLiteConnect(bbddName string) (*sqlx.DB, error) {
+	db, err := sqlx.Connect("sqlite", Path(bbddName)+connectionOptions)
+	if err != nil {
+		return db, err
+	}
+	// The stored version is the index of the last script executed, so an
+	// existing database resumes after it.
+	next := 0
+	if numbSc, err := GetDBVersion(db); err == nil {
+		next = numbSc + 1
+	}
+	if next < len(scripts) {
+		err = CreateScripts(db, next)
 		if err != nil {
 			return db, err
 		}
 	}
 
-	log.Info("Database version :", len(scripts))
+	slog.Info("Database version", "version", Version())
 
 	db.SetMaxOpenConns(3)
 
@@ -49,19 +143,19 @@ func SqlLiteConnect(bbddName string) (*sqlx.DB, error) {
 func CreateScripts(db *sqlx.DB, numbSc int) error {
 
 	for i := numbSc; i < len(scripts); i++ {
-		log.Info("Executing script - ", i+1)
+		slog.Info("Executing script", "script", i+1)
 		_, err := db.Exec(scripts[i].Script)
 		if err != nil {
-			log.Error(err)
+			slog.Error("Error executing script", "script", i+1, "error", err)
 			return err
 		}
 		err = UpdateVersion(db, i)
 		if err != nil {
-			log.Error(err)
+			slog.Error("Error updating database version", "version", i, "error", err)
 			return err
 		}
 	}
-	log.Info("Scrips executed successfully - ", len(scripts))
+	slog.Info("Scripts executed successfully", "scripts", len(scripts))
 
 	return nil
 }
@@ -82,6 +176,5 @@ func GetDBVersion(db *sqlx.DB) (int, error) {
 }
 
 func RemoveDB(bbddName string) error {
-	dir, _ := os.Getwd()
-	return os.Remove(filepath.Dir(dir) + bbddName)
+	return os.Remove(Path(bbddName))
 }
@@ -0,0 +1,17 @@
+package database
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// FreeSpace returns the bytes available to the process on the filesystem
+// holding path.
+func FreeSpace(path string) (uint64, error) {
+	dir, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free uint64
+	err = windows.GetDiskFreeSpaceEx(dir, &free, nil, nil)
+	return free, err
+}
@@ -27,6 +27,46 @@ var scripts = []DbScript{
 		Script:      addNameToCalendars,
 		Description: "add name column to calendar",
 	},
+	{
+		Script:      auditEvents,
+		Description: "audit events table",
+	},
+	{
+		Script:      chainAuditEvents,
+		Description: "hash chain columns in audit events",
+	},
+	{
+		Script:      outbox,
+		Description: "outbox table",
+	},
+	{
+		Script:      webhooks,
+		Description: "webhooks and deliveries tables",
+	},
+	{
+		Script:      exportJobs,
+		Description: "export jobs table",
+	},
+	{
+		Script:      erasedMails,
+		Description: "erased mails table",
+	},
+	{
+		Script:      extendUserProfile,
+		Description: "add profile and timestamp columns to users",
+	},
+	{
+		Script:      addVersionToUsers,
+		Description: "add version column to users",
+	},
+	{
+		Script:      addExpiryToExportJobs,
+		Description: "add expires_at column to export jobs",
+	},
+	{
+		Script:      redactableAuditEvents,
+		Description: "add details_hash and redacted columns to audit events",
+	},
 }
 var version = `
 CREATE TABLE IF NOT EXISTS db_version (
@@ -69,3 +109,136 @@ CREATE TABLE IF NOT EXISTS calendar (
 var addNameToCalendars = `
 ALTER TABLE calendar ADD name text NOT NULL;
 `
+
+var auditEvents = `
+CREATE TABLE IF NOT EXISTS audit_events (
+	id		   text	  PRIMARY KEY,
+	event	   text	  NOT NULL,
+	user_id	   text	  NOT NULL DEFAULT '',
+	actor_id   text	  NOT NULL DEFAULT '',
+	ip		   text	  NOT NULL DEFAULT '',
+	user_agent text	  NOT NULL DEFAULT '',
+	request_id text	  NOT NULL DEFAULT '',
+	details	   text	  NOT NULL DEFAULT '{}',
+	created_at text	  NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_user_id ON audit_events (user_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_events_created_at ON audit_events (created_at);
+`
+
+var chainAuditEvents = `
+ALTER TABLE audit_events ADD seq integer NOT NULL DEFAULT 0;
+ALTER TABLE audit_events ADD prev_hash text NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD hash text NOT NULL DEFAULT '';
+
+UPDATE audit_events SET seq = rowid;
+
+CREATE UNIQUE INDEX IF NOT EXISTS audit_events_seq ON audit_events (seq);
+`
+
+var outbox = `
+CREATE TABLE IF NOT EXISTS outbox (
+	id		        integer PRIMARY KEY AUTOINCREMENT,
+	event_id	    text	NOT NULL UNIQUE,
+	type		    text	NOT NULL,
+	aggregate_id    text	NOT NULL,
+	payload		    text	NOT NULL,
+	created_at	    text	NOT NULL,
+	attempts	    integer NOT NULL DEFAULT 0,
+	next_attempt_at text	NOT NULL,
+	last_error	    text	NOT NULL DEFAULT '',
+	delivered_at    text
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending ON outbox (delivered_at, next_attempt_at);
+`
+
+var webhooks = `
+CREATE TABLE IF NOT EXISTS webhooks (
+	id		             text	 PRIMARY KEY,
+	url		             text	 NOT NULL,
+	events		         text	 NOT NULL,
+	secret		         text	 NOT NULL,
+	active		         integer NOT NULL DEFAULT 1,
+	consecutive_failures integer NOT NULL DEFAULT 0,
+	created_at	         text	 NOT NULL,
+	disabled_at	         text
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id		        text	PRIMARY KEY,
+	webhook_id	    text	NOT NULL,
+	event_id	    text	NOT NULL,
+	event_type	    text	NOT NULL,
+	payload		    text	NOT NULL,
+	status		    text	NOT NULL DEFAULT 'pending',
+	attempts	    integer NOT NULL DEFAULT 0,
+	response_status integer NOT NULL DEFAULT 0,
+	last_error	    text	NOT NULL DEFAULT '',
+	redelivery_of   text	NOT NULL DEFAULT '',
+	created_at	    text	NOT NULL,
+	next_attempt_at text	NOT NULL,
+	delivered_at    text
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event ON webhook_deliveries (webhook_id, event_id) WHERE redelivery_of = '';
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending ON webhook_deliveries (status, next_attempt_at);
+`
+
+var exportJobs = `
+CREATE TABLE IF NOT EXISTS export_jobs (
+	id		     text	 PRIMARY KEY,
+	user_id	     text	 NOT NULL,
+	with_csv     integer NOT NULL DEFAULT 0,
+	status	     text	 NOT NULL,
+	file	     text	 NOT NULL DEFAULT '',
+	error	     text	 NOT NULL DEFAULT '',
+	created_at   text	 NOT NULL,
+	completed_at text
+);
+
+CREATE INDEX IF NOT EXISTS export_jobs_user_id ON export_jobs (user_id);
+`
+
+var erasedMails = `
+CREATE TABLE IF NOT EXISTS erased_mails (
+	mail_hash	  text PRIMARY KEY,
+	blocked_until text NOT NULL
+);`
+
+// extendUserProfile adds the profile columns to users. updated_at is kept by a
+// trigger whenever a profile column is written; it uses the same fixed width
+// layout as the timestamps written by the service.
+var extendUserProfile = `
+ALTER TABLE users ADD created_at text NOT NULL DEFAULT '';
+ALTER TABLE users ADD updated_at text NOT NULL DEFAULT '';
+ALTER TABLE users ADD last_login_at text;
+ALTER TABLE users ADD locale text NOT NULL DEFAULT '';
+ALTER TABLE users ADD timezone text NOT NULL DEFAULT '';
+ALTER TABLE users ADD avatar_url text NOT NULL DEFAULT '';
+ALTER TABLE users ADD dietary_preferences text NOT NULL DEFAULT '';
+
+CREATE TRIGGER IF NOT EXISTS users_updated_at
+AFTER UPDATE OF name, mail, password, locale, timezone, avatar_url, dietary_preferences ON users
+BEGIN
+	UPDATE users SET updated_at = strftime('%Y-%m-%dT%H:%M:%f000Z', 'now') WHERE id = NEW.id;
+END;
+`
+
+var addVersionToUsers = `
+ALTER TABLE users ADD version integer NOT NULL DEFAULT 1;
+`
+
+var addExpiryToExportJobs = `
+ALTER TABLE export_jobs ADD expires_at text;
+
+CREATE INDEX IF NOT EXISTS export_jobs_expires_at ON export_jobs (expires_at);
+`
+
+// redactableAuditEvents lets the details of an audit event be redacted without
+// breaking the chain: events chain the hash of their details, kept apart.
+var redactableAuditEvents = `
+ALTER TABLE audit_events ADD details_hash text NOT NULL DEFAULT '';
+ALTER TABLE audit_events ADD redacted integer NOT NULL DEFAULT 0;
+`
@@ -0,0 +1,65 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"github.com/jmoiron/sqlx"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"strings"
+	"users/pkg/tracing"
+)
+
+// tracedQuerier traces every statement run on a Querier as a span.
+type tracedQuerier struct {
+	Querier
+}
+
+// Traced wraps q so every statement run on it is traced as a child span of
+// the one in the context it is given.
+func Traced(q Querier) Querier {
+	return tracedQuerier{Querier: q}
+}
+
+func startStatement(ctx context.Context, query string) (context.Context, trace.Span) {
+	operation := strings.ToUpper(strings.SplitN(strings.TrimSpace(query), " ", 2)[0])
+	return tracing.Start(ctx, operation, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		semconv.DBSystemSqlite, semconv.DBOperationKey.String(operation), semconv.DBStatementKey.String(query)))
+}
+
+func (q tracedQuerier) ExecContext(ctx context.Context, query string, args ...interface{}) (result sql.Result, err error) {
+	ctx, span := startStatement(ctx, query)
+	defer func() { tracing.End(span, err) }()
+	return q.Querier.ExecContext(ctx, query, args...)
+}
+
+func (q tracedQuerier) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	ctx, span := startStatement(ctx, query)
+	defer func() { tracing.End(span, err) }()
+	return q.Querier.QueryContext(ctx, query, args...)
+}
+
+func (q tracedQuerier) QueryxContext(ctx context.Context, query string, args ...interface{}) (rows *sqlx.Rows, err error) {
+	ctx, span := startStatement(ctx, query)
+	defer func() { tracing.End(span, err) }()
+	return q.Querier.QueryxContext(ctx, query, args...)
+}
+
+func (q tracedQuerier) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	ctx, span := startStatement(ctx, query)
+	row := q.Querier.QueryRowxContext(ctx, query, args...)
+	tracing.End(span, row.Err())
+	return row
+}
+
+func (q tracedQuerier) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	ctx, span := startStatement(ctx, query)
+	defer func() { tracing.End(span, err) }()
+	return q.Querier.GetContext(ctx, dest, query, args...)
+}
+
+func (q tracedQuerier) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	ctx, span := startStatement(ctx, query)
+	defer func() { tracing.End(span, err) }()
+	return q.Querier.SelectContext(ctx, dest, query, args...)
+}
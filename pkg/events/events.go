@@ -0,0 +1,51 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Event is the envelope delivered to sinks. ID is stable across retries so
+// consumers can discard duplicates.
+type Event struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	AggregateID string          `json:"aggregateId"`
+	CreatedAt   string          `json:"createdAt"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// Sink delivers events to an external system. Send must return an error
+// unless the event was accepted, as delivery is retried on failure.
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, event Event) error
+}
+
+// WriterSink writes every event as a JSON line, e.g. to stdout.
+type WriterSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+func (s *WriterSink) Name() string {
+	return "stdout"
+}
+
+func (s *WriterSink) Send(_ context.Context, event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = fmt.Fprintf(s.w, "%s\n", line)
+	return err
+}
@@ -0,0 +1,145 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testEvent = Event{
+	ID:          "01H00Q44V18CKXHMY7FEJ2876S",
+	Type:        "user.created",
+	AggregateID: "01FN3EEB2NVFJAHAPU00000001",
+	CreatedAt:   "2023-05-01T10:00:00.000000Z",
+	Data:        json.RawMessage(`{"id":"01FN3EEB2NVFJAHAPU00000001","mail":"firstuser@mail.com"}`),
+}
+
+func TestWriterSink(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.NoError(t, NewWriterSink(out).Send(context.Background(), testEvent))
+
+	var written Event
+	require.NoError(t, json.Unmarshal(out.Bytes(), &written))
+	assert.Equal(t, testEvent, written)
+	assert.True(t, strings.HasSuffix(out.String(), "\n"))
+}
+
+func TestHTTPSink(t *testing.T) {
+	status := http.StatusAccepted
+	var received Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, testEvent.ID, r.Header.Get(HeaderEventID))
+		assert.Equal(t, testEvent.Type, r.Header.Get(HeaderEventType))
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	sink := NewHTTPSink(server.URL)
+	require.NoError(t, sink.Send(context.Background(), testEvent))
+	assert.Equal(t, testEvent, received)
+
+	status = http.StatusInternalServerError
+	assert.Error(t, sink.Send(context.Background(), testEvent))
+}
+
+// fakeNATS accepts one connection and answers the subset of the protocol
+// used by NATSSink, forwarding every published message and the options the
+// client connected with.
+func fakeNATS(t *testing.T, published chan<- string, connected chan<- string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		_, _ = io.WriteString(conn, "INFO {\"server_id\":\"test\",\"max_payload\":1048576}\r\n")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			fields := strings.Fields(line)
+			switch fields[0] {
+			case "PUB":
+				size, _ := strconv.Atoi(fields[len(fields)-1])
+				payload := make([]byte, size+2)
+				if _, err = io.ReadFull(reader, payload); err != nil {
+					return
+				}
+				published <- fields[1] + " " + string(payload[:size])
+			case "CONNECT":
+				if connected != nil {
+					connected <- strings.TrimSpace(strings.TrimPrefix(line, "CONNECT"))
+				}
+			case "PING":
+				_, _ = io.WriteString(conn, "PONG\r\n")
+			}
+		}
+	}()
+	return "nats://" + listener.Addr().String()
+}
+
+func TestNATSSink(t *testing.T) {
+	published := make(chan string, 2)
+	sink := NewNATSSink(fakeNATS(t, published, nil), "users")
+	defer sink.Close()
+
+	require.NoError(t, sink.Send(context.Background(), testEvent))
+	require.NoError(t, sink.Send(context.Background(), testEvent))
+
+	for i := 0; i < 2; i++ {
+		message := <-published
+		assert.True(t, strings.HasPrefix(message, "users.user.created {"), message)
+	}
+}
+
+func TestNATSSinkCredentials(t *testing.T) {
+	published, connected := make(chan string, 1), make(chan string, 1)
+	address := fakeNATS(t, published, connected)
+	sink := NewNATSSink(strings.Replace(address, "nats://", "nats://events:s3cret@", 1), "users")
+	defer sink.Close()
+
+	require.NoError(t, sink.Send(context.Background(), testEvent))
+	var options struct {
+		User     string `json:"user"`
+		Password string `json:"pass"`
+		Name     string `json:"name"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(<-connected), &options))
+	assert.Equal(t, "events", options.User)
+	assert.Equal(t, "s3cret", options.Password)
+	assert.Equal(t, "users", options.Name)
+	assert.True(t, strings.HasPrefix(<-published, "users.user.created {"))
+}
+
+func TestNATSReconnectDelay(t *testing.T) {
+	assert.Equal(t, natsReconnectMinDelay, natsReconnectDelay(1))
+	assert.Equal(t, 2*natsReconnectMinDelay, natsReconnectDelay(2))
+	assert.Equal(t, 8*natsReconnectMinDelay, natsReconnectDelay(4))
+	assert.Equal(t, natsReconnectMaxDelay, natsReconnectDelay(100))
+}
+
+func TestNATSSinkUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	assert.Error(t, NewNATSSink(address, "").Send(context.Background(), testEvent))
+}
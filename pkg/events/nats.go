@@ -0,0 +1,116 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/exp/slog"
+	"sync"
+	"time"
+)
+
+const (
+	natsTimeout           = 5 * time.Second
+	natsReconnectMinDelay = 250 * time.Millisecond
+	natsReconnectMaxDelay = 30 * time.Second
+)
+
+// NATSSink publishes every event on "<prefix>.<event type>" with the NATS
+// client. The URL may carry a user and password or a token, and a tls://
+// URL, or a server asking for it, upgrades the connection to TLS; options
+// add credentials files or CAs. A lost connection is reconnected with
+// exponential backoff, and Send flushes so it only returns once the server
+// has processed the event.
+type NATSSink struct {
+	URL     string
+	Prefix  string
+	Options []nats.Option
+
+	mu   sync.Mutex
+	conn *nats.Conn
+}
+
+// NewNATSSink accepts a nats:// or tls:// URL, or a bare host:port address.
+func NewNATSSink(url, prefix string, options ...nats.Option) *NATSSink {
+	return &NATSSink{URL: url, Prefix: prefix, Options: options}
+}
+
+func (s *NATSSink) Name() string {
+	return "nats"
+}
+
+func (s *NATSSink) Send(ctx context.Context, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	subject := event.Type
+	if s.Prefix != "" {
+		subject = s.Prefix + "." + subject
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.connect(); err != nil {
+		return err
+	}
+	if err = s.conn.Publish(subject, payload); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, natsTimeout)
+	defer cancel()
+	return s.conn.FlushWithContext(ctx)
+}
+
+// connect connects to the server the first time, and again once the client
+// gave up reconnecting. A server down at first is tried again on the next
+// Send.
+func (s *NATSSink) connect() error {
+	if s.conn != nil && !s.conn.IsClosed() {
+		return nil
+	}
+	options := append([]nats.Option{
+		nats.Name("users"),
+		nats.Timeout(natsTimeout),
+		nats.MaxReconnects(-1),
+		nats.CustomReconnectDelay(natsReconnectDelay),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("Disconnected from NATS, reconnecting", "error", err)
+			}
+		}),
+		nats.ReconnectHandler(func(conn *nats.Conn) {
+			slog.Info("Reconnected to NATS", "server", conn.ConnectedUrlRedacted())
+		}),
+	}, s.Options...)
+	conn, err := nats.Connect(s.URL, options...)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// natsReconnectDelay doubles the wait between reconnection attempts up to
+// natsReconnectMaxDelay.
+func natsReconnectDelay(attempts int) time.Duration {
+	delay := natsReconnectMinDelay
+	for i := 1; i < attempts && delay < natsReconnectMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > natsReconnectMaxDelay {
+		return natsReconnectMaxDelay
+	}
+	return delay
+}
+
+// Close drops the connection to the server.
+func (s *NATSSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.conn = nil
+	return nil
+}
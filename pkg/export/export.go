@@ -0,0 +1,112 @@
+package export
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// File is a named part of an export. Records are written as a JSON array and,
+// when CSV is requested, as a CSV table with one column per key.
+type File struct {
+	Name    string
+	Records []map[string]interface{}
+}
+
+// WriteZip writes every file as <name>.json, plus <name>.csv if withCSV, to a
+// ZIP archive.
+func WriteZip(w io.Writer, files []File, withCSV bool) error {
+	archive := zip.NewWriter(w)
+	modified := time.Now()
+	for _, file := range files {
+		if err := writeEntry(archive, file.Name+".json", modified, func(w io.Writer) error {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(file.Records)
+		}); err != nil {
+			return err
+		}
+		if !withCSV {
+			continue
+		}
+		if err := writeEntry(archive, file.Name+".csv", modified, func(w io.Writer) error {
+			return writeCSV(w, file.Records)
+		}); err != nil {
+			return err
+		}
+	}
+	return archive.Close()
+}
+
+func writeEntry(archive *zip.Writer, name string, modified time.Time, write func(w io.Writer) error) error {
+	entry, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	return write(entry)
+}
+
+func writeCSV(w io.Writer, records []map[string]interface{}) error {
+	columns := map[string]bool{}
+	for _, record := range records {
+		for column := range record {
+			columns[column] = true
+		}
+	}
+	header := make([]string, 0, len(columns))
+	for column := range columns {
+		header = append(header, column)
+	}
+	sort.Strings(header)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+	row := make([]string, len(header))
+	for _, record := range records {
+		for i, column := range header {
+			row[i] = csvValue(record[column])
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return escapeFormula(v)
+	case *string:
+		if v == nil {
+			return ""
+		}
+		return escapeFormula(*v)
+	case []byte:
+		return escapeFormula(string(v))
+	case json.RawMessage:
+		return escapeFormula(string(v))
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// escapeFormula prefixes with a quote the text a spreadsheet would run as a
+// formula, so values entered by users can't run when the CSV is opened.
+// Numbers are written as they are.
+func escapeFormula(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
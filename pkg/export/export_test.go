@@ -0,0 +1,90 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"testing"
+)
+
+var formula = "@SUM(A1)"
+
+var testFiles = []File{
+	{Name: "profile", Records: []map[string]interface{}{{"id": "01FN3EEB2NVFJAHAPU00000001", "name": "firstuser", "kcal": 2000}}},
+	{Name: "meals", Records: []map[string]interface{}{
+		{"id": "1", "name": "=HYPERLINK(\"http://evil\")", "kcal": -5},
+		{"id": "2", "name": "+1", "description": &formula},
+		{"id": "3", "name": "-2", "description": json.RawMessage(`{"a":1}`), "image": (*string)(nil)},
+	}},
+}
+
+// readZip returns the content of every entry of the archive by name.
+func readZip(t *testing.T, data []byte) map[string][]byte {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	entries := map[string][]byte{}
+	for _, file := range archive.File {
+		entry, err := file.Open()
+		require.NoError(t, err)
+		entries[file.Name], err = io.ReadAll(entry)
+		require.NoError(t, err)
+		require.NoError(t, entry.Close())
+	}
+	return entries
+}
+
+func TestWriteZip(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.NoError(t, WriteZip(out, testFiles, false))
+
+	entries := readZip(t, out.Bytes())
+	assert.Len(t, entries, 2)
+	var profile []map[string]interface{}
+	require.NoError(t, json.Unmarshal(entries["profile.json"], &profile))
+	assert.Equal(t, []map[string]interface{}{{"id": "01FN3EEB2NVFJAHAPU00000001", "name": "firstuser", "kcal": float64(2000)}}, profile)
+	var meals []map[string]interface{}
+	require.NoError(t, json.Unmarshal(entries["meals.json"], &meals))
+	assert.Len(t, meals, 3)
+	assert.Equal(t, "=HYPERLINK(\"http://evil\")", meals[0]["name"], "JSON keeps the values as they are")
+}
+
+func TestWriteZipCSV(t *testing.T) {
+	out := &bytes.Buffer{}
+	require.NoError(t, WriteZip(out, testFiles, true))
+
+	entries := readZip(t, out.Bytes())
+	assert.Len(t, entries, 4)
+	profile, err := csv.NewReader(bytes.NewReader(entries["profile.csv"])).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"id", "kcal", "name"}, {"01FN3EEB2NVFJAHAPU00000001", "2000", "firstuser"}}, profile)
+
+	meals, err := csv.NewReader(bytes.NewReader(entries["meals.csv"])).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"description", "id", "image", "kcal", "name"},
+		{"", "1", "", "-5", "'=HYPERLINK(\"http://evil\")"},
+		{"'@SUM(A1)", "2", "", "", "'+1"},
+		{`{"a":1}`, "3", "", "", "'-2"},
+	}, meals)
+}
+
+func TestEscapeFormula(t *testing.T) {
+	tests := map[string]string{
+		"":          "",
+		"firstuser": "firstuser",
+		"=1+1":      "'=1+1",
+		"+1":        "'+1",
+		"-1":        "'-1",
+		"@SUM(A1)":  "'@SUM(A1)",
+		"\t=1":      "'\t=1",
+		"\r=1":      "'\r=1",
+		"a=1":       "a=1",
+	}
+	for value, expected := range tests {
+		assert.Equal(t, expected, escapeFormula(value), value)
+	}
+}
@@ -0,0 +1,28 @@
+// Package httpstatus tells the status a request is answered with to the
+// middlewares that observe it without answering errors themselves.
+package httpstatus
+
+import (
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+)
+
+// Of returns the status the request of c is answered with: the one written,
+// or, when the handler returned err without writing a response, the one the
+// error handler answers err with. Errors with a StatusCode method answer it,
+// echo errors their code unless it is a server error, and any other error 500.
+func Of(c echo.Context, err error) int {
+	if err == nil || c.Response().Committed {
+		return c.Response().Status
+	}
+	var coder interface{ StatusCode() int }
+	if errors.As(err, &coder) {
+		return coder.StatusCode()
+	}
+	var he *echo.HTTPError
+	if errors.As(err, &he) && he.Code < http.StatusInternalServerError {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
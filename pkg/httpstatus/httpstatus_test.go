@@ -0,0 +1,41 @@
+package httpstatus
+
+import (
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type coded int
+
+func (c coded) Error() string   { return "coded" }
+func (c coded) StatusCode() int { return int(c) }
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		written  int
+		expected int
+	}{
+		{name: "[001] Response written (ok)", written: http.StatusCreated, expected: http.StatusCreated},
+		{name: "[002] Response written before the error (ok)", err: errors.New("failed"), written: http.StatusOK, expected: http.StatusOK},
+		{name: "[003] Error with a status (ok)", err: fmt.Errorf("wrapped: %w", coded(http.StatusConflict)), expected: http.StatusConflict},
+		{name: "[004] Echo client error (ok)", err: echo.ErrNotFound, expected: http.StatusNotFound},
+		{name: "[005] Echo server error (ok)", err: echo.ErrServiceUnavailable, expected: http.StatusInternalServerError},
+		{name: "[006] Any other error (ok)", err: errors.New("failed"), expected: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+			if tt.written != 0 {
+				assert.NoError(t, c.NoContent(tt.written))
+			}
+			assert.Equal(t, tt.expected, Of(c, tt.err))
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// withOrientation inserts an EXIF segment with the given orientation in a JPEG.
+func withOrientation(jpg []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08\x00\x01")
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3)
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(append(tiff, entry...), 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	header := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(header[2:], uint16(len(segment)+2))
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(append(out, header...), segment...)
+	return append(out, jpg[2:]...)
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	out := &bytes.Buffer{}
+	require.NoError(t, jpeg.Encode(out, img, nil))
+	return out.Bytes()
+}
+
+func TestOrientation(t *testing.T) {
+	jpg := encodeJPEG(t, image.NewRGBA(image.Rect(0, 0, 4, 2)))
+	assert.Equal(t, 1, Orientation(jpg))
+	assert.Equal(t, 6, Orientation(withOrientation(jpg, 6)))
+	assert.Equal(t, 1, Orientation(withOrientation(jpg, 42)))
+	assert.Equal(t, 1, Orientation([]byte("not a jpeg")))
+}
+
+func TestOrient(t *testing.T) {
+	// 2x1 image: red on the left, blue on the right.
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	img.Set(0, 0, red)
+	img.Set(1, 0, blue)
+
+	tests := []struct {
+		orientation int
+		width       int
+		first       color.RGBA
+	}{
+		{orientation: 1, width: 2, first: red},
+		{orientation: 2, width: 2, first: blue},
+		{orientation: 3, width: 2, first: blue},
+		{orientation: 6, width: 1, first: red},
+		{orientation: 8, width: 1, first: blue},
+	}
+	for _, tt := range tests {
+		oriented := Orient(img, tt.orientation)
+		assert.Equal(t, tt.width, oriented.Bounds().Dx(), "orientation %d", tt.orientation)
+		assert.Equal(t, tt.first, color.RGBAModel.Convert(oriented.At(0, 0)), "orientation %d", tt.orientation)
+	}
+}
+
+func TestThumbnails(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 200; y++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), A: 255})
+		}
+	}
+	source := encodeJPEG(t, img)
+	thumbnails, err := Thumbnails(withOrientation(source, 6), 64, 256)
+	require.NoError(t, err)
+	require.Len(t, thumbnails, 2)
+	for size, thumbnail := range thumbnails {
+		assert.NotContains(t, string(thumbnail), "Exif", "metadata is stripped")
+		decoded, format, err := image.Decode(bytes.NewReader(thumbnail))
+		require.NoError(t, err)
+		assert.Equal(t, "jpeg", format)
+		assert.Equal(t, image.Rect(0, 0, size, size), decoded.Bounds())
+	}
+
+	transparent := &bytes.Buffer{}
+	require.NoError(t, png.Encode(transparent, image.NewNRGBA(image.Rect(0, 0, 10, 10))))
+	thumbnails, err = Thumbnails(transparent.Bytes(), 64)
+	require.NoError(t, err)
+	decoded, _, err := image.Decode(bytes.NewReader(thumbnails[64]))
+	require.NoError(t, err)
+	r, g, b, _ := decoded.At(32, 32).RGBA()
+	assert.True(t, r > 0xf000 && g > 0xf000 && b > 0xf000, "transparency is flattened onto white")
+
+	_, err = Thumbnails([]byte("not an image"), 64)
+	assert.Equal(t, ErrUnsupportedFormat, err)
+}
@@ -0,0 +1,129 @@
+package logging
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"github.com/oklog/ulid/v2"
+	"golang.org/x/exp/slog"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	redacted = "[REDACTED]"
+	// maxRequestIDLength bounds the request ids taken from callers.
+	maxRequestIDLength = 128
+)
+
+// secretKeys are the parts of attribute keys whose values are never logged.
+var secretKeys = []string{"password", "passwd", "token", "secret", "authorization", "cookie"}
+
+type contextKey struct{}
+
+// New returns a logger writing JSON lines to w from level on, which may be a
+// *slog.LevelVar to change it while logging. Attributes whose key names a
+// password or a token are redacted.
+func New(w io.Writer, level slog.Leveler) *slog.Logger {
+	return slog.New(slog.HandlerOptions{Level: level, ReplaceAttr: redact}.NewJSONHandler(w))
+}
+
+// ParseLevel returns the level named debug, info, warn or error, info when
+// empty or unknown.
+func ParseLevel(level string) slog.Level {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return slog.LevelInfo
+	}
+	return parsed
+}
+
+func redact(_ []string, attr slog.Attr) slog.Attr {
+	key := strings.ToLower(attr.Key)
+	for _, secret := range secretKeys {
+		if strings.Contains(key, secret) {
+			return slog.String(attr.Key, redacted)
+		}
+	}
+	return attr
+}
+
+// WithContext returns a copy of ctx carrying logger.
+func WithContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger carried by ctx, or the default one.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Middleware gives every request an id, the X-Request-ID of the caller or a
+// new one, returned in the response. The request context carries logger with
+// the id, so everything logged on behalf of the request can be correlated,
+// and the request is logged once served. It must be the outermost middleware:
+// it answers the error the request ended with, which the others only observe.
+func Middleware(logger *slog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+			id := req.Header.Get(echo.HeaderXRequestID)
+			if !validRequestID(id) {
+				id = ulid.Make().String()
+				req.Header.Set(echo.HeaderXRequestID, id)
+			}
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+			requestLogger := logger.With("requestId", id)
+			c.SetRequest(req.WithContext(WithContext(req.Context(), requestLogger)))
+
+			// The error response is written here, so its status is logged,
+			// and the error is not handled again.
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			status := c.Response().Status
+			level := slog.LevelInfo
+			if status >= http.StatusInternalServerError {
+				level = slog.LevelError
+			} else if status >= http.StatusBadRequest {
+				level = slog.LevelWarn
+			}
+			attrs := []slog.Attr{
+				slog.String("method", req.Method),
+				slog.String("route", c.Path()),
+				slog.String("path", req.URL.Path),
+				slog.Int("status", status),
+				slog.Duration("latency", time.Since(start)),
+				slog.Int64("bytesOut", c.Response().Size),
+				slog.String("remoteIp", c.RealIP()),
+				slog.String("userAgent", req.UserAgent()),
+			}
+			if err != nil {
+				attrs = append(attrs, slog.String("error", err.Error()))
+			}
+			requestLogger.LogAttrs(req.Context(), level, "Request served", attrs...)
+			return nil
+		}
+	}
+}
+
+// validRequestID tells whether a request id taken from a caller is safe to
+// log and return: short and made of letters, digits and - _ . : only.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/exp/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func lines(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestNew(t *testing.T) {
+	out := &bytes.Buffer{}
+	logger := New(out, slog.LevelWarn)
+	logger.Info("Not logged")
+	logger.Warn("Login", "mail", "user@mail.com", "password", "MyPassword.123", "accessToken", "abc", "Authorization", "Bearer abc")
+
+	records := lines(t, out)
+	require.Len(t, records, 1)
+	assert.Equal(t, "WARN", records[0]["level"])
+	assert.Equal(t, "user@mail.com", records[0]["mail"])
+	for _, key := range []string{"password", "accessToken", "Authorization"} {
+		assert.Equal(t, redacted, records[0][key], key)
+	}
+	assert.NotContains(t, out.String(), "MyPassword.123")
+
+	out.Reset()
+	level := new(slog.LevelVar)
+	logger = New(out, level)
+	logger.Debug("Not logged")
+	level.Set(slog.LevelDebug)
+	logger.Debug("Logged")
+	assert.Len(t, lines(t, out), 1, "the level can change while logging")
+}
+
+func TestParseLevel(t *testing.T) {
+	assert.Equal(t, slog.LevelDebug, ParseLevel("debug"))
+	assert.Equal(t, slog.LevelWarn, ParseLevel("WARN"))
+	assert.Equal(t, slog.LevelInfo, ParseLevel(""))
+	assert.Equal(t, slog.LevelInfo, ParseLevel("verbose"), "unknown levels fall back to info")
+}
+
+func TestMiddleware(t *testing.T) {
+	out := &bytes.Buffer{}
+	e := echo.New()
+	e.Use(Middleware(New(out, slog.LevelInfo)))
+	e.GET("/user/:id", func(c echo.Context) error {
+		FromContext(c.Request().Context()).Info("Handling")
+		if c.Param("id") == "missing" {
+			return echo.NewHTTPError(http.StatusNotFound)
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	tests := []struct {
+		name      string
+		path      string
+		requestID string
+		status    int
+		level     string
+	}{
+		{name: "[001] Propagated request id (ok)", path: "/user/1", requestID: "req-42", status: http.StatusOK, level: "INFO"},
+		{name: "[002] Generated request id (ok)", path: "/user/1", status: http.StatusOK, level: "INFO"},
+		{name: "[003] Unsafe request id replaced (ok)", path: "/user/1", requestID: "req\"42", status: http.StatusOK, level: "INFO"},
+		{name: "[004] Error response (404)", path: "/user/missing", requestID: "req-43", status: http.StatusNotFound, level: "WARN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out.Reset()
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.requestID != "" {
+				req.Header.Set(echo.HeaderXRequestID, tt.requestID)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.status, rec.Code)
+			id := rec.Header().Get(echo.HeaderXRequestID)
+			if validRequestID(tt.requestID) {
+				assert.Equal(t, tt.requestID, id)
+			} else {
+				assert.Len(t, id, 26)
+			}
+			records := lines(t, out)
+			require.Len(t, records, 2)
+			assert.Equal(t, "Handling", records[0]["msg"])
+			assert.Equal(t, "Request served", records[1]["msg"])
+			assert.Equal(t, tt.level, records[1]["level"])
+			assert.EqualValues(t, tt.status, records[1]["status"])
+			assert.Equal(t, "/user/:id", records[1]["route"])
+			for _, record := range records {
+				assert.Equal(t, id, record["requestId"])
+			}
+		})
+	}
+}
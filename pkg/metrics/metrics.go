@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"database/sql"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"strconv"
+	"time"
+	"users/pkg/httpstatus"
+)
+
+const namespace = "amc_users"
+
+var (
+	// Requests counts the requests served, by route pattern and status.
+	Requests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Requests served by route, method and status.",
+	}, []string{"route", "method", "status"})
+	// RequestDuration is the latency of the requests, by route pattern and status.
+	RequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the requests by route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	// Logins counts the login attempts, by result: success or failure.
+	Logins = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Login attempts by result.",
+	}, []string{"result"})
+	// PasswordHashDuration is the time bcrypt takes, by operation: hash or compare.
+	PasswordHashDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "password_hash_duration_seconds",
+		Help:      "Time taken by bcrypt by operation.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2, 12),
+	}, []string{"operation"})
+	// QueryDuration is the latency of the calls to the database, by
+	// repository and method.
+	QueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of the repository calls to the database by repository and method.",
+		Buckets:   prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"repository", "method"})
+)
+
+// RegisterDatabase exports the statistics of the connection pool of db and
+// the version of its schema, as returned by version.
+func RegisterDatabase(db *sql.DB, version func() (int, error)) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "users"))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "db_migration_version",
+		Help:      "Version of the database schema, the index of the last migration executed.",
+	}, func() float64 {
+		current, err := version()
+		if err != nil {
+			return -1
+		}
+		return float64(current)
+	}))
+}
+
+// Since records in observer the seconds elapsed since start.
+func Since(observer prometheus.Observer, start time.Time) {
+	observer.Observe(time.Since(start).Seconds())
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+// Middleware records the requests served and their latency. Requests are
+// labelled with the pattern of their route, so paths with ids don't make a
+// series each.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			// The error response is written by the outermost middleware, so
+			// the status it will have is recorded.
+			err := next(c)
+			status := httpstatus.Of(c, err)
+			// Echo gives unmatched requests their own path as route.
+			route := c.Path()
+			if route == "" || err == echo.ErrNotFound {
+				route = "unmatched"
+			}
+			labels := prometheus.Labels{"route": route, "method": c.Request().Method, "status": strconv.Itoa(status)}
+			Requests.With(labels).Inc()
+			Since(RequestDuration.With(labels), start)
+			return err
+		}
+	}
+}
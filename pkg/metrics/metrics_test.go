@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"database/sql"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Use(Middleware())
+	e.GET("/user/:id", func(c echo.Context) error {
+		if c.Param("id") == "fail" {
+			return errors.New("failed")
+		}
+		return c.NoContent(http.StatusOK)
+	})
+
+	for _, path := range []string{"/user/1", "/user/2", "/user/fail", "/missing"} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(Requests.WithLabelValues("/user/:id", http.MethodGet, "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(Requests.WithLabelValues("/user/:id", http.MethodGet, "500")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(Requests.WithLabelValues("unmatched", http.MethodGet, "404")))
+	assert.Equal(t, 3, testutil.CollectAndCount(RequestDuration), "a latency histogram per route and status")
+}
+
+func TestHandler(t *testing.T) {
+	db, err := sql.Open("sqlite", ":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	RegisterDatabase(db, func() (int, error) { return 7, nil })
+	QueryDuration.WithLabelValues("users", "GetUser").Observe(0.01)
+
+	e := echo.New()
+	e.GET("/metrics", Handler())
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	assert.Contains(t, body, "amc_users_db_migration_version 7")
+	assert.Contains(t, body, `go_sql_open_connections{db_name="users"}`)
+	assert.Contains(t, body, `amc_users_db_query_duration_seconds_count{method="GetUser",repository="users"} 1`)
+}
@@ -0,0 +1,171 @@
+package pwned
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	prefixLength   = 5
+	hashLength     = 40
+	defaultTimeout = 5 * time.Second
+)
+
+var ErrUnexpectedStatus = errors.New("unexpected status from range api")
+
+// Checker tells whether a password appears in a breached-password corpus.
+type Checker interface {
+	IsPwned(password string) (bool, error)
+}
+
+// NewChecker returns the checker configured by the given sources. The local
+// file takes precedence over the range API; if neither is set nil is returned.
+func NewChecker(file, apiURL string) Checker {
+	switch {
+	case file != "":
+		return NewFileChecker(file)
+	case apiURL != "":
+		return NewRangeClient(apiURL)
+	}
+	return nil
+}
+
+func hashPassword(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+// FileChecker looks passwords up in a local copy of the corpus, one
+// "HASH:COUNT" line per entry ordered by hash, as published for download.
+type FileChecker struct {
+	Path string
+}
+
+func NewFileChecker(path string) *FileChecker {
+	return &FileChecker{Path: path}
+}
+
+func (f *FileChecker) IsPwned(password string) (bool, error) {
+	file, err := os.Open(f.Path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	return searchSorted(file, info.Size(), []byte(hashPassword(password)))
+}
+
+// searchSorted runs a binary search over byte offsets of a sorted line file.
+// Every probe compares the first line starting at or after the middle offset.
+func searchSorted(r io.ReaderAt, size int64, target []byte) (bool, error) {
+	low, high := int64(0), size
+	for low < high {
+		mid := low + (high-low)/2
+		line, start, next, err := lineFrom(r, size, mid)
+		if err != nil {
+			return false, err
+		}
+		if line == nil || start >= high {
+			high = mid
+			continue
+		}
+		switch cmp := bytes.Compare(hashOf(line), target); {
+		case cmp == 0:
+			return true, nil
+		case cmp < 0:
+			low = next
+		default:
+			high = mid
+		}
+	}
+	return false, nil
+}
+
+// lineFrom returns the first line starting at or after offset together with
+// its start and end offsets. A nil line means there is no line left.
+func lineFrom(r io.ReaderAt, size, offset int64) (line []byte, start, next int64, err error) {
+	start = offset
+	if offset > 0 {
+		reader := bufio.NewReader(io.NewSectionReader(r, offset-1, size-offset+1))
+		skipped, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil, size, size, nil
+		}
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		start = offset - 1 + int64(len(skipped))
+	}
+	if start >= size {
+		return nil, size, size, nil
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(r, start, size-start))
+	line, err = reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, 0, 0, err
+	}
+	return bytes.TrimRight(line, "\r\n"), start, start + int64(len(line)), nil
+}
+
+func hashOf(line []byte) []byte {
+	if i := bytes.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	return bytes.ToUpper(line)
+}
+
+// RangeClient queries a k-anonymity range API: only the first five characters
+// of the SHA-1 hash leave the service and the suffix is matched locally.
+type RangeClient struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func NewRangeClient(baseURL string) *RangeClient {
+	return &RangeClient{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Client:  &http.Client{Timeout: defaultTimeout},
+	}
+}
+
+func (c *RangeClient) IsPwned(password string) (bool, error) {
+	hash := hashPassword(password)
+	prefix, suffix := hash[:prefixLength], hash[prefixLength:]
+
+	resp, err := c.Client.Get(c.BaseURL + "/range/" + prefix)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%w: %d", ErrUnexpectedStatus, resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts[0]) != hashLength-prefixLength {
+			continue
+		}
+		if strings.EqualFold(parts[0], suffix) {
+			// Padded responses list fake suffixes with a zero count.
+			return len(parts) == 1 || strings.TrimSpace(parts[1]) != "0", nil
+		}
+	}
+	return false, scanner.Err()
+}
@@ -0,0 +1,100 @@
+package pwned
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var breached = []string{"password", "123456", "qwerty", "MyPassword.123", "letmein", "dragon", "monkey"}
+
+func writeCorpus(t *testing.T, passwords []string) string {
+	lines := make([]string, 0, len(passwords))
+	for i, password := range passwords {
+		lines = append(lines, fmt.Sprintf("%s:%d", hashPassword(password), i*137+1))
+	}
+	sort.Strings(lines)
+
+	path := filepath.Join(t.TempDir(), "pwned-passwords.txt")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\r\n")+"\r\n"), 0o600))
+	return path
+}
+
+func TestFileChecker(t *testing.T) {
+	checker := NewFileChecker(writeCorpus(t, breached))
+
+	for _, password := range breached {
+		found, err := checker.IsPwned(password)
+		require.NoError(t, err)
+		assert.True(t, found, password)
+	}
+	for _, password := range []string{"", "Correct-Horse-Battery-Staple", "MyPassword.124"} {
+		found, err := checker.IsPwned(password)
+		require.NoError(t, err)
+		assert.False(t, found, password)
+	}
+}
+
+func TestFileCheckerSingleEntry(t *testing.T) {
+	checker := NewFileChecker(writeCorpus(t, []string{"password"}))
+
+	found, err := checker.IsPwned("password")
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = checker.IsPwned("other")
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestFileCheckerMissingFile(t *testing.T) {
+	_, err := NewFileChecker(filepath.Join(t.TempDir(), "missing.txt")).IsPwned("password")
+	assert.Error(t, err)
+}
+
+func TestRangeClient(t *testing.T) {
+	leaked, padded := hashPassword("password"), hashPassword("letmein")
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		switch r.URL.Path {
+		case "/range/" + leaked[:prefixLength]:
+			fmt.Fprintf(w, "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n%s:3861493\r\n", leaked[prefixLength:])
+		case "/range/" + padded[:prefixLength]:
+			fmt.Fprintf(w, "%s:0\r\n", padded[prefixLength:])
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	client := NewRangeClient(server.URL + "/")
+
+	found, err := client.IsPwned("password")
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	found, err = client.IsPwned("letmein")
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, err = client.IsPwned("unavailable")
+	assert.ErrorIs(t, err, ErrUnexpectedStatus)
+
+	for _, path := range requested {
+		assert.Len(t, strings.TrimPrefix(path, "/range/"), prefixLength)
+	}
+}
+
+func TestNewChecker(t *testing.T) {
+	assert.Nil(t, NewChecker("", ""))
+	assert.IsType(t, &FileChecker{}, NewChecker("corpus.txt", "http://localhost"))
+	assert.IsType(t, &RangeClient{}, NewChecker("", "http://localhost"))
+}
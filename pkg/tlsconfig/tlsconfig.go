@@ -0,0 +1,145 @@
+// Package tlsconfig builds the TLS configuration of the server: its
+// certificate, loaded again when its files change, HTTP/2 and the optional
+// verification of client certificates.
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"golang.org/x/exp/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Client authentication modes: none asks for no client certificate, verify
+// verifies the ones given and require rejects connections without one.
+const (
+	ClientAuthNone    = "none"
+	ClientAuthVerify  = "verify"
+	ClientAuthRequire = "require"
+)
+
+var ErrNoClientCA = errors.New("tlsconfig: client certificates need a CA to verify them")
+
+// CertReloader serves the certificate of a pair of PEM files, loaded again by
+// Reload when either changes, so renewed certificates are used without a
+// restart.
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	stamp [2]fileStamp
+}
+
+// fileStamp tells a file apart from its previous versions.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertReloader loads the certificate of certFile and keyFile.
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the certificate loaded last, as tls.Config asks it
+// on every handshake.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// Reload loads the certificate again if its files changed, telling whether
+// it did. A pair that does not load, such as one caught halfway through
+// being replaced, is not used and is tried again once the files change
+// again.
+func (r *CertReloader) Reload() (bool, error) {
+	stamp := [2]fileStamp{stampOf(r.certFile), stampOf(r.keyFile)}
+	r.mu.RLock()
+	unchanged := r.cert != nil && stamp == r.stamp
+	r.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stamp = stamp
+	if err != nil {
+		return false, fmt.Errorf("tlsconfig: loading %s: %w", r.certFile, err)
+	}
+	r.cert = &cert
+	return true, nil
+}
+
+// Run reloads the certificate every interval until ctx is done.
+func (r *CertReloader) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				slog.Error("Error reloading TLS certificate, keeping the current one", "error", err)
+			} else if reloaded {
+				slog.Info("TLS certificate reloaded", "file", r.certFile)
+			}
+		}
+	}
+}
+
+func stampOf(path string) fileStamp {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}
+}
+
+// Server returns the configuration of a server presenting the certificate of
+// certs, offering HTTP/2, and verifying client certificates against the PEM
+// CAs of clientCAFile as clientAuth asks.
+func Server(certs *CertReloader, clientAuth, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	switch clientAuth {
+	case "", ClientAuthNone:
+		return config, nil
+	case ClientAuthVerify:
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("tlsconfig: unknown client authentication %q", clientAuth)
+	}
+	if clientCAFile == "" {
+		return nil, ErrNoClientCA
+	}
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = x509.NewCertPool()
+	if !config.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tlsconfig: no certificate in %s", clientCAFile)
+	}
+	return config, nil
+}
@@ -0,0 +1,224 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// authority is a certificate and its key, self-signed when it is a CA.
+type authority struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// issue generates a certificate for name signed by ca, or self-signed when
+// ca is nil. Self-signed certificates are CAs, so they can be trusted.
+func issue(t *testing.T, ca *authority, name string) *authority {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, signer := template, key
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+	} else {
+		parent, signer = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &authority{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+func (a *authority) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(a.key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (a *authority) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(a.pem, a.keyPEM(t))
+	require.NoError(t, err)
+	return cert
+}
+
+// writePair writes the certificate and key of a to files in dir, dated at
+// modTime so changes are told apart within the resolution of the clock.
+func writePair(t *testing.T, dir string, a *authority, modTime time.Time) (string, string) {
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	require.NoError(t, os.WriteFile(certFile, a.pem, 0o600))
+	require.NoError(t, os.WriteFile(keyFile, a.keyPEM(t), 0o600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return certFile, keyFile
+}
+
+// serve serves over TLS with config as main does, answering the protocol
+// of the request, and returns the address.
+func serve(t *testing.T, config *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, r.Proto)
+		}),
+		TLSConfig: config,
+	}
+	go func() { _ = server.Serve(tls.NewListener(listener, config)) }()
+	t.Cleanup(func() { _ = server.Close() })
+	return "https://" + listener.Addr().String()
+}
+
+// get asks address, presenting cert if given even when the server does not
+// list its CA, as Certificates would skip it.
+func get(address string, roots *x509.CertPool, cert *tls.Certificate) (string, error) {
+	presented := &tls.Certificate{}
+	if cert != nil {
+		presented = cert
+	}
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs: roots,
+				GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+					return presented, nil
+				},
+			},
+			ForceAttemptHTTP2: true,
+		},
+	}
+	resp, err := client.Get(address)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestServerHTTP2(t *testing.T) {
+	server := issue(t, nil, "localhost")
+	certs, err := NewCertReloader(writePair(t, t.TempDir(), server, time.Now()))
+	require.NoError(t, err)
+	config, err := Server(certs, ClientAuthNone, "")
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+
+	proto, err := get(serve(t, config), roots, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/2.0", proto)
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	first, second := issue(t, nil, "localhost"), issue(t, nil, "localhost")
+	start := time.Now().Add(-time.Hour)
+	certs, err := NewCertReloader(writePair(t, dir, first, start))
+	require.NoError(t, err)
+	served := func() *big.Int {
+		cert, err := certs.GetCertificate(nil)
+		require.NoError(t, err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(t, err)
+		return leaf.SerialNumber
+	}
+
+	reloaded, err := certs.Reload()
+	require.NoError(t, err)
+	assert.False(t, reloaded, "unchanged files are not loaded again")
+
+	writePair(t, dir, second, start.Add(time.Minute))
+	reloaded, err = certs.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, second.cert.SerialNumber, served())
+
+	// A certificate replaced before its key does not match it.
+	certFile := filepath.Join(dir, "tls.crt")
+	require.NoError(t, os.WriteFile(certFile, first.pem, 0o600))
+	require.NoError(t, os.Chtimes(certFile, start.Add(2*time.Minute), start.Add(2*time.Minute)))
+	_, err = certs.Reload()
+	assert.Error(t, err)
+	assert.Equal(t, second.cert.SerialNumber, served(), "the current certificate is kept")
+
+	writePair(t, dir, first, start.Add(3*time.Minute))
+	reloaded, err = certs.Reload()
+	require.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, first.cert.SerialNumber, served())
+}
+
+func TestClientAuth(t *testing.T) {
+	server := issue(t, nil, "localhost")
+	certs, err := NewCertReloader(writePair(t, t.TempDir(), server, time.Now()))
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(server.cert)
+
+	ca, otherCA := issue(t, nil, "services-ca"), issue(t, nil, "other-ca")
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0o600))
+	meals := issue(t, ca, "meals").tlsCertificate(t)
+	stranger := issue(t, otherCA, "stranger").tlsCertificate(t)
+
+	tests := []struct {
+		name       string
+		clientAuth string
+		cert       *tls.Certificate
+		ok         bool
+	}{
+		{name: "[001] None without certificate (ok)", clientAuth: ClientAuthNone, ok: true},
+		{name: "[002] Verify without certificate (ok)", clientAuth: ClientAuthVerify, ok: true},
+		{name: "[003] Verify with trusted certificate (ok)", clientAuth: ClientAuthVerify, cert: &meals, ok: true},
+		{name: "[004] Verify with untrusted certificate (error)", clientAuth: ClientAuthVerify, cert: &stranger},
+		{name: "[005] Require without certificate (error)", clientAuth: ClientAuthRequire},
+		{name: "[006] Require with trusted certificate (ok)", clientAuth: ClientAuthRequire, cert: &meals, ok: true},
+		{name: "[007] Require with untrusted certificate (error)", clientAuth: ClientAuthRequire, cert: &stranger},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := Server(certs, tt.clientAuth, caFile)
+			require.NoError(t, err)
+			_, err = get(serve(t, config), roots, tt.cert)
+			if tt.ok {
+				assert.NoError(t, err)
+			} else {
+				assert.Error(t, err)
+			}
+		})
+	}
+
+	_, err = Server(certs, ClientAuthRequire, "")
+	assert.ErrorIs(t, err, ErrNoClientCA)
+	_, err = Server(certs, "always", caFile)
+	assert.Error(t, err)
+}
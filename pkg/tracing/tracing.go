@@ -0,0 +1,90 @@
+package tracing
+
+import (
+	"context"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/semconv/v1.17.0/httpconv"
+	"go.opentelemetry.io/otel/trace"
+	"net/url"
+	"users/pkg/httpstatus"
+)
+
+const tracerName = "users"
+
+// Setup installs the tracer provider exporting the spans of serviceName over
+// OTLP/HTTP to endpoint, a URL such as http://collector:4318, and the W3C
+// trace context propagator. Spans are not exported when endpoint is empty.
+// The function returned flushes the spans left and stops the exporter.
+func Setup(ctx context.Context, endpoint, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(target.Host)}
+	if target.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	if target.Path != "" && target.Path != "/" {
+		options = append(options, otlptracehttp.WithURLPath(target.Path))
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a span as a child of the one in ctx, if any.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// End marks span as failed when err is not nil and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Middleware traces every request as a span named after its route, continuing
+// the trace of the caller when the request has a traceparent header.
+func Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+			ctx, span := Start(ctx, req.Method+" "+c.Path(),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(httpconv.ServerRequest("", req)...),
+				trace.WithAttributes(semconv.HTTPRoute(c.Path())))
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			// The error response is written by the outermost middleware, so
+			// the status it will have is recorded.
+			err := next(c)
+			status := httpstatus.Of(c, err)
+			span.SetAttributes(semconv.HTTPStatusCode(status))
+			span.SetStatus(httpconv.ServerStatus(status))
+			return err
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package webhook
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	body := []byte(`{"type":"user.deleted"}`)
+	now := time.Now().Unix()
+	signature := Sign("secret", now, body)
+
+	assert.NoError(t, Verify("secret", signature, now, body, time.Minute))
+	assert.ErrorIs(t, Verify("other", signature, now, body, time.Minute), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("secret", signature, now, []byte(`{}`), time.Minute), ErrInvalidSignature)
+
+	old := now - 600
+	assert.ErrorIs(t, Verify("secret", Sign("secret", old, body), old, body, time.Minute), ErrExpiredSignature)
+}
+
+func TestNewSecret(t *testing.T) {
+	first, err := NewSecret()
+	assert.NoError(t, err)
+	second, err := NewSecret()
+	assert.NoError(t, err)
+	assert.Len(t, first, 2*secretBytes)
+	assert.NotEqual(t, first, second)
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for _, address := range []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "100.64.0.1", "169.254.169.254", "0.0.0.0", "224.0.0.1", "::1", "fe80::1", "fd00:ec2::254", "::ffff:127.0.0.1", "::"} {
+		assert.False(t, IsPublicIP(net.ParseIP(address)), address)
+	}
+	for _, address := range []string{"203.0.113.10", "8.8.8.8", "2001:4860:4860::8888"} {
+		assert.True(t, IsPublicIP(net.ParseIP(address)), address)
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	assert.ErrorIs(t, CheckURL(context.Background(), "http://169.254.169.254/latest/meta-data"), ErrPrivateAddress)
+	assert.ErrorIs(t, CheckURL(context.Background(), "http://localhost:3100/user"), ErrPrivateAddress)
+	assert.NoError(t, CheckURL(context.Background(), "https://203.0.113.10/hooks"))
+}
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	request := Request{URL: server.URL, Secret: "secret", Body: []byte(`{}`)}
+
+	_, err := Send(context.Background(), NewClient(time.Second, false), request)
+	assert.ErrorIs(t, err, ErrPrivateAddress)
+
+	status, err := Send(context.Background(), NewClient(time.Second, true), request)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, status)
+}